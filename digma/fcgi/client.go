@@ -0,0 +1,300 @@
+package fcgi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// balancing between backends
+const (
+	RoundRobin = "roundrobin"
+	LeastBusy  = "leastbusy"
+)
+
+// idle connections per backend if there is no limit of the requests
+const defaultMaxIdle = 16
+
+// BackendConfig is the address of a FastCGI server, e.g. php-fpm
+type BackendConfig struct {
+	// tcp or unix
+	Network string
+	Addr    string
+	// concurrent requests. 0 = Options.MaxConns
+	MaxConns int
+}
+
+// Options of a Client
+type Options struct {
+	// RoundRobin (default) or LeastBusy
+	Balance string
+	// concurrent requests per backend. 0 = no limit
+	MaxConns int
+	// idle connections kept per backend. default MaxConns or 16 without limit of the requests
+	MaxIdle int
+	// timeout for establishing a connection. default 5s
+	ConnectTimeout time.Duration
+	// timeout for sending a request and reading the response. 0 = no limit
+	Timeout time.Duration
+	// interval of health checks. 0 = no health checks
+	HealthCheck time.Duration
+	// environment of the health check request, e.g. the ping path of php-fpm. nil = connect only
+	Ping map[string]string
+}
+
+// Client sends requests to a list of backends
+type Client struct {
+	backends []*backend
+	opts     Options
+	next     atomic.Uint32
+	done     chan struct{}
+}
+
+type backend struct {
+	BackendConfig
+	// free slots of the concurrency limit. nil = no limit
+	slots   chan struct{}
+	maxIdle int
+	active  atomic.Int32
+	healthy atomic.Bool
+	m       sync.Mutex
+	idle    []*conn
+}
+
+func NewClient(backends []BackendConfig, opts Options) (*Client, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no fastcgi backend configured")
+	}
+	switch opts.Balance {
+	case "":
+		opts.Balance = RoundRobin
+	case RoundRobin, LeastBusy:
+	default:
+		return nil, fmt.Errorf("unknown balancing %s", opts.Balance)
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = 5 * time.Second
+	}
+	c := &Client{opts: opts, done: make(chan struct{})}
+	for _, cfg := range backends {
+		b := &backend{BackendConfig: cfg}
+		if b.MaxConns <= 0 {
+			b.MaxConns = opts.MaxConns
+		}
+		if b.MaxConns > 0 {
+			b.slots = make(chan struct{}, b.MaxConns)
+		}
+		b.maxIdle = opts.MaxIdle
+		if b.maxIdle <= 0 {
+			b.maxIdle = b.MaxConns
+		}
+		if b.maxIdle <= 0 {
+			b.maxIdle = defaultMaxIdle
+		}
+		b.healthy.Store(true)
+		c.backends = append(c.backends, b)
+	}
+	if opts.HealthCheck > 0 {
+		go c.checkHealth()
+	}
+	return c, nil
+}
+
+// Close stops the health checks and closes the idle connections
+func (c *Client) Close() {
+	close(c.done)
+	for _, b := range c.backends {
+		b.m.Lock()
+		for _, cn := range b.idle {
+			cn.Close()
+		}
+		b.idle = nil
+		b.m.Unlock()
+	}
+}
+
+// Do sends a request to a backend and returns the complete response. ctx limits the waiting for a free connection as well.
+// if a backend cannot be reached, the next one is tried
+func (c *Client) Do(ctx context.Context, env map[string]string, stdin []byte) (*Response, error) {
+	buf := &bytes.Buffer{}
+	resp, err := c.Stream(ctx, env, stdin, buf)
+	if err != nil {
+		return nil, err
+	}
+	resp.Stdout = buf.Bytes()
+	return resp, nil
+}
+
+// Stream sends a request to a backend like Do and writes the output of the script to stdout as it arrives.
+// a request is only repeated on another connection or backend before anything has been written
+func (c *Client) Stream(ctx context.Context, env map[string]string, stdin []byte, stdout io.Writer) (*Response, error) {
+	tried := map[*backend]bool{}
+	var lastErr error
+	for len(tried) < len(c.backends) {
+		b := c.pick(tried)
+		tried[b] = true
+		resp, err := c.doBackend(ctx, b, env, stdin, stdout)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		var dialErr *dialError
+		if !errors.As(err, &dialErr) {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+type dialError struct {
+	addr string
+	err  error
+}
+
+func (e *dialError) Error() string {
+	return fmt.Sprintf("cannot connect to fastcgi backend %s: %v", e.addr, e.err)
+}
+
+func (e *dialError) Unwrap() error { return e.err }
+
+func (c *Client) doBackend(ctx context.Context, b *backend, env map[string]string, stdin []byte, stdout io.Writer) (*Response, error) {
+	if b.slots != nil {
+		select {
+		case b.slots <- struct{}{}:
+			defer func() { <-b.slots }()
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no free connection to fastcgi backend %s: %v", b.Addr, ctx.Err())
+		}
+	}
+	b.active.Add(1)
+	defer b.active.Add(-1)
+
+	deadline := time.Time{}
+	if c.opts.Timeout > 0 {
+		deadline = time.Now().Add(c.opts.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	for {
+		cn, reused := b.get()
+		if cn == nil {
+			var err error
+			if cn, err = dial(b.Network, b.Addr, c.opts.ConnectTimeout); err != nil {
+				b.healthy.Store(false)
+				return nil, &dialError{b.Addr, err}
+			}
+			b.healthy.Store(true)
+		}
+		resp, err := cn.do(env, stdin, stdout, deadline)
+		if err != nil {
+			cn.Close()
+			// the backend may have closed an idle connection
+			if reused && !cn.answered && closedByPeer(err) {
+				continue
+			}
+			return nil, fmt.Errorf("fastcgi request to %s failed: %w", b.Addr, err)
+		}
+		b.put(cn)
+		return resp, nil
+	}
+}
+
+func closedByPeer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// healthy backend which has not been tried yet. unhealthy backends are used if there are no others
+func (c *Client) pick(tried map[*backend]bool) *backend {
+	var result *backend
+	start := int(c.next.Add(1))
+	for _, healthy := range []bool{true, false} {
+		for i := range c.backends {
+			b := c.backends[(start+i)%len(c.backends)]
+			if tried[b] || b.healthy.Load() != healthy {
+				continue
+			}
+			if c.opts.Balance == RoundRobin {
+				return b
+			}
+			if result == nil || b.active.Load() < result.active.Load() {
+				result = b
+			}
+		}
+		if result != nil {
+			return result
+		}
+	}
+	return result
+}
+
+// idle connection. nil if there is none
+func (b *backend) get() (*conn, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if n := len(b.idle); n > 0 {
+		cn := b.idle[n-1]
+		b.idle = b.idle[:n-1]
+		return cn, true
+	}
+	return nil, false
+}
+
+// keep a connection for the next request
+func (b *backend) put(cn *conn) {
+	if err := cn.SetDeadline(time.Time{}); err != nil {
+		cn.Close()
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	if len(b.idle) >= b.maxIdle {
+		cn.Close()
+		return
+	}
+	b.idle = append(b.idle, cn)
+}
+
+func (c *Client) checkHealth() {
+	ticker := time.NewTicker(c.opts.HealthCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		for _, b := range c.backends {
+			b.healthy.Store(c.check(b) == nil)
+		}
+	}
+}
+
+// connect to the backend and send the ping request if configured
+func (c *Client) check(b *backend) error {
+	cn, err := dial(b.Network, b.Addr, c.opts.ConnectTimeout)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+	if c.opts.Ping == nil {
+		return nil
+	}
+	_, err = cn.do(c.opts.Ping, nil, io.Discard, time.Now().Add(c.opts.ConnectTimeout))
+	return err
+}
+
+// Healthy reports the state of the backends by address
+func (c *Client) Healthy() map[string]bool {
+	result := map[string]bool{}
+	for _, b := range c.backends {
+		result[b.Addr] = b.healthy.Load()
+	}
+	return result
+}
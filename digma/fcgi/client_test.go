@@ -0,0 +1,250 @@
+package fcgi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// in-process FastCGI responder. the output is the REQUEST_URI of the request
+type testResponder struct {
+	addr     string
+	requests atomic.Int32
+	conns    atomic.Int32
+	// close the connection after every response although the client asked to keep it
+	closeAfter bool
+	delay      time.Duration
+	// protocol status of the end request record
+	status byte
+}
+
+func newTestResponder(t *testing.T, r *testResponder) *testResponder {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	r.addr = l.Addr().String()
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.conns.Add(1)
+			go r.serve(nc)
+		}
+	}()
+	return r
+}
+
+func (r *testResponder) serve(nc net.Conn) {
+	defer nc.Close()
+	c := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	for {
+		env, err := readTestRequest(c)
+		if err != nil {
+			return
+		}
+		r.requests.Add(1)
+		time.Sleep(r.delay)
+		w := bufio.NewWriter(nc)
+		if r.status == statusRequestComplete {
+			c.writeStream(w, typeStdout, []byte("Content-Type: text/plain\r\n\r\n"+env["REQUEST_URI"]))
+			c.writeStream(w, typeStderr, []byte("log"))
+		}
+		end := make([]byte, 8)
+		end[4] = r.status
+		c.writeRecord(w, typeEndRequest, end)
+		if w.Flush() != nil || r.closeAfter {
+			return
+		}
+	}
+}
+
+// read the records of a request up to the end of stdin and decode the params
+func readTestRequest(c *conn) (map[string]string, error) {
+	params := []byte{}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return nil, err
+		}
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:]))+int(header[6]))
+		if _, err := io.ReadFull(c.r, content); err != nil {
+			return nil, err
+		}
+		content = content[:binary.BigEndian.Uint16(header[4:])]
+		switch header[1] {
+		case typeParams:
+			params = append(params, content...)
+		case typeStdin:
+			if len(content) == 0 {
+				return decodeTestParams(params), nil
+			}
+		}
+	}
+}
+
+func decodeTestParams(data []byte) map[string]string {
+	env := map[string]string{}
+	length := func() int {
+		if data[0] < 128 {
+			n := int(data[0])
+			data = data[1:]
+			return n
+		}
+		n := int(binary.BigEndian.Uint32(data) &^ (1 << 31))
+		data = data[4:]
+		return n
+	}
+	for len(data) > 0 {
+		nameLen := length()
+		valueLen := length()
+		env[string(data[:nameLen])] = string(data[nameLen : nameLen+valueLen])
+		data = data[nameLen+valueLen:]
+	}
+	return env
+}
+
+func testEnv(uri string) map[string]string {
+	return map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": uri, "LONG": strings.Repeat("x", 300)}
+}
+
+func TestDo(t *testing.T) {
+	r := newTestResponder(t, &testResponder{})
+	c, err := NewClient([]BackendConfig{{Network: "tcp", Addr: r.addr}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, uri := range []string{"/first", "/second"} {
+		resp, err := c.Do(context.Background(), testEnv(uri), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", uri, err)
+		}
+		if !strings.HasSuffix(string(resp.Stdout), "\r\n\r\n"+uri) || string(resp.Stderr) != "log" {
+			t.Errorf("%s: stdout %q, stderr %q", uri, resp.Stdout, resp.Stderr)
+		}
+	}
+	if n := r.conns.Load(); n != 1 {
+		t.Errorf("keep-alive connection not reused, %d connections", n)
+	}
+}
+
+func TestStaleConnection(t *testing.T) {
+	r := newTestResponder(t, &testResponder{closeAfter: true})
+	c, _ := NewClient([]BackendConfig{{Network: "tcp", Addr: r.addr}}, Options{})
+	defer c.Close()
+	if _, err := c.Do(context.Background(), testEnv("/first"), nil); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	// the responder has closed the idle connection in the meantime
+	time.Sleep(20 * time.Millisecond)
+	resp, err := c.Do(context.Background(), testEnv("/second"), nil)
+	if err != nil {
+		t.Fatalf("request on stale connection not repeated: %v", err)
+	}
+	if !strings.HasSuffix(string(resp.Stdout), "/second") {
+		t.Errorf("stdout %q", resp.Stdout)
+	}
+	if n := r.requests.Load(); n != 2 {
+		t.Errorf("responder got %d requests, expected 2", n)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	r := newTestResponder(t, &testResponder{delay: 500 * time.Millisecond})
+	c, _ := NewClient([]BackendConfig{{Network: "tcp", Addr: r.addr}}, Options{Timeout: 50 * time.Millisecond})
+	defer c.Close()
+	start := time.Now()
+	_, err := c.Do(context.Background(), testEnv("/slow"), nil)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("timeout after %v", d)
+	}
+	if n := r.requests.Load(); n != 1 {
+		t.Errorf("timed out request was repeated, %d requests", n)
+	}
+}
+
+func TestOverloaded(t *testing.T) {
+	r := newTestResponder(t, &testResponder{status: statusOverloaded})
+	c, _ := NewClient([]BackendConfig{{Network: "tcp", Addr: r.addr}}, Options{})
+	defer c.Close()
+	if _, err := c.Do(context.Background(), testEnv("/busy"), nil); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("expected ErrOverloaded, got %v", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+	r := newTestResponder(t, &testResponder{})
+	c, _ := NewClient([]BackendConfig{{Network: "tcp", Addr: down}, {Network: "tcp", Addr: r.addr}}, Options{})
+	defer c.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := c.Do(context.Background(), testEnv("/failover"), nil); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if healthy := c.Healthy(); healthy[down] || !healthy[r.addr] {
+		t.Errorf("health %v", healthy)
+	}
+	if n := r.requests.Load(); n != 4 {
+		t.Errorf("responder got %d requests, expected 4", n)
+	}
+}
+
+func TestMaxIdle(t *testing.T) {
+	r := newTestResponder(t, &testResponder{delay: 50 * time.Millisecond})
+	c, _ := NewClient([]BackendConfig{{Network: "tcp", Addr: r.addr}}, Options{MaxIdle: 2})
+	defer c.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Do(context.Background(), testEnv("/parallel"), nil); err != nil {
+				t.Errorf("request: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	b := c.backends[0]
+	b.m.Lock()
+	idle := len(b.idle)
+	b.m.Unlock()
+	if r.conns.Load() <= 2 || idle != 2 {
+		t.Errorf("%d connections, %d idle, expected more than 2 and 2", r.conns.Load(), idle)
+	}
+}
+
+func TestStream(t *testing.T) {
+	r := newTestResponder(t, &testResponder{})
+	c, _ := NewClient([]BackendConfig{{Network: "tcp", Addr: r.addr}}, Options{})
+	defer c.Close()
+	out := &strings.Builder{}
+	resp, err := c.Stream(context.Background(), testEnv("/stream"), nil, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Stdout) != 0 || !strings.HasSuffix(out.String(), "/stream") {
+		t.Errorf("stdout %q, streamed %q", resp.Stdout, out.String())
+	}
+}
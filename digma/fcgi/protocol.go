@@ -0,0 +1,192 @@
+// Package fcgi is a FastCGI client with pooled keep-alive connections to one or more backends.
+// one request at a time is sent over a connection, requests are not multiplexed
+package fcgi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// record types
+const (
+	typeBeginRequest = 1
+	typeAbortRequest = 2
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+)
+
+// protocol status of the end request record
+const (
+	statusRequestComplete = 0
+	statusCantMultiplex   = 1
+	statusOverloaded      = 2
+	statusUnknownRole     = 3
+)
+
+const (
+	version       = 1
+	roleResponder = 1
+	flagKeepConn  = 1
+	// connections are not multiplexed
+	requestId = 1
+	// maximum content of a record
+	maxContent = 65535
+)
+
+// ErrOverloaded is returned if the backend rejects a request
+var ErrOverloaded = errors.New("fastcgi backend is overloaded")
+
+// Response is the output of a FastCGI responder
+type Response struct {
+	// cgi response with headers and body. empty if the output has been streamed
+	Stdout []byte
+	// error log of the script
+	Stderr []byte
+	// exit status of the application
+	AppStatus uint32
+}
+
+// error of the writer of the output. the request cannot be repeated
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return fmt.Sprintf("cannot write output: %v", e.err) }
+
+func (e *writeError) Unwrap() error { return e.err }
+
+// connection to a backend
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	// set as soon as the backend answered. a failed request on a reused connection without answer can be repeated
+	answered bool
+}
+
+func dial(network string, addr string, timeout time.Duration) (*conn, error) {
+	nc, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: nc, r: bufio.NewReader(nc)}, nil
+}
+
+func (c *conn) writeRecord(w *bufio.Writer, typ byte, content []byte) error {
+	padding := -len(content) & 7
+	header := [8]byte{version, typ}
+	binary.BigEndian.PutUint16(header[2:], requestId)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	header[6] = byte(padding)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// write a stream in records of maximum size and close it with an empty record
+func (c *conn) writeStream(w *bufio.Writer, typ byte, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), maxContent)
+		if err := c.writeRecord(w, typ, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return c.writeRecord(w, typ, nil)
+}
+
+// length of a name or value in the params stream
+func appendLength(buf []byte, n int) []byte {
+	if n < 128 {
+		return append(buf, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(buf, uint32(n)|1<<31)
+}
+
+func encodeParams(env map[string]string) []byte {
+	buf := []byte{}
+	for name, value := range env {
+		buf = appendLength(buf, len(name))
+		buf = appendLength(buf, len(value))
+		buf = append(buf, name...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+// send a request and read the response. stdout gets the output of the script as it arrives.
+// the connection can be reused if there is no error
+func (c *conn) do(env map[string]string, stdin []byte, stdout io.Writer, deadline time.Time) (*Response, error) {
+	c.answered = false
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(c.Conn)
+	begin := []byte{0, roleResponder, flagKeepConn, 0, 0, 0, 0, 0}
+	if err := c.writeRecord(w, typeBeginRequest, begin); err != nil {
+		return nil, err
+	}
+	if err := c.writeStream(w, typeParams, encodeParams(env)); err != nil {
+		return nil, err
+	}
+	if err := c.writeStream(w, typeStdin, stdin); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	resp := &Response{}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return nil, err
+		}
+		c.answered = true
+		if header[0] != version {
+			return nil, fmt.Errorf("invalid fastcgi version %d", header[0])
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		content := make([]byte, length+int(header[6]))
+		if _, err := io.ReadFull(c.r, content); err != nil {
+			return nil, err
+		}
+		content = content[:length]
+		if binary.BigEndian.Uint16(header[2:]) != requestId {
+			continue
+		}
+		switch header[1] {
+		case typeStdout:
+			if _, err := stdout.Write(content); err != nil {
+				return nil, &writeError{err}
+			}
+		case typeStderr:
+			resp.Stderr = append(resp.Stderr, content...)
+		case typeEndRequest:
+			if len(content) < 8 {
+				return nil, fmt.Errorf("invalid fastcgi end request record")
+			}
+			resp.AppStatus = binary.BigEndian.Uint32(content)
+			switch content[4] {
+			case statusRequestComplete:
+				return resp, nil
+			case statusOverloaded:
+				return nil, ErrOverloaded
+			default:
+				return nil, fmt.Errorf("fastcgi request rejected with protocol status %d", content[4])
+			}
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package mediaserver
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Action handles the requests /<collection>/<signature>/<action>/<params>
+// actions of other packages are added with RegisterAction
+type Action interface {
+	// name of the action in the url
+	Name() string
+	// check and normalize the url parameters. invalid parameters are reported as *ParamError
+	Params(params []string) ([]string, error)
+	// action and param of the fullcache row. an empty action skips lookup and access check
+	CacheKey(params []string) (action string, param string)
+	// requests for unknown signatures are rejected with not found
+	NeedsMaster() bool
+	// write the response
+	Produce(ar *ActionRequest) error
+}
+
+// Generator is implemented by actions which create derivatives of the master.
+// the result is written to the storage of the collection and registered in the cache table,
+// so the derivative can be created without a waiting client
+type Generator interface {
+	Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error)
+}
+
+// ProgressGenerator is a Generator which reports its progress between 0 and 1 while creating a derivative
+type ProgressGenerator interface {
+	Generator
+	GenerateProgress(ms *Mediaserver, coll Collection, signature string, params []string, progress func(float64)) (*Entry, error)
+}
+
+// ParamError reports an invalid parameter of an action. results in a bad request
+type ParamError struct {
+	Param string
+	Msg   string
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("invalid parameter %s: %s", e.Param, e.Msg)
+}
+
+// ActionRequest is the context of an action call
+type ActionRequest struct {
+	Mediaserver *Mediaserver
+	Writer      http.ResponseWriter
+	Request     *http.Request
+	Collection  Collection
+	Signature   string
+	Action      string
+	// normalized parameters
+	Params      []string
+	ParamString string
+	// access token of the request
+	Token string
+	// fullcache row of the cache key. nil if there is none
+	Entry *Entry
+
+	cacheAction string
+	cacheParam  string
+	// progress of background jobs
+	progress func(float64)
+}
+
+var (
+	registeredActions = map[string]Action{}
+	registeredM       sync.RWMutex
+)
+
+// RegisterAction adds an action to all mediaservers created afterwards.
+// registered actions replace built-in actions with the same name
+func RegisterAction(a Action) {
+	registeredM.Lock()
+	defer registeredM.Unlock()
+	registeredActions[strings.ToLower(a.Name())] = a
+}
+
+// actions of a mediaserver
+type Actions struct {
+	actions map[string]Action
+}
+
+func newActions(cfg *CfgMediaserver) *Actions {
+	actions := &Actions{actions: map[string]Action{}}
+	for _, a := range []Action{&masterAction{}, &iiifAction{}, &memberAction{}, &replayAction{}, &webrecorderAction{}, &metadataAction{}, &manifestAction{}} {
+		actions.actions[a.Name()] = a
+	}
+	for _, name := range imageActions {
+		if cfg.Images.Native {
+			actions.actions[name] = &imageAction{name: name}
+		} else {
+			// the fcgi backend gets checked parameters only
+			actions.actions[name] = &cachedAction{name: name, specs: fcgiImageParamSpecs}
+		}
+	}
+	if cfg.FFmpeg.Path != "" {
+		actions.actions["transcode"] = &transcodeAction{}
+		actions.actions["poster"] = &posterAction{}
+		actions.actions["hls"] = &hlsAction{}
+		actions.actions["waveform"] = &waveformAction{}
+	}
+	if cfg.PDF.Pdfinfo != "" {
+		if cfg.PDF.Pdftoppm != "" {
+			actions.actions["page"] = &pageAction{}
+		}
+		if cfg.PDF.Pdftotext != "" {
+			actions.actions["text"] = &textAction{}
+		}
+	}
+	registeredM.RLock()
+	for name, a := range registeredActions {
+		actions.actions[name] = a
+	}
+	registeredM.RUnlock()
+	return actions
+}
+
+// action by name. unknown actions are handled by the fcgi backend
+func (as *Actions) Get(name string) Action {
+	if a, ok := as.actions[strings.ToLower(name)]; ok {
+		return a
+	}
+	return &cachedAction{name: name}
+}
+
+// names of all actions
+func (as *Actions) Names() []string {
+	names := []string{}
+	for name := range as.actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lowercase and sort parameters, empty parameters are removed
+func sortedParams(params []string) []string {
+	result := []string{}
+	for _, param := range params {
+		if param != "" {
+			result = append(result, strings.ToLower(param))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// master file
+type masterAction struct{}
+
+func (a *masterAction) Name() string { return "master" }
+
+func (a *masterAction) Params(params []string) ([]string, error) { return sortedParams(params), nil }
+
+func (a *masterAction) CacheKey(params []string) (string, string) {
+	return "master", strings.Join(params, "/")
+}
+
+func (a *masterAction) NeedsMaster() bool { return false }
+
+func (a *masterAction) Produce(ar *ActionRequest) error { return ar.ServeEntry(nil) }
+
+// derivatives from the cache table. missing ones are created by the fcgi backend
+type cachedAction struct {
+	name string
+	// parameters of the action. nil for unknown actions
+	specs ParamSpecs
+}
+
+func (a *cachedAction) Name() string { return a.name }
+
+func (a *cachedAction) Params(params []string) ([]string, error) {
+	if a.specs == nil {
+		return sortedParams(params), nil
+	}
+	return a.specs.Canonical(params)
+}
+
+func (a *cachedAction) CacheKey(params []string) (string, string) {
+	return a.name, strings.Join(params, "/")
+}
+
+func (a *cachedAction) NeedsMaster() bool { return false }
+
+func (a *cachedAction) Produce(ar *ActionRequest) error { return ar.ServeEntry(nil) }
+
+// Error writes an error page
+func (ar *ActionRequest) Error(status int, message string) error {
+	ar.Mediaserver.DoPanic(ar.Writer, ar.Request, status, message)
+	return fmt.Errorf("%s", message)
+}
+
+// request for another derivative of the same master, e.g. the pyramidal tiff of an iiif request
+func (ar *ActionRequest) derivativeRequest(action string, params []string) *ActionRequest {
+	dr := &ActionRequest{
+		Mediaserver: ar.Mediaserver,
+		Writer:      ar.Writer,
+		Request:     ar.Request,
+		Collection:  ar.Collection,
+		Signature:   ar.Signature,
+		Action:      action,
+		Params:      params,
+		ParamString: strings.Join(params, "/"),
+		Token:       ar.Token,
+	}
+	dr.cacheAction, dr.cacheParam = ar.Mediaserver.actions.Get(action).CacheKey(params)
+	return dr
+}
+
+// EnsureEntry creates the missing derivative of the request with gen or the fcgi or http backend.
+// returns false if the response has already been written, e.g. an error, a job or the output of the backend
+func (ar *ActionRequest) EnsureEntry(gen Generator) (bool, error) {
+	if ar.Entry != nil {
+		return true, nil
+	}
+	if ar.async() {
+		return false, ar.enqueue()
+	}
+	val, err := ar.generate(gen)
+	if err != nil {
+		if _, ok := err.(*ParamError); ok {
+			return false, ar.Error(http.StatusBadRequest, err.Error())
+		}
+		if gen == nil {
+			return false, ar.Error(http.StatusBadGateway, err.Error())
+		}
+		return false, ar.Error(http.StatusInternalServerError, fmt.Sprintf("Cannot create %s/%s/%s/%s: %s", ar.Collection.name, ar.Signature, ar.cacheAction, ar.cacheParam, err.Error()))
+	}
+	switch resp := val.(type) {
+	case *streamedResponse:
+		if resp.ar == ar {
+			return false, resp.err
+		}
+		// the response went to another client, the backend should have registered the derivative
+		ms := ar.Mediaserver
+		ms.lookup.Invalidate(ar.Collection.id, ar.Signature, ar.cacheAction, ar.cacheParam)
+		entry, err := ms.lookup.Entry(ar.Collection.id, ar.Signature, ar.cacheAction, ar.cacheParam)
+		if err != nil {
+			return false, ar.fallbackBackend(ar.cacheAction)
+		}
+		ar.Entry = entry
+		return true, nil
+	}
+	ar.Entry = val.(*Entry)
+	return true, nil
+}
+
+// ServeEntry delivers the fullcache row of the request.
+// a missing derivative is created by gen. without generator the request is forwarded to the fcgi backend
+func (ar *ActionRequest) ServeEntry(gen Generator) error {
+	ms := ar.Mediaserver
+	if ok, err := ar.EnsureEntry(gen); !ok {
+		return err
+	}
+	entry := ar.Entry
+	fs, err := ms.storages.FS(entry.filebase)
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Cannot access storage %s: %s", entry.filebase, err.Error()))
+	}
+	if !entry.jwtkey.Valid {
+		ar.Writer.Header().Set("Cache-Control", ms.cfg.Mediaserver.CacheControl)
+	}
+	if err := ar.verifyFixity(fs); err != nil {
+		return err
+	}
+	if entry.mimetype != "" {
+		ar.Writer.Header().Set("Content-Type", entry.mimetype)
+	}
+	return ms.serveStorageFile(ar.Writer, ar.Request, fs, entry.path)
+}
+
+// check the checksum of the entry if configured
+func (ar *ActionRequest) verifyFixity(fs StorageFS) error {
+	ms := ar.Mediaserver
+	if !ms.cfg.Mediaserver.Fixity.Verify || ar.Request.URL.Query().Get("version") != "" {
+		return nil
+	}
+	entry := ar.Entry
+	if err := ms.fixity.Verify(fs, storageURI(entry.filebase, entry.path), entry.path, ar.Collection.id, ar.Signature, ar.cacheAction, ar.cacheParam); err != nil {
+		return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Fixity check of %s/%s/%s/%s failed: %s", ar.Collection.name, ar.Signature, ar.cacheAction, ar.cacheParam, err.Error()))
+	}
+	return nil
+}
+
+// query handler
+func (ms *Mediaserver) Handler(writer http.ResponseWriter, req *http.Request, collection string, signature string, action string, params []string) (err error) {
+	var (
+		jwtkey  sql.NullString
+		private int
+	)
+	//	writer.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// collections are refreshed in the background, unknown names don't trigger a reload
+	coll, err := ms.collections.ByName(collection)
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusNotFound, err.Error())
+		return err
+	}
+
+	a := ms.actions.Get(action)
+	rawParams := params
+	params, err = a.Params(params)
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusBadRequest, err.Error())
+		return err
+	}
+	if ms.cfg.Mediaserver.CanonicalRedirect {
+		if target, ok := ms.canonicalURL(req, collection, signature, action, rawParams, params); !ok {
+			http.Redirect(writer, req, target, http.StatusMovedPermanently)
+			return nil
+		}
+	}
+	ar := &ActionRequest{
+		Mediaserver: ms,
+		Writer:      writer,
+		Request:     req,
+		Collection:  coll,
+		Signature:   signature,
+		Action:      action,
+		Params:      params,
+		ParamString: strings.Join(params, "/"),
+	}
+	ar.cacheAction, ar.cacheParam = a.CacheKey(params)
+	// get token from uri parameter
+	// sometimes auth is used instead of token...
+	if token, ok := req.URL.Query()["token"]; ok {
+		ar.Token = token[0]
+	} else if token, ok := req.URL.Query()["auth"]; ok {
+		ar.Token = token[0]
+	}
+	if ar.cacheAction == "" {
+		return a.Produce(ar)
+	}
+	ms.logger.Debug("QUERY: /" + collection + "[" + fmt.Sprint(coll.id) + "]/" + signature + "/" + ar.cacheAction + "/" + ar.cacheParam)
+
+	exists := true
+	entry, err := ms.lookup.Entry(coll.id, signature, ar.cacheAction, ar.cacheParam)
+	if err == nil {
+		ar.Entry = entry
+		jwtkey, private = entry.jwtkey, entry.private
+	} else {
+		master, err := ms.lookup.Master(coll.id, signature)
+		if err != nil {
+			exists = false
+			ms.logger.Debug(fmt.Sprintf("could not find in databbase [%s/%s] - %v", collection, signature, err))
+		} else {
+			jwtkey, private = master.jwtkey, master.private
+		}
+	}
+
+	ms.logger.Debugf("%s/%s: found: %v // exists: %v // private: %v // jwtkey.Valid: %v", collection, signature, ar.Entry != nil, exists, private, jwtkey.Valid)
+	if exists && private == 1 && jwtkey.Valid {
+		if ar.Token == "" {
+			ms.DoPanic(writer, req, http.StatusForbidden, fmt.Sprintf("no access token"))
+			return fmt.Errorf("no access token")
+		}
+		sub := strings.ToLower(strings.TrimRight(ms.cfg.SubPrefix+collection+"/"+signature+"/"+action+"/"+ar.ParamString, "/"))
+		if err := CheckJWT(ar.Token, jwtkey.String, sub); err != nil {
+			// tokens created before the canonicalization of the parameters
+			legacy := strings.ToLower(strings.TrimRight(ms.cfg.SubPrefix+collection+"/"+signature+"/"+action+"/"+strings.Join(sortedParams(rawParams), "/"), "/"))
+			if legacy == sub || CheckJWT(ar.Token, jwtkey.String, legacy) != nil {
+				ms.DoPanic(writer, req, http.StatusForbidden, err.Error())
+				return err
+			}
+		}
+	}
+	if !exists && a.NeedsMaster() {
+		ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("could not find master of %s/%s", collection, signature))
+		return fmt.Errorf("could not find master of %s/%s", collection, signature)
+	}
+	return a.Produce(ar)
+}
+
+// url of the canonical parameters. ok is true if the request already uses them
+func (ms *Mediaserver) canonicalURL(req *http.Request, collection string, signature string, action string, raw []string, params []string) (target string, ok bool) {
+	given := []string{}
+	for _, param := range raw {
+		if param != "" {
+			given = append(given, param)
+		}
+	}
+	if strings.Join(given, "/") == strings.Join(params, "/") || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return "", true
+	}
+	target = strings.TrimRight(ms.cfg.Mediaserver.Alias, "/") + "/" + collection + "/" + signature + "/" + action
+	if len(params) > 0 {
+		target += "/" + strings.Join(params, "/")
+	}
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	return target, false
+}
@@ -0,0 +1,46 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// check the access token of an administration request. without secret there is no access
+func (ms *Mediaserver) checkAdmin(writer http.ResponseWriter, req *http.Request) bool {
+	secret := ms.cfg.Mediaserver.Admin.Secret
+	if secret == "" {
+		ms.DoPanic(writer, req, http.StatusForbidden, "no admin secret configured")
+		return false
+	}
+	token, ok := req.URL.Query()["token"]
+	if !ok {
+		token, ok = req.URL.Query()["auth"]
+	}
+	if !ok {
+		ms.DoPanic(writer, req, http.StatusForbidden, fmt.Sprintf("no access token"))
+		return false
+	}
+	sub := ms.cfg.SubPrefix + req.URL.EscapedPath()
+	if err := CheckJWT(token[0], secret, sub); err != nil {
+		ms.DoPanic(writer, req, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// json output of the cache statistics
+func (ms *Mediaserver) HandlerStats(writer http.ResponseWriter, req *http.Request) (err error) {
+	if !ms.checkAdmin(writer, req) {
+		return fmt.Errorf("access denied")
+	}
+	stats := map[string]interface{}{
+		"lookupcache": ms.lookup.Stats(),
+	}
+	if ms.iiifCache != nil {
+		stats["iiifcache"] = ms.iiifCache.Stats()
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(writer).Encode(stats)
+}
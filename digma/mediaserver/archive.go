@@ -0,0 +1,392 @@
+package mediaserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum number of archive indexes kept in memory
+const archiveCacheSize = 200
+
+// entry of a zip or tar container
+type archiveEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	// tar: start of data
+	offset int64
+	// zip: header of the member and offset of the compressed data (computed on first use)
+	zipFile    *zip.File
+	zipOffset  int64
+	zipOffsetM sync.Mutex
+}
+
+// index of the members of a container
+type archiveIndex struct {
+	size    int64
+	modTime time.Time
+	entries map[string]*archiveEntry
+	used    time.Time
+}
+
+// archive indexes by storage uri
+type archiveCache struct {
+	indexes map[string]*archiveIndex
+	m       sync.Mutex
+}
+
+func newArchiveCache() *archiveCache {
+	return &archiveCache{indexes: make(map[string]*archiveIndex)}
+}
+
+// ReaderAt on a storage file. outside of index creation the file is opened on every call
+type storageReaderAt struct {
+	fs      StorageFS
+	name    string
+	version string
+	file    StorageFile
+	m       sync.Mutex
+}
+
+func (sra *storageReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	sra.m.Lock()
+	file := sra.file
+	sra.m.Unlock()
+	if file != nil {
+		return file.ReadAt(p, off)
+	}
+	file, err := openStorageVersion(sra.fs, sra.name, sra.version)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(p, off)
+}
+
+func (sra *storageReaderAt) setFile(file StorageFile) {
+	sra.m.Lock()
+	defer sra.m.Unlock()
+	sra.file = file
+}
+
+// buffered ReadSeeker on a ReaderAt. keeps the number of reads on remote storages low
+type blockReader struct {
+	r     io.ReaderAt
+	size  int64
+	pos   int64
+	buf   []byte
+	start int64
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	if br.pos >= br.size {
+		return 0, io.EOF
+	}
+	if br.pos < br.start || br.pos >= br.start+int64(len(br.buf)) {
+		buf := make([]byte, 64*1024)
+		n, err := br.r.ReadAt(buf, br.pos)
+		if n == 0 && err != nil {
+			return 0, err
+		}
+		br.buf = buf[:n]
+		br.start = br.pos
+	}
+	n := copy(p, br.buf[br.pos-br.start:])
+	br.pos += int64(n)
+	return n, nil
+}
+
+func (br *blockReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += br.pos
+	case io.SeekEnd:
+		offset += br.size
+	default:
+		return br.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return br.pos, fmt.Errorf("negative position %d", offset)
+	}
+	br.pos = offset
+	return offset, nil
+}
+
+// ReadSeeker for deflated members. seeking backwards restarts decompression
+type inflateSeeker struct {
+	open func() io.ReadCloser
+	size int64
+	r    io.ReadCloser
+	rpos int64
+	pos  int64
+}
+
+func (is *inflateSeeker) Read(p []byte) (int, error) {
+	if is.r != nil && is.rpos > is.pos {
+		is.r.Close()
+		is.r = nil
+	}
+	if is.r == nil {
+		is.r = is.open()
+		is.rpos = 0
+	}
+	if is.rpos < is.pos {
+		n, err := io.CopyN(io.Discard, is.r, is.pos-is.rpos)
+		is.rpos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := is.r.Read(p)
+	is.rpos += int64(n)
+	is.pos = is.rpos
+	return n, err
+}
+
+func (is *inflateSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += is.pos
+	case io.SeekEnd:
+		offset += is.size
+	default:
+		return is.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return is.pos, fmt.Errorf("negative position %d", offset)
+	}
+	is.pos = offset
+	return offset, nil
+}
+
+func (is *inflateSeeker) Close() error {
+	if is.r != nil {
+		return is.r.Close()
+	}
+	return nil
+}
+
+// get the index of the container name. the index is rebuilt if size or modification time changed
+func (ac *archiveCache) get(fs StorageFS, uri string, name string, version string, file StorageFile) (*archiveIndex, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ac.m.Lock()
+	idx, ok := ac.indexes[uri]
+	if ok && idx.size == stat.Size() && idx.modTime.Equal(stat.ModTime()) {
+		idx.used = time.Now()
+		ac.m.Unlock()
+		return idx, nil
+	}
+	ac.m.Unlock()
+
+	header := make([]byte, 512)
+	n, err := file.ReadAt(header, 0)
+	if n == 0 && err != nil {
+		return nil, err
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		idx, err = newZipIndex(fs, name, version, file, stat.Size())
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		idx, err = newTarIndex(file, stat.Size())
+	default:
+		return nil, fmt.Errorf("%s is not a zip or tar container", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx.size = stat.Size()
+	idx.modTime = stat.ModTime()
+	idx.used = time.Now()
+
+	ac.m.Lock()
+	defer ac.m.Unlock()
+	if len(ac.indexes) >= archiveCacheSize {
+		// remove least recently used index
+		var oldest string
+		for key, i := range ac.indexes {
+			if oldest == "" || i.used.Before(ac.indexes[oldest].used) {
+				oldest = key
+			}
+		}
+		delete(ac.indexes, oldest)
+	}
+	ac.indexes[uri] = idx
+	return idx, nil
+}
+
+// index from the zip central directory
+func newZipIndex(fs StorageFS, name string, version string, file StorageFile, size int64) (*archiveIndex, error) {
+	sra := &storageReaderAt{fs: fs, name: name, version: version}
+	sra.setFile(file)
+	defer sra.setFile(nil)
+	zr, err := zip.NewReader(sra, size)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read zip directory of %s: %v", name, err)
+	}
+	idx := &archiveIndex{entries: make(map[string]*archiveEntry)}
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "/") {
+			continue
+		}
+		idx.entries[strings.TrimLeft(path.Clean("/"+zf.Name), "/")] = &archiveEntry{
+			name:      zf.Name,
+			size:      int64(zf.UncompressedSize64),
+			modTime:   zf.Modified,
+			zipFile:   zf,
+			zipOffset: -1,
+		}
+	}
+	return idx, nil
+}
+
+// index of the regular files in a tar container
+func newTarIndex(file StorageFile, size int64) (*archiveIndex, error) {
+	br := &blockReader{r: file, size: size}
+	tr := tar.NewReader(br)
+	idx := &archiveIndex{entries: make(map[string]*archiveEntry)}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read tar header: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		idx.entries[strings.TrimLeft(path.Clean("/"+hdr.Name), "/")] = &archiveEntry{
+			name:    hdr.Name,
+			size:    hdr.Size,
+			modTime: hdr.ModTime,
+			offset:  br.pos,
+		}
+	}
+	return idx, nil
+}
+
+// content of a member as ReadSeeker
+func (entry *archiveEntry) open(file StorageFile) (io.ReadSeeker, error) {
+	if entry.zipFile == nil {
+		return io.NewSectionReader(file, entry.offset, entry.size), nil
+	}
+	entry.zipOffsetM.Lock()
+	if entry.zipOffset < 0 {
+		offset, err := entry.zipFile.DataOffset()
+		if err != nil {
+			entry.zipOffsetM.Unlock()
+			return nil, err
+		}
+		entry.zipOffset = offset
+	}
+	offset := entry.zipOffset
+	entry.zipOffsetM.Unlock()
+
+	compressedSize := int64(entry.zipFile.CompressedSize64)
+	switch entry.zipFile.Method {
+	case zip.Store:
+		return io.NewSectionReader(file, offset, compressedSize), nil
+	case zip.Deflate:
+		return &inflateSeeker{
+			open: func() io.ReadCloser {
+				return flate.NewReader(io.NewSectionReader(file, offset, compressedSize))
+			},
+			size: entry.size,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d for %s", entry.zipFile.Method, entry.name)
+	}
+}
+
+// serve a member of a zip or tar container from a storage
+func (ms *Mediaserver) serveArchiveMember(writer http.ResponseWriter, req *http.Request, fs StorageFS, uri string, name string, member string) (err error) {
+	version := req.URL.Query().Get("version")
+	if version != "" {
+		uri += "?version=" + version
+	}
+	file, err := openStorageVersion(fs, name, version)
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("Container not found: %s - %s", name, err.Error()))
+		return err
+	}
+	defer file.Close()
+
+	idx, err := ms.archives.get(fs, uri, name, version, file)
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("Cannot read container %s: %s", name, err.Error()))
+		return err
+	}
+	entry, ok := idx.entries[strings.TrimLeft(path.Clean("/"+member), "/")]
+	if !ok {
+		err = &os.PathError{Op: "open", Path: member, Err: os.ErrNotExist}
+		ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("Container %s does not contain %s", name, member))
+		return err
+	}
+	content, err := entry.open(file)
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Cannot open %s in %s: %s", member, name, err.Error()))
+		return err
+	}
+	if closer, ok := content.(io.Closer); ok {
+		defer closer.Close()
+	}
+	http.ServeContent(writer, req, path.Base(entry.name), entry.modTime, content)
+	return nil
+}
+
+// member of a zip or tar master. the parameters are the path of the member
+type memberAction struct{}
+
+func (a *memberAction) Name() string { return "member" }
+
+// members are addressed by path, so case and order of the params are kept
+func (a *memberAction) Params(params []string) ([]string, error) {
+	result := []string{}
+	for _, param := range params {
+		if param != "" {
+			result = append(result, param)
+		}
+	}
+	if len(result) == 0 {
+		return nil, &ParamError{"member", "no member given"}
+	}
+	return result, nil
+}
+
+func (a *memberAction) CacheKey(params []string) (string, string) { return "master", "" }
+
+func (a *memberAction) NeedsMaster() bool { return true }
+
+func (a *memberAction) Produce(ar *ActionRequest) error {
+	ms := ar.Mediaserver
+	if ar.Entry == nil {
+		return ar.Error(http.StatusNotFound, fmt.Sprintf("could not find master of %s/%s", ar.Collection.name, ar.Signature))
+	}
+	fs, err := ms.storages.FS(ar.Entry.filebase)
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Cannot access storage %s: %s", ar.Entry.filebase, err.Error()))
+	}
+	if !ar.Entry.jwtkey.Valid {
+		ar.Writer.Header().Set("Cache-Control", ms.cfg.Mediaserver.CacheControl)
+	}
+	if err := ar.verifyFixity(fs); err != nil {
+		return err
+	}
+	return ms.serveArchiveMember(ar.Writer, ar.Request, fs, storageURI(ar.Entry.filebase, ar.Entry.path), ar.Entry.path, ar.ParamString)
+}
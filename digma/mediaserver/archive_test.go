@@ -0,0 +1,145 @@
+package mediaserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+// mediaserver for handler tests. errors are written with the template of the repository
+func newTestMediaserver() *Mediaserver {
+	return &Mediaserver{
+		cfg:      &Config{ErrorTemplate: "../../error.html"},
+		archives: newArchiveCache(),
+		logger:   logging.MustGetLogger("test"),
+	}
+}
+
+// members of the test containers
+var testMembers = map[string]string{
+	"readme.txt":        "read me",
+	"dir/data.txt":      strings.Repeat("0123456789", 1000),
+	"dir/sub/Image.JPG": "jpeg",
+}
+
+func writeTestZip(t *testing.T, name string, method uint16, members map[string]string) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	if _, err := zw.CreateHeader(&zip.FileHeader{Name: "dir/", Method: zip.Store}); err != nil {
+		t.Fatal(err)
+	}
+	for member, content := range members {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: member, Method: method, Modified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTar(t *testing.T, name string) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "readme.txt"})
+	for member, content := range testMembers {
+		// tar writers often store relative names with ./
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + member, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), ModTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveMember(t *testing.T) {
+	dir := t.TempDir()
+	writeTestZip(t, filepath.Join(dir, "deflate.zip"), zip.Deflate, testMembers)
+	writeTestZip(t, filepath.Join(dir, "store.zip"), zip.Store, testMembers)
+	writeTestTar(t, filepath.Join(dir, "test.tar"))
+	os.WriteFile(filepath.Join(dir, "plain.txt"), []byte("no container"), 0644)
+	fs := &localFS{root: dir}
+	ms := newTestMediaserver()
+
+	data := testMembers["dir/data.txt"]
+	tests := []struct {
+		container string
+		member    string
+		rangeHdr  string
+		status    int
+		body      string
+	}{
+		{"deflate.zip", "readme.txt", "", http.StatusOK, "read me"},
+		{"deflate.zip", "dir/data.txt", "", http.StatusOK, data},
+		{"deflate.zip", "dir/data.txt", "bytes=5000-5009", http.StatusPartialContent, data[5000:5010]},
+		{"deflate.zip", "dir/data.txt", "bytes=-5", http.StatusPartialContent, data[len(data)-5:]},
+		{"store.zip", "dir/data.txt", "bytes=10-19", http.StatusPartialContent, data[10:20]},
+		{"store.zip", "/dir/./sub/Image.JPG", "", http.StatusOK, "jpeg"},
+		{"test.tar", "dir/data.txt", "bytes=100-104", http.StatusPartialContent, data[100:105]},
+		{"test.tar", "dir/sub/Image.JPG", "", http.StatusOK, "jpeg"},
+		{"test.tar", "../readme.txt", "", http.StatusOK, "read me"},
+		// member names are case sensitive
+		{"store.zip", "dir/sub/image.jpg", "", http.StatusNotFound, ""},
+		{"deflate.zip", "dir", "", http.StatusNotFound, ""},
+		{"test.tar", "link", "", http.StatusNotFound, ""},
+		{"test.tar", "missing.txt", "", http.StatusNotFound, ""},
+		{"plain.txt", "readme.txt", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.rangeHdr != "" {
+			req.Header.Set("Range", test.rangeHdr)
+		}
+		rec := httptest.NewRecorder()
+		ms.serveArchiveMember(rec, req, fs, storageURI("file:///test", test.container), test.container, test.member)
+		if rec.Code != test.status {
+			t.Errorf("%s %s %s: status %d, expected %d", test.container, test.member, test.rangeHdr, rec.Code, test.status)
+			continue
+		}
+		if test.status < 300 && rec.Body.String() != test.body {
+			t.Errorf("%s %s %s: body %.40q, expected %.40q", test.container, test.member, test.rangeHdr, rec.Body.String(), test.body)
+		}
+	}
+}
+
+// the index is rebuilt if the container changes
+func TestArchiveIndexChanged(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test.zip")
+	writeTestZip(t, name, zip.Store, testMembers)
+	fs := &localFS{root: dir}
+	ms := newTestMediaserver()
+	uri := storageURI("file:///test", "test.zip")
+
+	rec := httptest.NewRecorder()
+	ms.serveArchiveMember(rec, httptest.NewRequest(http.MethodGet, "/", nil), fs, uri, "test.zip", "new.txt")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d", rec.Code)
+	}
+	writeTestZip(t, name, zip.Store, map[string]string{"new.txt": "new"})
+	rec = httptest.NewRecorder()
+	ms.serveArchiveMember(rec, httptest.NewRequest(http.MethodGet, "/", nil), fs, uri, "test.zip", "new.txt")
+	if rec.Code != http.StatusOK || rec.Body.String() != "new" {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
@@ -3,9 +3,6 @@ package mediaserver
 import (
 	"fmt"
 	"net/http"
-	"os"
-	"path"
-	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -31,27 +28,10 @@ func (ms *Mediaserver) AuthFileSrvHandler(w http.ResponseWriter, req *http.Reque
 		}
 	}
 
-	filePath := strings.TrimRight(basePath, "/") + "/" + strings.TrimLeft(params.ByName("path"), "/")
-	_, fileName := path.Split(filePath)
-
-	fileStat, err := os.Stat(filePath)
+	fs, err := ms.storages.FS(basePath)
 	if err != nil {
-		ms.DoPanic(w, req, http.StatusNotFound, err.Error())
+		ms.DoPanic(w, req, http.StatusInternalServerError, fmt.Sprintf("Cannot access %s: %s", alias, err.Error()))
 		return
 	}
-
-	if fileStat.IsDir() {
-		ms.DoPanic(w, req, http.StatusForbidden, fmt.Sprintf("Access denied to folder %s", fileName))
-		return
-	}
-
-	file, err := os.Open(filePath)
-	if err != nil {
-		ms.DoPanic(w, req, http.StatusNotFound, fmt.Sprintf("Collection %s does not contain file %s", alias, fileName ))
-		return
-	}
-	defer file.Close()
-
-	t := fileStat.ModTime()
-	http.ServeContent(w, req, fileName, t, file)
+	ms.serveStorageFile(w, req, fs, params.ByName("path"))
 }
@@ -3,7 +3,7 @@ package mediaserver
 import (
 	"database/sql"
 	"errors"
-	"log"
+	"fmt"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,54 +17,67 @@ type Collections struct {
 }
 
 type Collection struct {
-	id   int
-	name string
+	id        int
+	name      string
+	storageid int
 }
 
+func (c Collection) Id() int      { return c.id }
+func (c Collection) Name() string { return c.name }
+
 // Create a new Mediaserver
 // db Database Handle
-func NewCollections(db *sql.DB) *Collections {
+func NewCollections(db *sql.DB) (*Collections, error) {
 	collections := &Collections{
-		db: db,
-		m:  sync.RWMutex{},
+		db:          db,
+		collections: make(map[string]Collection),
+		m:           sync.RWMutex{},
 	}
-	collections.Init()
-	return collections
+	err := collections.Init()
+	return collections, err
 }
 
 // constructor
-// load all collections into a map
+// load all collections into a new map and swap it with the current one.
+// on errors the current collections are kept
 func (colls *Collections) Init() (err error) {
 	var (
-		id   int
-		name string
+		id        int
+		name      string
+		storageid int
 	)
-	colls.m.Lock()
-	defer colls.m.Unlock()
-	// initialize maps
-	colls.collections = make(map[string]Collection)
+	collections := make(map[string]Collection)
 	// get all collections
-	rows, err := colls.db.Query("select collectionid as id, name from collection")
+	rows, err := colls.db.Query("select collectionid as id, name, storageid from collection")
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("cannot query collections: %v", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		err := rows.Scan(&id, &name)
+		err := rows.Scan(&id, &name, &storageid)
 		if err != nil {
-			log.Fatal(err)
-			break
+			return fmt.Errorf("cannot scan collection: %v", err)
 		}
 		// add collection to map
-		colls.collections[strings.ToLower(name)] = Collection{name: name, id: id}
+		collections[strings.ToLower(name)] = Collection{name: name, id: id, storageid: storageid}
 	}
 	err = rows.Err()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("cannot read collections: %v", err)
 	}
+	colls.m.Lock()
+	colls.collections = collections
+	colls.m.Unlock()
 	return
 }
 
+// number of collections
+func (colls *Collections) Len() int {
+	colls.m.RLock()
+	defer colls.m.RUnlock()
+	return len(colls.collections)
+}
+
 func (colls *Collections) ByName(name string) (c Collection, err error) {
 	colls.m.RLock()
 	defer colls.m.RUnlock()
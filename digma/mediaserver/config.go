@@ -2,6 +2,7 @@ package mediaserver
 
 import (
 	"log"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -22,23 +23,175 @@ type Config struct {
 }
 
 type CfgMediaserver struct {
-	DB           database `toml:"database"`
-	FCGI         fcgi     `toml:"fcgi"`
-	IIIF         iiif     `toml:"iiif"`
+	DB           database    `toml:"database"`
+	FCGI         fcgi        `toml:"fcgi"`
+	HTTPBackend  httpbackend `toml:"httpbackend"`
+	IIIF         iiif        `toml:"iiif"`
+	S3           s3cfg       `toml:"s3"`
+	Fixity       fixity      `toml:"fixity"`
+	LookupCache  lookupcache `toml:"lookupcache"`
+	Admin        admin       `toml:"admin"`
+	Derivatives  derivatives `toml:"derivatives"`
+	Images       images      `toml:"images"`
+	Jobs         jobs        `toml:"jobs"`
+	FFmpeg       ffmpegcfg   `toml:"ffmpeg"`
+	HLS          hls         `toml:"hls"`
+	PDF          pdfcfg      `toml:"pdf"`
 	Alias        string
 	CacheControl string
+	// redirect requests with non-canonical parameters, e.g. size0200x200 to size200x200
+	CanonicalRedirect bool
+	// interval for reloading collections and storages. default 10m, negative = no refresh
+	Refresh time.Duration
 }
 
+// fcgi backend. additional backends are configured as [[mediaserver.fcgi.backend]]
 type fcgi struct {
-	Proto  string
-	Addr   string
-	Script string
+	Proto    string
+	Addr     string
+	Script   string
+	Backends []fcgiBackend `toml:"backend"`
+	// roundrobin or leastbusy
+	Balance string
+	// concurrent requests per backend. 0 = no limit
+	MaxConns int
+	// idle connections per backend. default maxconns or 16
+	MaxIdle        int
+	ConnectTimeout time.Duration
+	// maximum time for a request. 0 = no limit
+	Timeout time.Duration
+	// interval of health checks. 0 = no checks
+	HealthCheck time.Duration
+	// ping path of php-fpm (pm.status_path/ping.path) for health checks. empty = connect only
+	Ping string
+}
+
+type fcgiBackend struct {
+	Proto    string
+	Addr     string
+	MaxConns int
+}
+
+// http(s) derivative service instead of the fcgi backend. empty url disables it
+type httpbackend struct {
+	URL string
+	// bearer token for the service
+	Secret string
+	// maximum time until the response headers arrive. 0 = no limit
+	Timeout time.Duration
 }
 
 type iiif struct {
 	URL      string
 	IIIFBase string
 	Alias    string
+	// serve the image api from the pyramidal tiffs instead of forwarding to the iiif server at URL
+	Native bool
+	// limits of the output size of the native image api. maxwidth 0 = no limit, maxheight defaults to maxwidth,
+	// maxarea defaults to 25000000
+	MaxWidth  int
+	MaxHeight int
+	MaxArea   int64
+	// manifests per page of the iiif collections. default 1000
+	PageSize int
+	// lifetime of the access tokens in manifests and image services of private items. default 2h
+	TokenTTL time.Duration
+	Cache    iiifcache `toml:"cache"`
+}
+
+// disk cache for responses of the iiif server. empty dir disables the cache
+type iiifcache struct {
+	Dir string
+	// size in bytes. default 1 GiB. existing entries above the size are removed at startup
+	MaxSize int64
+	TTL     time.Duration
+}
+
+// endpoint and credentials for s3:// storages
+type s3cfg struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Region    string
+}
+
+// verify checksums of files before they are served. results are kept for ttl, default 1h
+type fixity struct {
+	Verify bool
+	TTL    time.Duration
+}
+
+// in-memory cache for database lookups. size 0 disables the cache
+type lookupcache struct {
+	Size        int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+}
+
+// administration routes. requests need a token for the secret
+type admin struct {
+	Alias  string
+	Secret string
+}
+
+// location of derivatives created by the mediaserver itself
+type derivatives struct {
+	// folder on the storage of the collection. default "derivate"
+	Folder string
+	// folder for temporary files. default os.TempDir()
+	TempDir string
+	// serialize the generation of a derivative across instances with a mysql named lock
+	Lock        bool
+	LockTimeout time.Duration
+}
+
+// native image pipeline for resize, convert and rotate instead of the fcgi backend
+type images struct {
+	Native bool
+	// jpeg quality, webp is written lossless. default 85
+	Quality int
+	// masters with more pixels are refused. default 50000000
+	MaxPixels int64
+	// masters decoded at the same time. default number of cpus
+	Concurrency int
+}
+
+// external ffmpeg for the actions transcode and poster. empty path disables the actions
+type ffmpegcfg struct {
+	Path      string
+	ProbePath string
+	// maximum runtime of a call. 0 = no limit
+	Timeout time.Duration
+}
+
+// poppler tools for pdf masters. pdfinfo is needed by page and text
+type pdfcfg struct {
+	Pdfinfo   string
+	Pdftoppm  string
+	Pdftotext string
+	// maximum runtime of a call. 0 = no limit
+	Timeout time.Duration
+}
+
+// renditions of the hls action. heights above the master are skipped
+type hls struct {
+	Renditions []int
+	Segment    time.Duration
+	// lifetime of the access tokens in playlists of private items in addition to the duration of the playlist. default 2h
+	TokenTTL time.Duration
+}
+
+// asynchronous creation of derivatives. empty alias disables jobs
+type jobs struct {
+	// route of the job status: <alias><id>
+	Alias   string
+	Workers int
+	// actions which are always created in the background. other actions with the header Prefer: respond-async
+	Actions []string
+	// interval for checking the queue for jobs of other instances
+	Poll time.Duration
+	// finished jobs are removed after this time. default 7 days
+	Retention time.Duration
 }
 
 type database struct {
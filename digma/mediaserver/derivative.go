@@ -0,0 +1,306 @@
+package mediaserver
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// location of a derivative relative to the storage filebase
+// <folder>/<action>/<signature>/<params>.<ext>, folders of several files have no extension.
+// signature and params are encoded reversibly, different derivatives never share a file
+func (ms *Mediaserver) derivativePath(signature string, action string, param string, ext string) string {
+	folder := strings.Trim(ms.cfg.Mediaserver.Derivatives.Folder, "/")
+	if folder == "" {
+		folder = "derivate"
+	}
+	names := []string{}
+	for _, p := range strings.Split(param, "/") {
+		if p != "" {
+			names = append(names, pathElement(p))
+		}
+	}
+	// the encoding never contains a comma
+	name := strings.Join(names, ",")
+	if name == "" {
+		name = "default"
+	}
+	name = folder + "/" + action + "/" + pathElement(signature) + "/" + name
+	if ext != "" {
+		name += "." + ext
+	}
+	return name
+}
+
+// reversible encoding of a path element. bytes other than letters, digits, '-' and
+// a '.' which is not the first byte are written as _<hex>
+func pathElement(s string) string {
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('_')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
+
+// open the master of a signature
+func (ms *Mediaserver) OpenMaster(coll Collection, signature string) (StorageFile, *Entry, error) {
+	master, err := ms.lookup.Entry(coll.id, signature, "master", "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot find master of %s/%s: %v", coll.name, signature, err)
+	}
+	fs, err := ms.storages.FS(master.filebase)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := fs.Open(master.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open master of %s/%s: %v", coll.name, signature, err)
+	}
+	return file, master, nil
+}
+
+// path of the master in the local filesystem for external programs.
+// masters of remote storages are copied to a temporary file, which is removed by cleanup
+func (ms *Mediaserver) LocalMaster(coll Collection, signature string) (name string, cleanup func(), master *Entry, err error) {
+	master, err = ms.lookup.Entry(coll.id, signature, "master", "")
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("cannot find master of %s/%s: %v", coll.name, signature, err)
+	}
+	fs, err := ms.storages.FS(master.filebase)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if lfs, ok := fs.(LocalFS); ok {
+		if name, err := lfs.LocalPath(master.path); err == nil {
+			return name, func() {}, master, nil
+		}
+	}
+	src, err := fs.Open(master.path)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("cannot open master of %s/%s: %v", coll.name, signature, err)
+	}
+	defer src.Close()
+	tmp, err := ms.TempFile(path.Ext(master.path))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	cleanup = func() { os.Remove(tmp.Name()) }
+	_, err = io.Copy(tmp, src)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, nil, fmt.Errorf("cannot copy master of %s/%s: %v", coll.name, signature, err)
+	}
+	return tmp.Name(), cleanup, master, nil
+}
+
+// TempFile creates a temporary file with extension ext in the configured folder
+func (ms *Mediaserver) TempFile(ext string) (*os.File, error) {
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	tmp, err := os.CreateTemp(ms.cfg.Mediaserver.Derivatives.TempDir, "mediasrv2-*"+ext)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary file: %v", err)
+	}
+	return tmp, nil
+}
+
+// writable storage of a collection for derivatives
+func (ms *Mediaserver) derivativeStorage(coll Collection) (Storage, WritableFS, error) {
+	storage, err := ms.storages.ById(coll.storageid)
+	if err != nil {
+		return storage, nil, err
+	}
+	fs, err := ms.storages.FS(storage.filebase)
+	if err != nil {
+		return storage, nil, err
+	}
+	wfs, ok := fs.(WritableFS)
+	if !ok {
+		return storage, nil, fmt.Errorf("storage %s is not writable", storage.name)
+	}
+	return storage, wfs, nil
+}
+
+// copy a local file to name on a storage
+func copyToStorage(wfs WritableFS, name string, src string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := wfs.Create(name)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create %s: %v", name, err)
+	}
+	size, err := io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return 0, fmt.Errorf("cannot write %s: %v", name, err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("cannot write %s: %v", name, err)
+	}
+	return size, nil
+}
+
+// register a stored derivative in the cache table and return its fullcache entry
+func (ms *Mediaserver) registerDerivative(coll Collection, signature string, action string, param string, storage Storage, name string, mimetype string, size int64) (*Entry, error) {
+	// fullcache combines the cache table with the storage of the collection
+	_, err := ms.db.Exec("INSERT INTO cache (collection_id, signature, action, param, path, mimetype, filesize) VALUES (?, ?, ?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE path=VALUES(path), mimetype=VALUES(mimetype), filesize=VALUES(filesize)",
+		coll.id, signature, action, param, name, mimetype, size)
+	if err != nil {
+		return nil, fmt.Errorf("cannot register %s/%s/%s/%s: %v", coll.name, signature, action, param, err)
+	}
+	ms.lookup.Invalidate(coll.id, signature, action, param)
+	ms.logger.Infof("derivative %s/%s/%s/%s stored as %s", coll.name, signature, action, param, storageURI(storage.filebase, name))
+	return ms.lookup.Entry(coll.id, signature, action, param)
+}
+
+// copy a locally created derivative to the storage of the collection and register it in the cache table
+func (ms *Mediaserver) StoreDerivative(coll Collection, signature string, action string, param string, mimetype string, ext string, src string) (*Entry, error) {
+	storage, wfs, err := ms.derivativeStorage(coll)
+	if err != nil {
+		return nil, err
+	}
+	name := ms.derivativePath(signature, action, param, ext)
+	size, err := copyToStorage(wfs, name, src)
+	if err != nil {
+		return nil, fmt.Errorf("storage %s: %v", storage.name, err)
+	}
+	return ms.registerDerivative(coll, signature, action, param, storage, name, mimetype, size)
+}
+
+// actions whose derivative is a folder created by StoreDerivativeDir. the registered
+// file references all files of its folder
+var derivativeDirActions = map[string]bool{"hls": true}
+
+// copy a folder of derivative files (e.g. playlist and segments) to the storage of the collection.
+// the file main is registered in the cache table, the others are located relative to it
+func (ms *Mediaserver) StoreDerivativeDir(coll Collection, signature string, action string, param string, mimetype string, srcDir string, main string) (*Entry, error) {
+	storage, wfs, err := ms.derivativeStorage(coll)
+	if err != nil {
+		return nil, err
+	}
+	dir := ms.derivativePath(signature, action, param, "")
+	var mainSize int64 = -1
+	err = filepath.Walk(srcDir, func(src string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, src)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		size, err := copyToStorage(wfs, dir+"/"+rel, src)
+		if err != nil {
+			return fmt.Errorf("storage %s: %v", storage.name, err)
+		}
+		if rel == main {
+			mainSize = size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mainSize < 0 {
+		return nil, fmt.Errorf("%s not found in %s", main, srcDir)
+	}
+	return ms.registerDerivative(coll, signature, action, param, storage, dir+"/"+main, mimetype, mainSize)
+}
+
+// create the missing derivative of a request. concurrent requests for the same derivative wait for one run.
+// returns the new *Entry or the *streamedResponse of the php mediaserver or the http backend if there is no generator
+func (ar *ActionRequest) generate(gen Generator) (interface{}, error) {
+	ms := ar.Mediaserver
+	key := fmt.Sprintf("%d/%s/%s/%s", ar.Collection.id, ar.Signature, ar.cacheAction, ar.cacheParam)
+	flight := key
+	if gen == nil {
+		flight += ar.fcgiVariant()
+	}
+	val, err, shared := ms.generating.Do(flight, func() (interface{}, error) {
+		unlock, err := ms.lockDerivative(key)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		// another instance could have created the derivative while waiting for the lock
+		if ms.cfg.Mediaserver.Derivatives.Lock {
+			ms.lookup.Invalidate(ar.Collection.id, ar.Signature, ar.cacheAction, ar.cacheParam)
+			if entry, err := ms.lookup.Entry(ar.Collection.id, ar.Signature, ar.cacheAction, ar.cacheParam); err == nil {
+				return entry, nil
+			}
+		}
+		if gen == nil {
+			if ms.httpBackend != nil {
+				return ar.generateHTTP()
+			}
+			return ar.callFCGI(ar.cacheAction)
+		}
+		if pg, ok := gen.(ProgressGenerator); ok && ar.progress != nil {
+			return pg.GenerateProgress(ms, ar.Collection, ar.Signature, ar.Params, ar.progress)
+		}
+		return gen.Generate(ms, ar.Collection, ar.Signature, ar.Params)
+	})
+	if shared {
+		ms.logger.Debugf("shared generation of %s", key)
+	}
+	return val, err
+}
+
+// lock the generation of a derivative across all mediaserver instances with a mysql named lock.
+// returns the function which releases the lock
+func (ms *Mediaserver) lockDerivative(key string) (func(), error) {
+	if !ms.cfg.Mediaserver.Derivatives.Lock {
+		return func() {}, nil
+	}
+	timeout := ms.cfg.Mediaserver.Derivatives.LockTimeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	// named locks are bound to the connection
+	ctx := context.Background()
+	conn, err := ms.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get database connection for lock of %s: %v", key, err)
+	}
+	// lock names are limited to 64 characters
+	name := fmt.Sprintf("mediasrv2:%x", sha1.Sum([]byte(key)))
+	var result sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int(timeout.Seconds())).Scan(&result); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot get lock for %s: %v", key, err)
+	}
+	if !result.Valid || result.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("timeout waiting for lock of %s", key)
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name); err != nil {
+			ms.logger.Errorf("cannot release lock of %s: %v", key, err)
+		}
+		conn.Close()
+	}, nil
+}
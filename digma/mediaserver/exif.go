@@ -0,0 +1,313 @@
+package mediaserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// names of the tiff and exif tags in the metadata. other tags are skipped
+var exifTags = map[uint16]string{
+	0x0100: "ImageWidth",
+	0x0101: "ImageLength",
+	0x0102: "BitsPerSample",
+	0x0103: "Compression",
+	0x0106: "PhotometricInterpretation",
+	0x010e: "ImageDescription",
+	0x010f: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x0115: "SamplesPerPixel",
+	0x011a: "XResolution",
+	0x011b: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013b: "Artist",
+	0x8298: "Copyright",
+	0x829a: "ExposureTime",
+	0x829d: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9000: "ExifVersion",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9010: "OffsetTime",
+	0x9011: "OffsetTimeOriginal",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9205: "MaxApertureValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920a: "FocalLength",
+	0x9286: "UserComment",
+	0x9291: "SubSecTimeOriginal",
+	0xa000: "FlashpixVersion",
+	0xa001: "ColorSpace",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+	0xa402: "ExposureMode",
+	0xa403: "WhiteBalance",
+	0xa405: "FocalLengthIn35mmFilm",
+	0xa406: "SceneCaptureType",
+	0xa431: "BodySerialNumber",
+	0xa433: "LensMake",
+	0xa434: "LensModel",
+}
+
+// names of the tags in the gps ifd
+var gpsTags = map[uint16]string{
+	0x00: "GPSVersionID",
+	0x01: "GPSLatitudeRef",
+	0x02: "GPSLatitude",
+	0x03: "GPSLongitudeRef",
+	0x04: "GPSLongitude",
+	0x05: "GPSAltitudeRef",
+	0x06: "GPSAltitude",
+	0x07: "GPSTimeStamp",
+	0x1d: "GPSDateStamp",
+}
+
+const (
+	tagExifIFD = 0x8769
+	tagGPSIFD  = 0x8825
+	tagXMP     = 0x02bc
+)
+
+// sizes of the tiff field types
+var exifTypeSize = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// marker of xmp packets in jpeg segments
+const xmpJPEGPrefix = "http://ns.adobe.com/xap/1.0/\x00"
+
+// exif and xmp of jpeg and tiff files. other formats are searched for an xmp packet at the beginning
+func readEmbeddedMetadata(r io.ReaderAt, size int64) (map[string]interface{}, string, error) {
+	header := make([]byte, 4)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, "", err
+	}
+	switch {
+	case header[0] == 0xff && header[1] == 0xd8:
+		return readJPEGMetadata(r, size)
+	case string(header) == "II*\x00" || string(header) == "MM\x00*":
+		exif, xmp, err := readTIFFMetadata(io.NewSectionReader(r, 0, size))
+		return exif, string(xmp), err
+	}
+	head := make([]byte, min(size, 1024*1024))
+	n, _ := r.ReadAt(head, 0)
+	return nil, findXMP(head[:n]), nil
+}
+
+// xmp packet in a buffer
+func findXMP(data []byte) string {
+	start := bytes.Index(data, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return ""
+	}
+	end := bytes.Index(data[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return ""
+	}
+	return string(data[start : start+end+len("</x:xmpmeta>")])
+}
+
+// app1 segments of a jpeg file up to the image data
+func readJPEGMetadata(r io.ReaderAt, size int64) (map[string]interface{}, string, error) {
+	var (
+		exif map[string]interface{}
+		xmp  string
+	)
+	marker := make([]byte, 4)
+	for offset := int64(2); offset+4 <= size; {
+		if _, err := r.ReadAt(marker, offset); err != nil {
+			return exif, xmp, err
+		}
+		if marker[0] != 0xff {
+			return exif, xmp, fmt.Errorf("invalid jpeg marker at %d", offset)
+		}
+		// start of scan or end of image
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			break
+		}
+		length := int64(binary.BigEndian.Uint16(marker[2:]))
+		if marker[1] == 0xe1 && length > 2 {
+			segment := make([]byte, length-2)
+			if _, err := r.ReadAt(segment, offset+4); err != nil {
+				return exif, xmp, err
+			}
+			switch {
+			case bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+				var err error
+				if exif, _, err = readTIFFMetadata(bytes.NewReader(segment[6:])); err != nil {
+					return exif, xmp, err
+				}
+			case bytes.HasPrefix(segment, []byte(xmpJPEGPrefix)):
+				xmp = strings.TrimSpace(string(segment[len(xmpJPEGPrefix):]))
+			}
+		}
+		offset += 2 + length
+	}
+	return exif, xmp, nil
+}
+
+// tags of ifd0 with the exif and gps ifds
+func readTIFFMetadata(r io.ReaderAt) (map[string]interface{}, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, nil, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("invalid tiff header")
+	}
+	// bigtiff is not supported
+	if order.Uint16(header[2:]) != 42 {
+		return nil, nil, nil
+	}
+	ifd := &exifIFD{r: r, order: order}
+	result := map[string]interface{}{}
+	xmp, err := ifd.read(int64(order.Uint32(header[4:])), exifTags, result)
+	if err != nil {
+		return result, xmp, err
+	}
+	return result, xmp, nil
+}
+
+type exifIFD struct {
+	r     io.ReaderAt
+	order binary.ByteOrder
+	// offsets of the visited ifds against loops
+	visited map[int64]bool
+}
+
+// read the named tags of an ifd into result and follow the exif and gps ifds. returns the xmp tag
+func (ifd *exifIFD) read(offset int64, names map[uint16]string, result map[string]interface{}) ([]byte, error) {
+	if ifd.visited == nil {
+		ifd.visited = map[int64]bool{}
+	}
+	if ifd.visited[offset] {
+		return nil, nil
+	}
+	ifd.visited[offset] = true
+	buf := make([]byte, 2)
+	if _, err := ifd.r.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("cannot read ifd at %d: %v", offset, err)
+	}
+	count := int(ifd.order.Uint16(buf))
+	if count > 1000 {
+		return nil, fmt.Errorf("too many entries in ifd at %d", offset)
+	}
+	entries := make([]byte, 12*count)
+	if _, err := ifd.r.ReadAt(entries, offset+2); err != nil {
+		return nil, fmt.Errorf("cannot read ifd at %d: %v", offset, err)
+	}
+	var xmp []byte
+	for i := 0; i < count; i++ {
+		entry := entries[12*i : 12*i+12]
+		tag, typ, n := ifd.order.Uint16(entry), ifd.order.Uint16(entry[2:]), ifd.order.Uint32(entry[4:])
+		size, ok := exifTypeSize[typ]
+		if !ok || int64(n)*int64(size) > 1024*1024 {
+			continue
+		}
+		data := entry[8:12]
+		if length := int(n) * size; length > 4 {
+			data = make([]byte, length)
+			if _, err := ifd.r.ReadAt(data, int64(ifd.order.Uint32(entry[8:]))); err != nil {
+				continue
+			}
+		} else {
+			data = data[:length]
+		}
+		switch {
+		case tag == tagExifIFD && n == 1 && (typ == 4 || typ == 13) && len(data) >= 4:
+			if _, err := ifd.read(int64(ifd.order.Uint32(data)), exifTags, result); err != nil {
+				return xmp, err
+			}
+		case tag == tagGPSIFD && n == 1 && (typ == 4 || typ == 13) && len(data) >= 4:
+			if _, err := ifd.read(int64(ifd.order.Uint32(data)), gpsTags, result); err != nil {
+				return xmp, err
+			}
+		case tag == tagXMP && (typ == 1 || typ == 7):
+			xmp = data
+		default:
+			if name, ok := names[tag]; ok {
+				if value := ifd.value(typ, int(n), data); value != nil {
+					result[name] = value
+				}
+			}
+		}
+	}
+	return xmp, nil
+}
+
+// value of an entry. single values are scalars, rationals become floats
+func (ifd *exifIFD) value(typ uint16, n int, data []byte) interface{} {
+	switch typ {
+	case 2:
+		return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+	case 7:
+		// versions like 0230 and comments with character code
+		switch {
+		case n == 4:
+			return string(data)
+		case bytes.HasPrefix(data, []byte("ASCII\x00\x00\x00")):
+			return strings.TrimSpace(strings.TrimRight(string(data[8:]), "\x00"))
+		}
+		return nil
+	}
+	values := make([]interface{}, n)
+	for i := range values {
+		switch typ {
+		case 1:
+			values[i] = data[i]
+		case 6:
+			values[i] = int8(data[i])
+		case 3:
+			values[i] = ifd.order.Uint16(data[2*i:])
+		case 8:
+			values[i] = int16(ifd.order.Uint16(data[2*i:]))
+		case 4:
+			values[i] = ifd.order.Uint32(data[4*i:])
+		case 9:
+			values[i] = int32(ifd.order.Uint32(data[4*i:]))
+		case 5:
+			num, den := ifd.order.Uint32(data[8*i:]), ifd.order.Uint32(data[8*i+4:])
+			values[i] = rational(float64(num), float64(den))
+		case 10:
+			num, den := int32(ifd.order.Uint32(data[8*i:])), int32(ifd.order.Uint32(data[8*i+4:]))
+			values[i] = rational(float64(num), float64(den))
+		case 11:
+			values[i] = finite(float64(math.Float32frombits(ifd.order.Uint32(data[4*i:]))))
+		case 12:
+			values[i] = finite(math.Float64frombits(ifd.order.Uint64(data[8*i:])))
+		}
+	}
+	if n == 1 {
+		return values[0]
+	}
+	return values
+}
+
+func rational(num float64, den float64) float64 {
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// json has no NaN and infinity
+func finite(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
@@ -0,0 +1,290 @@
+package mediaserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	fcgiclient "github.com/je4/mediaserver2/digma/fcgi"
+)
+
+// pooled client for the backends of the config. nil if there is no backend
+func newFCGIClient(cfg fcgi) (*fcgiclient.Client, error) {
+	backends := []fcgiclient.BackendConfig{}
+	if cfg.Addr != "" {
+		backends = append(backends, fcgiclient.BackendConfig{Network: cfg.Proto, Addr: cfg.Addr})
+	}
+	for _, b := range cfg.Backends {
+		backends = append(backends, fcgiclient.BackendConfig{Network: b.Proto, Addr: b.Addr, MaxConns: b.MaxConns})
+	}
+	if len(backends) == 0 {
+		return nil, nil
+	}
+	opts := fcgiclient.Options{
+		Balance:        cfg.Balance,
+		MaxConns:       cfg.MaxConns,
+		MaxIdle:        cfg.MaxIdle,
+		ConnectTimeout: cfg.ConnectTimeout,
+		Timeout:        cfg.Timeout,
+		HealthCheck:    cfg.HealthCheck,
+	}
+	if cfg.Ping != "" {
+		opts.Ping = map[string]string{
+			"SCRIPT_NAME":     cfg.Ping,
+			"SCRIPT_FILENAME": cfg.Ping,
+			"REQUEST_URI":     cfg.Ping,
+			"REQUEST_METHOD":  "GET",
+			"SERVER_SOFTWARE": VERSION,
+		}
+	}
+	return fcgiclient.NewClient(backends, opts)
+}
+
+// headers of the cgi response which are not passed to the client
+var fcgiHopHeaders = []string{"Status", "Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Upgrade"}
+
+// request headers which change the response of the backend. requests differing in them don't share a call
+var fcgiVariantHeaders = []string{"Accept", "Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// maximum size of the header of a cgi response
+const maxCGIHeader = 1 << 16
+
+// Fallback forwards the request to the php mediaserver or the http derivative service.
+// concurrent identical requests wait for one call of the fcgi backend, which streams the response to its client.
+// the others call the backend afterwards, when the php mediaserver has the derivative in its cache
+func (ar *ActionRequest) Fallback(action string) error {
+	ms := ar.Mediaserver
+	if ms.httpBackend != nil {
+		return ar.fallbackHTTP(action)
+	}
+	key := fmt.Sprintf("fcgi:%d/%s/%s/%s%s", ar.Collection.id, ar.Signature, action, strings.Join(ar.Params, "/"), ar.fcgiVariant())
+	val, err, shared := ms.generating.Do(key, func() (interface{}, error) {
+		return ar.callFCGI(action)
+	})
+	if err != nil {
+		return ar.Error(http.StatusBadGateway, err.Error())
+	}
+	if resp := val.(*streamedResponse); resp.ar == ar {
+		return resp.err
+	}
+	if shared {
+		ms.logger.Debugf("fcgi shared call: %s", key)
+	}
+	return ar.fallbackFCGI(action)
+}
+
+// forward the request to the php mediaserver without sharing the call
+func (ar *ActionRequest) fallbackFCGI(action string) error {
+	resp, err := ar.callFCGI(action)
+	if err != nil {
+		return ar.Error(http.StatusBadGateway, err.Error())
+	}
+	return resp.err
+}
+
+// forward the request to the http derivative service or the php mediaserver without sharing the call
+func (ar *ActionRequest) fallbackBackend(action string) error {
+	if ar.Mediaserver.httpBackend != nil {
+		return ar.fallbackHTTP(action)
+	}
+	return ar.fallbackFCGI(action)
+}
+
+// suffix of the flight key for requests with a method or headers which change the response
+func (ar *ActionRequest) fcgiVariant() string {
+	h := sha1.New()
+	found := ar.Request.Method != http.MethodGet
+	if found {
+		fmt.Fprintf(h, "%s\n", ar.Request.Method)
+	}
+	for _, name := range fcgiVariantHeaders {
+		for _, value := range ar.Request.Header.Values(name) {
+			fmt.Fprintf(h, "%s: %s\n", name, value)
+			found = true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return fmt.Sprintf("|%x", h.Sum(nil))
+}
+
+// writes the output of a cgi script (rfc 3875, section 6) to the client of ar.
+// the header is collected until it is complete, the body is passed through
+type cgiWriter struct {
+	ar     *ActionRequest
+	header []byte
+	// status sent to the client. 0 until the header is complete
+	status int
+	// false for responses without body
+	body bool
+}
+
+func (w *cgiWriter) Write(p []byte) (int, error) {
+	if w.status != 0 {
+		if !w.body {
+			return len(p), nil
+		}
+		return w.ar.Writer.Write(p)
+	}
+	w.header = append(w.header, p...)
+	end, sep := len(w.header), 0
+	if i := bytes.Index(w.header, []byte("\r\n\r\n")); i >= 0 {
+		end, sep = i, 4
+	}
+	if i := bytes.Index(w.header, []byte("\n\n")); i >= 0 && i < end {
+		end, sep = i, 2
+	}
+	if sep == 0 {
+		if len(w.header) > maxCGIHeader {
+			return 0, fmt.Errorf("header too large")
+		}
+		return len(p), nil
+	}
+	body := w.header[end+sep:]
+	if err := w.writeHeader(w.header[:end+sep]); err != nil {
+		return 0, err
+	}
+	if len(body) > 0 && w.body {
+		if _, err := w.ar.Writer.Write(body); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// end of the output. a response without body may end without empty line
+func (w *cgiWriter) Close() error {
+	if w.status != 0 {
+		return nil
+	}
+	if len(bytes.TrimSpace(w.header)) == 0 {
+		return fmt.Errorf("empty response")
+	}
+	return w.writeHeader(append(w.header, "\n\n"...))
+}
+
+func (w *cgiWriter) writeHeader(data []byte) error {
+	mime, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil {
+		return fmt.Errorf("invalid header: %v", err)
+	}
+	header := http.Header(mime)
+	status := http.StatusOK
+	if value := header.Get("Status"); value != "" {
+		code, _, _ := strings.Cut(value, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			return fmt.Errorf("invalid status %s", value)
+		}
+	} else if header.Get("Location") != "" {
+		// client and local redirects. local redirects are not processed internally
+		status = http.StatusFound
+	}
+	if header.Get("Content-Type") == "" && header.Get("Location") == "" {
+		header.Set("Content-Type", "text/html")
+	}
+	for _, name := range fcgiHopHeaders {
+		header.Del(name)
+	}
+	target := w.ar.Writer.Header()
+	for name, values := range header {
+		target[name] = values
+	}
+	w.status = status
+	w.body = w.ar.Request.Method != http.MethodHead && status != http.StatusNotModified && status != http.StatusNoContent
+	w.ar.Writer.WriteHeader(status)
+	return nil
+}
+
+// environment of the cgi request (rfc 3875, section 4.1) with the headers of the client as HTTP_* variables
+func (ar *ActionRequest) fcgiEnv(query string) map[string]string {
+	ms := ar.Mediaserver
+	req := ar.Request
+	remoteAddr, remotePort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteAddr = req.RemoteAddr
+	}
+	serverName, serverPort, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		serverName, serverPort = req.Host, "443"
+	}
+	env := map[string]string{
+		"AUTH_TYPE":         "", // Not used
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SCRIPT_FILENAME":   ms.cfg.Mediaserver.FCGI.Script,
+		"SERVER_SOFTWARE":   VERSION,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"QUERY_STRING":      query,
+		"HOME":              "/",
+		"HTTPS":             "on",
+		"REQUEST_SCHEME":    "https",
+		"SERVER_PROTOCOL":   req.Proto,
+		"REQUEST_METHOD":    req.Method,
+		"FCGI_ROLE":         "RESPONDER",
+		"REQUEST_URI":       req.RequestURI,
+	}
+	for name, values := range req.Header {
+		switch name {
+		case "Content-Type":
+			env["CONTENT_TYPE"] = values[0]
+		case "Content-Length":
+			env["CONTENT_LENGTH"] = values[0]
+		case "Proxy":
+			// httpoxy
+		default:
+			env["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = strings.Join(values, ", ")
+		}
+	}
+	if req.Host != "" {
+		env["HTTP_HOST"] = req.Host
+	}
+	return env
+}
+
+// call the php mediaserver and stream its response to the client of ar.
+// returns an error if nothing has been sent to the client
+func (ar *ActionRequest) callFCGI(action string) (*streamedResponse, error) {
+	ms := ar.Mediaserver
+	if ms.fcgi == nil {
+		return nil, fmt.Errorf("no fcgi backend configured")
+	}
+	parameters := url.Values{}
+	parameters.Add("collection", ar.Collection.name)
+	parameters.Add("signature", ar.Signature)
+	parameters.Add("action", action)
+	if ar.Token != "" {
+		parameters.Add("token", ar.Token)
+	}
+	for _, value := range ar.Params {
+		if value != "" {
+			parameters.Add("params[]", value)
+		}
+	}
+	w := &cgiWriter{ar: ar}
+	// the backend call is shared with other requests and must not end with the first client
+	resp, err := ms.fcgi.Stream(context.Background(), ar.fcgiEnv(parameters.Encode()), nil, w)
+	if err == nil {
+		if len(resp.Stderr) > 0 {
+			ms.logger.Warningf("fcgi %s/%s/%s: %s", ar.Collection.name, ar.Signature, action, strings.TrimSpace(string(resp.Stderr)))
+		}
+		err = w.Close()
+	}
+	if w.status == 0 {
+		return nil, fmt.Errorf("Unable to get data from fcgi backend: %s", err)
+	}
+	if err != nil {
+		ms.logger.Errorf("fcgi %s/%s/%s: %v", ar.Collection.name, ar.Signature, action, err)
+	}
+	return &streamedResponse{ar: ar, status: w.status, err: err}, nil
+}
@@ -0,0 +1,70 @@
+package mediaserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCGIWriter(t *testing.T) {
+	tests := []struct {
+		method string
+		// output of the script in chunks
+		output      []string
+		status      int
+		contentType string
+		location    string
+		body        string
+	}{
+		{"GET", []string{"Content-Type: image/jpeg\r\n\r\nJPEG"}, 200, "image/jpeg", "", "JPEG"},
+		{"GET", []string{"Status: 404 Not Found\nContent-Type: text/plain\n\nmissing"}, 404, "text/plain", "", "missing"},
+		{"GET", []string{"Content-Ty", "pe: image/png\r", "\n\r", "\nPN", "G"}, 200, "image/png", "", "PNG"},
+		{"GET", []string{"Location: https://example.org/x\r\n\r\n"}, 302, "", "https://example.org/x", ""},
+		{"GET", []string{"Status: 301\r\nLocation: /y\r\n\r\n"}, 301, "", "/y", ""},
+		{"GET", []string{"X-Test: 1\n\nbody"}, 200, "text/html", "", "body"},
+		{"GET", []string{"Status: 304 Not Modified\r\n\r\nignored"}, 304, "text/html", "", ""},
+		{"HEAD", []string{"Content-Type: image/jpeg\r\n\r\nJPEG"}, 200, "image/jpeg", "", ""},
+		// header without empty line at the end of the output
+		{"GET", []string{"Status: 204 No Content\r\n"}, 204, "text/html", "", ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		w := &cgiWriter{ar: &ActionRequest{Writer: rec, Request: httptest.NewRequest(test.method, "/", nil)}}
+		for _, chunk := range test.output {
+			if _, err := w.Write([]byte(chunk)); err != nil {
+				t.Fatalf("%q: %v", test.output, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%q: %v", test.output, err)
+		}
+		if rec.Code != test.status || rec.Header().Get("Content-Type") != test.contentType ||
+			rec.Header().Get("Location") != test.location || rec.Body.String() != test.body {
+			t.Errorf("%s %q: status %d, content type %q, location %q, body %q", test.method, test.output,
+				rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("Location"), rec.Body.String())
+		}
+		if rec.Header().Get("Status") != "" {
+			t.Errorf("%q: status header passed to the client", test.output)
+		}
+	}
+}
+
+func TestCGIWriterInvalid(t *testing.T) {
+	tests := []string{
+		"Status: abc\r\n\r\n",
+		"Status: 42\r\n\r\n",
+		"no header line\r\n\r\n",
+		"",
+		string(make([]byte, maxCGIHeader+1)),
+	}
+	for _, output := range tests {
+		w := &cgiWriter{ar: &ActionRequest{Writer: httptest.NewRecorder(), Request: httptest.NewRequest(http.MethodGet, "/", nil)}}
+		_, err := w.Write([]byte(output))
+		if err == nil {
+			err = w.Close()
+		}
+		if err == nil {
+			t.Errorf("%.40q: accepted", output)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package mediaserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// run ffmpeg with a timeout. progress gets the position in seconds if the args contain -progress pipe:1
+func (ms *Mediaserver) runFFmpeg(args []string, progress func(seconds float64)) error {
+	return ms.execFFmpeg(args, func(stdout io.Reader) error {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			// out_time_us is in microseconds, out_time_ms as well
+			line := scanner.Text()
+			if progress == nil || !strings.HasPrefix(line, "out_time_us=") {
+				continue
+			}
+			if us, err := strconv.ParseInt(strings.TrimPrefix(line, "out_time_us="), 10, 64); err == nil && us >= 0 {
+				progress(float64(us) / 1e6)
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// run ffmpeg with a timeout. output reads the standard output
+func (ms *Mediaserver) execFFmpeg(args []string, output func(stdout io.Reader) error) error {
+	cfg := ms.cfg.Mediaserver.FFmpeg
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	ms.logger.Debugf("%s %s", cfg.Path, strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, cfg.Path, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start %s: %v", cfg.Path, err)
+	}
+	outErr := output(stdout)
+	if outErr != nil {
+		// stop ffmpeg if the output is not needed anymore
+		cancel()
+	}
+	io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil && outErr == nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 1024 {
+			msg = "..." + msg[len(msg)-1024:]
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s timed out after %v", cfg.Path, cfg.Timeout)
+		}
+		return fmt.Errorf("%s failed: %v - %s", cfg.Path, err, msg)
+	}
+	return outErr
+}
+
+// run ffprobe with the timeout of ffmpeg and return its output
+func (ms *Mediaserver) execProbe(args ...string) ([]byte, error) {
+	cfg := ms.cfg.Mediaserver.FFmpeg
+	ctx := context.Background()
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	out, err := exec.CommandContext(ctx, cfg.ProbePath, args...).Output()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s timed out after %v", cfg.ProbePath, cfg.Timeout)
+	}
+	return out, err
+}
+
+// duration of a media file in seconds. 0 if unknown
+func (ms *Mediaserver) probeDuration(name string) float64 {
+	if ms.cfg.Mediaserver.FFmpeg.ProbePath == "" {
+		return 0
+	}
+	out, err := ms.execProbe("-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", name)
+	if err != nil {
+		ms.logger.Errorf("cannot get duration of %s: %v", name, err)
+		return 0
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0
+	}
+	return duration
+}
+
+// stream of a media file
+type probeStream struct {
+	CodecType string `json:"codec_type"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+}
+
+// streams of a media file
+func (ms *Mediaserver) probeStreams(name string) ([]probeStream, error) {
+	if ms.cfg.Mediaserver.FFmpeg.ProbePath == "" {
+		return nil, fmt.Errorf("no ffprobe configured")
+	}
+	out, err := ms.execProbe("-v", "error", "-show_entries", "stream=codec_type,width,height", "-of", "json", name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot probe %s: %v", name, err)
+	}
+	result := struct {
+		Streams []probeStream `json:"streams"`
+	}{}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("cannot parse streams of %s: %v", name, err)
+	}
+	return result.Streams, nil
+}
+
+// bitrate like 2000k or 2m
+func parseBitrate(param string, value string) (string, error) {
+	num := strings.TrimRight(value, "km")
+	if n, err := strconv.Atoi(num); err != nil || n <= 0 || len(value)-len(num) > 1 {
+		return "", &ParamError{param, "expected bitrate like 2000k"}
+	}
+	return value, nil
+}
+
+// timestamp in seconds or [hh:]mm:ss[.fff]
+func parseTimestamp(param string, value string) (float64, error) {
+	var seconds float64
+	for _, part := range strings.Split(value, ":") {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil || f < 0 {
+			return 0, &ParamError{param, "expected seconds or hh:mm:ss"}
+		}
+		seconds = seconds*60 + f
+	}
+	return seconds, nil
+}
+
+// scale filter which keeps the aspect ratio and doesn't enlarge
+func scaleFilter(width int, height int) string {
+	switch {
+	case width > 0 && height > 0:
+		return fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease:force_divisible_by=2", width, height)
+	case width > 0:
+		return fmt.Sprintf("scale='trunc(min(%d,iw)/2)*2':-2", width)
+	case height > 0:
+		return fmt.Sprintf("scale=-2:'trunc(min(%d,ih)/2)*2'", height)
+	}
+	return ""
+}
+
+// size parameters shared by video actions
+func parseDimension(param string, prefix string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(param, prefix))
+	if err != nil || n <= 0 {
+		return 0, &ParamError{param, "invalid " + prefix}
+	}
+	return n, nil
+}
+
+// output formats of transcode: extension, mimetype and codec arguments. audio formats have no video codec
+var transcodeFormats = map[string]struct {
+	ext          string
+	mimetype     string
+	video        []string
+	audio        []string
+	audioBitrate string
+}{
+	"mp4":  {"mp4", "video/mp4", []string{"-c:v", "libx264", "-preset", "medium", "-pix_fmt", "yuv420p"}, []string{"-c:a", "aac"}, "128k"},
+	"webm": {"webm", "video/webm", []string{"-c:v", "libvpx-vp9", "-row-mt", "1"}, []string{"-c:a", "libopus"}, "128k"},
+	"opus": {"opus", "audio/ogg", nil, []string{"-c:a", "libopus"}, "96k"},
+	"mp3":  {"mp3", "audio/mpeg", nil, []string{"-c:a", "libmp3lame"}, "192k"},
+	"aac":  {"m4a", "audio/mp4", nil, []string{"-c:a", "aac"}, "128k"},
+}
+
+var transcodeParamSpecs = ParamSpecs{
+	{Name: "format", Kind: ParamEnum, Values: []string{"mp4", "webm", "opus", "mp3", "aac"}},
+	{Name: "width", Kind: ParamInt, Min: 1},
+	{Name: "height", Kind: ParamInt, Min: 1},
+	{Name: "videobitrate", Kind: ParamBitrate},
+	{Name: "audiobitrate", Kind: ParamBitrate},
+}
+
+type transcodeParams struct {
+	format       string
+	width        int
+	height       int
+	videoBitrate string
+	audioBitrate string
+}
+
+// format<mp4|webm|opus|mp3|aac>, width<w>, height<h>, videobitrate<n>[k|m], audiobitrate<n>[k]
+func parseTranscodeParams(params []string) (*transcodeParams, error) {
+	tp := &transcodeParams{format: "mp4"}
+	for _, param := range params {
+		var err error
+		switch {
+		case strings.HasPrefix(param, "format"):
+			tp.format = strings.TrimPrefix(param, "format")
+			if _, ok := transcodeFormats[tp.format]; !ok {
+				return nil, &ParamError{param, "unsupported format"}
+			}
+		case strings.HasPrefix(param, "width"):
+			tp.width, err = parseDimension(param, "width")
+		case strings.HasPrefix(param, "height"):
+			tp.height, err = parseDimension(param, "height")
+		case strings.HasPrefix(param, "videobitrate"):
+			tp.videoBitrate, err = parseBitrate(param, strings.TrimPrefix(param, "videobitrate"))
+		case strings.HasPrefix(param, "audiobitrate"):
+			tp.audioBitrate, err = parseBitrate(param, strings.TrimPrefix(param, "audiobitrate"))
+		default:
+			return nil, &ParamError{param, "unknown parameter"}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if transcodeFormats[tp.format].video == nil && (tp.width > 0 || tp.height > 0 || tp.videoBitrate != "") {
+		return nil, &ParamError{"format" + tp.format, "audio formats have no video parameters"}
+	}
+	return tp, nil
+}
+
+// transcode a video or audio master with ffmpeg
+type transcodeAction struct{}
+
+func (a *transcodeAction) Name() string { return "transcode" }
+
+func (a *transcodeAction) Params(params []string) ([]string, error) {
+	params, err := transcodeParamSpecs.Canonical(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseTranscodeParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (a *transcodeAction) CacheKey(params []string) (string, string) {
+	return "transcode", strings.Join(params, "/")
+}
+
+func (a *transcodeAction) NeedsMaster() bool { return true }
+
+func (a *transcodeAction) Produce(ar *ActionRequest) error { return ar.ServeEntry(a) }
+
+func (a *transcodeAction) Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error) {
+	return a.GenerateProgress(ms, coll, signature, params, nil)
+}
+
+func (a *transcodeAction) GenerateProgress(ms *Mediaserver, coll Collection, signature string, params []string, progress func(float64)) (*Entry, error) {
+	tp, err := parseTranscodeParams(params)
+	if err != nil {
+		return nil, err
+	}
+	input, cleanup, _, err := ms.LocalMaster(coll, signature)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	f := transcodeFormats[tp.format]
+	tmp, err := ms.TempFile(f.ext)
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	args := []string{"-y", "-nostdin", "-v", "error", "-i", input}
+	switch {
+	case f.video == nil:
+		// audio only, cover images are dropped
+		args = append(args, "-vn")
+	default:
+		args = append(args, f.video...)
+		if filter := scaleFilter(tp.width, tp.height); filter != "" {
+			args = append(args, "-vf", filter)
+		}
+		if tp.videoBitrate != "" {
+			args = append(args, "-b:v", tp.videoBitrate)
+		} else if tp.format == "webm" {
+			args = append(args, "-crf", "32", "-b:v", "0")
+		} else {
+			args = append(args, "-crf", "23")
+		}
+	}
+	args = append(args, f.audio...)
+	audioBitrate := tp.audioBitrate
+	if audioBitrate == "" {
+		audioBitrate = f.audioBitrate
+	}
+	args = append(args, "-b:a", audioBitrate)
+	if f.ext == "mp4" || f.ext == "m4a" {
+		args = append(args, "-movflags", "+faststart")
+	}
+
+	var position func(float64)
+	if progress != nil {
+		if duration := ms.probeDuration(input); duration > 0 {
+			args = append(args, "-progress", "pipe:1", "-nostats")
+			position = func(seconds float64) { progress(min(seconds/duration, 0.99)) }
+		}
+	}
+	args = append(args, tmp.Name())
+	start := time.Now()
+	if err := ms.runFFmpeg(args, position); err != nil {
+		return nil, err
+	}
+	ms.logger.Infof("transcoded %s/%s to %s in %v", coll.name, signature, strings.Join(params, "/"), time.Since(start))
+	return ms.StoreDerivative(coll, signature, "transcode", strings.Join(params, "/"), f.mimetype, f.ext, tmp.Name())
+}
+
+var posterParamSpecs = ParamSpecs{
+	{Name: "time", Kind: ParamTime},
+	{Name: "format", Kind: ParamEnum, Values: []string{"jpeg", "png"}, Aliases: map[string]string{"jpg": "jpeg"}},
+	{Name: "width", Kind: ParamInt, Min: 1},
+	{Name: "height", Kind: ParamInt, Min: 1},
+}
+
+type posterParams struct {
+	time   float64
+	format string
+	width  int
+	height int
+}
+
+// time<seconds|hh:mm:ss>, format<jpeg|png>, width<w>, height<h>
+func parsePosterParams(params []string) (*posterParams, error) {
+	pp := &posterParams{format: "jpeg"}
+	for _, param := range params {
+		var err error
+		switch {
+		case strings.HasPrefix(param, "time"):
+			pp.time, err = parseTimestamp(param, strings.TrimPrefix(param, "time"))
+		case strings.HasPrefix(param, "format"):
+			pp.format = strings.TrimPrefix(param, "format")
+			if pp.format == "jpg" {
+				pp.format = "jpeg"
+			}
+			if pp.format != "jpeg" && pp.format != "png" {
+				return nil, &ParamError{param, "unsupported format"}
+			}
+		case strings.HasPrefix(param, "width"):
+			pp.width, err = parseDimension(param, "width")
+		case strings.HasPrefix(param, "height"):
+			pp.height, err = parseDimension(param, "height")
+		default:
+			return nil, &ParamError{param, "unknown parameter"}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pp, nil
+}
+
+// still image of a video master at a timestamp
+type posterAction struct{}
+
+func (a *posterAction) Name() string { return "poster" }
+
+func (a *posterAction) Params(params []string) ([]string, error) {
+	params, err := posterParamSpecs.Canonical(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parsePosterParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (a *posterAction) CacheKey(params []string) (string, string) {
+	return "poster", strings.Join(params, "/")
+}
+
+func (a *posterAction) NeedsMaster() bool { return true }
+
+func (a *posterAction) Produce(ar *ActionRequest) error { return ar.ServeEntry(a) }
+
+func (a *posterAction) Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error) {
+	pp, err := parsePosterParams(params)
+	if err != nil {
+		return nil, err
+	}
+	input, cleanup, _, err := ms.LocalMaster(coll, signature)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	f := imageFormats[pp.format]
+	tmp, err := ms.TempFile(f.ext)
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// seeking before the input is fast and exact for current ffmpeg versions
+	args := []string{"-y", "-nostdin", "-v", "error", "-ss", strconv.FormatFloat(pp.time, 'f', 3, 64), "-i", input, "-frames:v", "1"}
+	if filter := scaleFilter(pp.width, pp.height); filter != "" {
+		args = append(args, "-vf", filter)
+	}
+	if pp.format == "jpeg" {
+		args = append(args, "-q:v", "2")
+	}
+	args = append(args, tmp.Name())
+	if err := ms.runFFmpeg(args, nil); err != nil {
+		return nil, err
+	}
+	// no frame after the end of the video
+	if stat, err := os.Stat(tmp.Name()); err != nil || stat.Size() == 0 {
+		return nil, &ParamError{"time", fmt.Sprintf("no frame at %vs", pp.time)}
+	}
+	return ms.StoreDerivative(coll, signature, "poster", strings.Join(params, "/"), f.mimetype, f.ext, tmp.Name())
+}
@@ -0,0 +1,274 @@
+package mediaserver
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum number of verification results kept in memory
+const fixityCacheSize = 100000
+
+// default lifetime of verification results. new expected checksums are noticed after this time
+const fixityCacheTTL = time.Hour
+
+// expected checksums of cache entries are stored in table fixity (see mediasrv2.sql)
+type Fixity struct {
+	db      *sql.DB
+	ttl     time.Duration
+	results map[string]fixityResult
+	m       sync.RWMutex
+	flight  *flightGroup
+}
+
+// result of a verification. valid as long as size and modification time don't change and the ttl is not over
+type fixityResult struct {
+	size    int64
+	modTime time.Time
+	checked time.Time
+	err     error
+}
+
+// FixityMismatch is a file which does not match its expected checksum
+type FixityMismatch struct {
+	Collection string `json:"collection"`
+	Signature  string `json:"signature"`
+	Action     string `json:"action"`
+	Param      string `json:"param"`
+	URI        string `json:"uri"`
+	Algorithm  string `json:"algorithm,omitempty"`
+	Expected   string `json:"expected,omitempty"`
+	Actual     string `json:"actual,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// FixityReport is the result of a fixity audit
+type FixityReport struct {
+	Checked    int              `json:"checked"`
+	Mismatches []FixityMismatch `json:"mismatches"`
+}
+
+func NewFixity(db *sql.DB, ttl time.Duration) *Fixity {
+	if ttl <= 0 {
+		ttl = fixityCacheTTL
+	}
+	return &Fixity{
+		db:      db,
+		ttl:     ttl,
+		results: make(map[string]fixityResult),
+		flight:  newFlightGroup(),
+	}
+}
+
+func newFixityHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "sha256", "sha-256":
+		return sha256.New(), nil
+	case "sha512", "sha-512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %s", algorithm)
+	}
+}
+
+// calculate the checksums of a storage file in one pass
+func fileDigests(fs StorageFS, name string, algorithms []string) (map[string]string, error) {
+	hashes := map[string]hash.Hash{}
+	writers := []io.Writer{}
+	for _, algorithm := range algorithms {
+		h, err := newFixityHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", name, err)
+	}
+	digests := map[string]string{}
+	for algorithm, h := range hashes {
+		digests[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// expected checksums of a cache entry by algorithm
+func (fix *Fixity) expected(collectionId int, signature string, action string, param string) (map[string]string, error) {
+	rows, err := fix.db.Query("SELECT algorithm, digest FROM fixity WHERE collection_id=? AND signature=? AND action=? AND param=?", collectionId, signature, action, param)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query fixity: %v", err)
+	}
+	defer rows.Close()
+	digests := map[string]string{}
+	for rows.Next() {
+		var algorithm, digest string
+		if err := rows.Scan(&algorithm, &digest); err != nil {
+			return nil, fmt.Errorf("cannot scan fixity: %v", err)
+		}
+		digests[strings.ToLower(algorithm)] = strings.ToLower(digest)
+	}
+	return digests, rows.Err()
+}
+
+// compare checksums. returns the first mismatch
+func compareDigests(expected map[string]string, actual map[string]string) (algorithm string, ok bool) {
+	for algorithm, digest := range expected {
+		if actual[algorithm] != digest {
+			return algorithm, false
+		}
+	}
+	return "", true
+}
+
+// verify a file before it's served. results are cached per size and modification time for the ttl
+func (fix *Fixity) Verify(fs StorageFS, uri string, name string, collectionId int, signature string, action string, param string) error {
+	stat, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	fix.m.RLock()
+	result, ok := fix.results[uri]
+	fix.m.RUnlock()
+	if ok && result.size == stat.Size() && result.modTime.Equal(stat.ModTime()) && time.Since(result.checked) < fix.ttl {
+		return result.err
+	}
+
+	// concurrent requests for the same file wait for one verification
+	key := fmt.Sprintf("%s|%d|%d", uri, stat.Size(), stat.ModTime().UnixNano())
+	val, err, _ := fix.flight.Do(key, func() (interface{}, error) {
+		result := fixityResult{size: stat.Size(), modTime: stat.ModTime()}
+		expected, err := fix.expected(collectionId, signature, action, param)
+		if err != nil {
+			return nil, err
+		}
+		if len(expected) > 0 {
+			algorithms := []string{}
+			for algorithm := range expected {
+				algorithms = append(algorithms, algorithm)
+			}
+			actual, err := fileDigests(fs, name, algorithms)
+			if err != nil {
+				return nil, err
+			}
+			if algorithm, ok := compareDigests(expected, actual); !ok {
+				result.err = fmt.Errorf("fixity mismatch for %s: %s should be %s but is %s", uri, algorithm, expected[algorithm], actual[algorithm])
+			}
+		}
+		result.checked = time.Now()
+
+		fix.m.Lock()
+		if len(fix.results) >= fixityCacheSize {
+			fix.results = make(map[string]fixityResult)
+		}
+		fix.results[uri] = result
+		fix.m.Unlock()
+		return result, nil
+	})
+	if err != nil {
+		return err
+	}
+	return val.(fixityResult).err
+}
+
+// check all cache entries with expected checksums and write a json report
+func (ms *Mediaserver) FixityAudit(w io.Writer) (report *FixityReport, err error) {
+	type entry struct {
+		collectionId int
+		signature    string
+		action       string
+		param        string
+		filebase     string
+		path         string
+		expected     map[string]string
+	}
+	rows, err := ms.db.Query("SELECT f.collection_id, f.signature, f.action, f.param, f.filebase, f.path, x.algorithm, x.digest" +
+		" FROM fullcache f, fixity x" +
+		" WHERE f.collection_id=x.collection_id AND f.signature=x.signature AND f.action=x.action AND f.param=x.param" +
+		" ORDER BY f.collection_id, f.signature, f.action, f.param")
+	if err != nil {
+		return nil, fmt.Errorf("cannot query fixity: %v", err)
+	}
+	entries := []*entry{}
+	var last *entry
+	for rows.Next() {
+		e := &entry{expected: map[string]string{}}
+		var algorithm, digest string
+		if err := rows.Scan(&e.collectionId, &e.signature, &e.action, &e.param, &e.filebase, &e.path, &algorithm, &digest); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("cannot scan fixity: %v", err)
+		}
+		if last != nil && last.collectionId == e.collectionId && last.signature == e.signature && last.action == e.action && last.param == e.param {
+			last.expected[strings.ToLower(algorithm)] = strings.ToLower(digest)
+			continue
+		}
+		e.expected[strings.ToLower(algorithm)] = strings.ToLower(digest)
+		entries = append(entries, e)
+		last = e
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report = &FixityReport{Mismatches: []FixityMismatch{}}
+	for _, e := range entries {
+		collection := fmt.Sprintf("#%d", e.collectionId)
+		if coll, err := ms.collections.ById(e.collectionId); err == nil {
+			collection = coll.name
+		}
+		uri := storageURI(e.filebase, e.path)
+		mismatch := FixityMismatch{
+			Collection: collection,
+			Signature:  e.signature,
+			Action:     e.action,
+			Param:      e.param,
+			URI:        uri,
+		}
+		report.Checked++
+		ms.logger.Debugf("fixity check %s", uri)
+
+		fs, err := ms.storages.FS(e.filebase)
+		if err != nil {
+			mismatch.Error = err.Error()
+			report.Mismatches = append(report.Mismatches, mismatch)
+			continue
+		}
+		algorithms := []string{}
+		for algorithm := range e.expected {
+			algorithms = append(algorithms, algorithm)
+		}
+		actual, err := fileDigests(fs, e.path, algorithms)
+		if err != nil {
+			mismatch.Error = err.Error()
+			report.Mismatches = append(report.Mismatches, mismatch)
+			continue
+		}
+		if algorithm, ok := compareDigests(e.expected, actual); !ok {
+			mismatch.Algorithm = algorithm
+			mismatch.Expected = e.expected[algorithm]
+			mismatch.Actual = actual[algorithm]
+			report.Mismatches = append(report.Mismatches, mismatch)
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
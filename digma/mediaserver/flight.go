@@ -0,0 +1,51 @@
+package mediaserver
+
+import (
+	"fmt"
+	"sync"
+)
+
+// flightGroup runs a function only once for concurrent calls with the same key.
+// all callers get the result of the single run
+type flightGroup struct {
+	m     sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// execute fn for key. shared is true if the result came from a run of another caller.
+// a panic of fn becomes an error for all callers
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	g.m.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.m.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.m.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			call.val, call.err = nil, fmt.Errorf("panic in %s: %v", key, r)
+			val, err = call.val, call.err
+		}
+		call.wg.Done()
+		g.m.Lock()
+		delete(g.calls, key)
+		g.m.Unlock()
+	}()
+	call.val, call.err = fn()
+	return call.val, call.err, false
+}
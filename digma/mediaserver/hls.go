@@ -0,0 +1,272 @@
+package mediaserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const hlsMaster = "master.m3u8"
+
+// names of the files of an hls package: master.m3u8, <rendition>/playlist.m3u8, <rendition>/init.mp4, <rendition>/seg00001.m4s
+var hlsName = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9]+)?$`)
+
+// uri attributes of playlist tags, e.g. #EXT-X-MAP:URI="init.mp4"
+var hlsURIAttr = regexp.MustCompile(`URI="([^"]*)"`)
+
+// hls package of a video master with several renditions. the package is created on the first request
+// and stored as folder on the storage. the cache table knows the master playlist only
+type hlsAction struct{}
+
+func (a *hlsAction) Name() string { return "hls" }
+
+// the params are the path of a file in the package
+func (a *hlsAction) Params(params []string) ([]string, error) {
+	result := []string{}
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		param = strings.ToLower(param)
+		if !hlsName.MatchString(param) {
+			return nil, &ParamError{param, "invalid file name"}
+		}
+		result = append(result, param)
+	}
+	if len(result) > 2 {
+		return nil, &ParamError{strings.Join(result, "/"), "invalid path"}
+	}
+	return result, nil
+}
+
+func (a *hlsAction) CacheKey(params []string) (string, string) { return "hls", "" }
+
+func (a *hlsAction) NeedsMaster() bool { return true }
+
+func (a *hlsAction) Produce(ar *ActionRequest) error {
+	ms := ar.Mediaserver
+	// relative urls of the playlists need the file name
+	if ar.ParamString == "" {
+		target := strings.TrimRight(ar.Request.URL.Path, "/") + "/" + hlsMaster
+		if ar.Request.URL.RawQuery != "" {
+			target += "?" + ar.Request.URL.RawQuery
+		}
+		http.Redirect(ar.Writer, ar.Request, target, http.StatusMovedPermanently)
+		return nil
+	}
+	if ok, err := ar.EnsureEntry(a); !ok {
+		return err
+	}
+	entry := ar.Entry
+	fs, err := ms.storages.FS(entry.filebase)
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Cannot access storage %s: %s", entry.filebase, err.Error()))
+	}
+	if !entry.jwtkey.Valid {
+		ar.Writer.Header().Set("Cache-Control", ms.cfg.Mediaserver.CacheControl)
+	}
+	name := path.Join(path.Dir(entry.path), ar.ParamString)
+	switch path.Ext(name) {
+	case ".m3u8":
+		return a.servePlaylist(ar, fs, name)
+	case ".mp4":
+		ar.Writer.Header().Set("Content-Type", "video/mp4")
+	case ".m4s":
+		ar.Writer.Header().Set("Content-Type", "video/iso.segment")
+	}
+	return ms.serveStorageFile(ar.Writer, ar.Request, fs, name)
+}
+
+// total duration of the segments of a media playlist. 0 for master playlists
+func playlistDuration(playlist []byte) time.Duration {
+	var total float64
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "#EXTINF:"); ok {
+			value, _, _ = strings.Cut(value, ",")
+			if seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && seconds > 0 {
+				total += seconds
+			}
+		}
+	}
+	return time.Duration(total * float64(time.Second))
+}
+
+// deliver a playlist. for private items every uri gets its own access token
+func (a *hlsAction) servePlaylist(ar *ActionRequest, fs StorageFS, name string) error {
+	ms := ar.Mediaserver
+	file, err := fs.Open(name)
+	if err != nil {
+		return ar.Error(http.StatusNotFound, fmt.Sprintf("File not found: %s - %s", ar.ParamString, err.Error()))
+	}
+	defer file.Close()
+	playlist, err := io.ReadAll(file)
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Cannot read %s: %s", name, err.Error()))
+	}
+
+	if ar.Entry.jwtkey.Valid && ar.Entry.private == 1 {
+		dir := path.Dir(ar.ParamString)
+		// the segments of a media playlist must be accessible until the end of the playback
+		ttl := ms.cfg.Mediaserver.HLS.TokenTTL
+		if ttl <= 0 {
+			ttl = 2 * time.Hour
+		}
+		ttl += playlistDuration(playlist)
+		sign := func(uri string) (string, error) {
+			sub := strings.ToLower(ms.cfg.SubPrefix + ar.Collection.name + "/" + ar.Signature + "/hls/" + path.Join(dir, uri))
+			token, err := NewJWT(ar.Entry.jwtkey.String, sub, int64(ttl.Seconds()))
+			if err != nil {
+				return "", err
+			}
+			return uri + "?token=" + url.QueryEscape(token), nil
+		}
+		out := &bytes.Buffer{}
+		scanner := bufio.NewScanner(bytes.NewReader(playlist))
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+			case !strings.HasPrefix(line, "#"):
+				if line, err = sign(line); err != nil {
+					return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Error creating access token: %s", err.Error()))
+				}
+			case hlsURIAttr.MatchString(line):
+				uri := hlsURIAttr.FindStringSubmatch(line)[1]
+				signed, err := sign(uri)
+				if err != nil {
+					return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Error creating access token: %s", err.Error()))
+				}
+				line = strings.Replace(line, `URI="`+uri+`"`, `URI="`+signed+`"`, 1)
+			}
+			out.WriteString(line + "\n")
+		}
+		playlist = out.Bytes()
+	}
+	ar.Writer.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	ar.Writer.Header().Set("Content-Length", strconv.Itoa(len(playlist)))
+	if ar.Request.Method == http.MethodHead {
+		return nil
+	}
+	_, err = ar.Writer.Write(playlist)
+	return err
+}
+
+func (a *hlsAction) Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error) {
+	return a.GenerateProgress(ms, coll, signature, params, nil)
+}
+
+// one ffmpeg run creates all renditions up to the height of the master
+func (a *hlsAction) GenerateProgress(ms *Mediaserver, coll Collection, signature string, params []string, progress func(float64)) (*Entry, error) {
+	input, cleanup, _, err := ms.LocalMaster(coll, signature)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	streams, err := ms.probeStreams(input)
+	if err != nil {
+		return nil, err
+	}
+	height, audio := 0, false
+	for _, stream := range streams {
+		switch stream.CodecType {
+		case "video":
+			height = max(height, stream.Height)
+		case "audio":
+			audio = true
+		}
+	}
+	if height == 0 {
+		return nil, fmt.Errorf("%s/%s has no video stream", coll.name, signature)
+	}
+	renditions := []int{}
+	heights := ms.cfg.Mediaserver.HLS.Renditions
+	if len(heights) == 0 {
+		heights = []int{360, 720, 1080}
+	}
+	for _, h := range heights {
+		if h <= height {
+			renditions = append(renditions, h)
+		}
+	}
+	if len(renditions) == 0 {
+		renditions = []int{height}
+	}
+	sort.Ints(renditions)
+	segment := ms.cfg.Mediaserver.HLS.Segment
+	if segment <= 0 {
+		segment = 6 * time.Second
+	}
+
+	dir, err := os.MkdirTemp(ms.cfg.Mediaserver.Derivatives.TempDir, "mediasrv2-hls-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// split the video for the renditions
+	filter := fmt.Sprintf("[0:v]split=%d", len(renditions))
+	for i := range renditions {
+		filter += fmt.Sprintf("[v%d]", i)
+	}
+	for i, h := range renditions {
+		filter += fmt.Sprintf(";[v%d]scale=-2:%d[v%dout]", i, h&^1, i)
+	}
+	args := []string{"-y", "-nostdin", "-v", "error", "-i", input, "-filter_complex", filter}
+	streamMap := []string{}
+	for i, h := range renditions {
+		// bitrate grows with the number of pixels, 2800k for 720p
+		bitrate := h * h * 54 / 10000
+		args = append(args, "-map", fmt.Sprintf("[v%dout]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264", fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", bitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", bitrate*3/2), fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", bitrate*2))
+		if audio {
+			args = append(args, "-map", "0:a:0")
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d,name:%dp", i, i, h))
+		} else {
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,name:%dp", i, h))
+		}
+	}
+	if audio {
+		args = append(args, "-c:a", "aac", "-b:a", "128k", "-ac", "2")
+	}
+	// keyframes at the segment boundaries
+	seconds := strconv.FormatFloat(segment.Seconds(), 'f', -1, 64)
+	args = append(args,
+		"-preset", "medium", "-pix_fmt", "yuv420p",
+		"-force_key_frames", "expr:gte(t,n_forced*"+seconds+")",
+		"-f", "hls",
+		"-hls_time", seconds,
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", "init.mp4",
+		"-hls_segment_filename", dir+"/%v/seg%05d.m4s",
+		"-master_pl_name", hlsMaster,
+		"-var_stream_map", strings.Join(streamMap, " "),
+	)
+	var position func(float64)
+	if progress != nil {
+		if duration := ms.probeDuration(input); duration > 0 {
+			args = append(args, "-progress", "pipe:1", "-nostats")
+			position = func(seconds float64) { progress(min(seconds/duration, 0.99)) }
+		}
+	}
+	args = append(args, dir+"/%v/playlist.m3u8")
+	start := time.Now()
+	if err := ms.runFFmpeg(args, position); err != nil {
+		return nil, err
+	}
+	ms.logger.Infof("hls package of %s/%s with %v in %v", coll.name, signature, renditions, time.Since(start))
+	return ms.StoreDerivativeDir(coll, signature, "hls", "", "application/vnd.apple.mpegurl", dir, hlsMaster)
+}
@@ -0,0 +1,107 @@
+package mediaserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// request of the http derivative service
+type httpBackendRequest struct {
+	Collection string   `json:"collection"`
+	Signature  string   `json:"signature"`
+	Action     string   `json:"action"`
+	Params     []string `json:"params"`
+	Token      string   `json:"token,omitempty"`
+	// method of the client request, the service doesn't need to send a body for HEAD
+	Method string `json:"method"`
+}
+
+// response of the http derivative service or the php mediaserver which has already been sent to the client of ar
+type streamedResponse struct {
+	ar     *ActionRequest
+	status int
+	err    error
+}
+
+// call the http derivative service. the request headers which change the response are forwarded
+func (ar *ActionRequest) callHTTP(action string) (*http.Response, error) {
+	ms := ar.Mediaserver
+	cfg := ms.cfg.Mediaserver.HTTPBackend
+	body, err := json.Marshal(&httpBackendRequest{
+		Collection: ar.Collection.name,
+		Signature:  ar.Signature,
+		Action:     action,
+		Params:     ar.Params,
+		Token:      ar.Token,
+		Method:     ar.Request.Method,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid url of http backend %s: %v", cfg.URL, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", VERSION)
+	if cfg.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Secret)
+	}
+	for _, name := range fcgiVariantHeaders {
+		for _, value := range ar.Request.Header.Values(name) {
+			req.Header.Add(name, value)
+		}
+	}
+	if host, _, err := net.SplitHostPort(ar.Request.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+	ms.logger.Debugf("http backend %s: %s/%s/%s/%s", cfg.URL, ar.Collection.name, ar.Signature, action, strings.Join(ar.Params, "/"))
+	resp, err := ms.httpBackend.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get data from http backend: %s", err)
+	}
+	return resp, nil
+}
+
+// stream the response of the http derivative service to the client
+func (ar *ActionRequest) streamHTTP(resp *http.Response) error {
+	header := ar.Writer.Header()
+	for name, values := range resp.Header {
+		header[name] = append([]string{}, values...)
+	}
+	for _, name := range fcgiHopHeaders {
+		header.Del(name)
+	}
+	ar.Writer.WriteHeader(resp.StatusCode)
+	if ar.Request.Method == http.MethodHead {
+		return nil
+	}
+	_, err := io.Copy(ar.Writer, resp.Body)
+	return err
+}
+
+// forward the request to the http derivative service without sharing the call
+func (ar *ActionRequest) fallbackHTTP(action string) error {
+	resp, err := ar.callHTTP(action)
+	if err != nil {
+		return ar.Error(http.StatusBadGateway, err.Error())
+	}
+	defer resp.Body.Close()
+	return ar.streamHTTP(resp)
+}
+
+// create a missing derivative with the http derivative service. the response goes to the client of ar,
+// requests waiting for the same derivative look it up in the cache afterwards
+func (ar *ActionRequest) generateHTTP() (*streamedResponse, error) {
+	resp, err := ar.callHTTP(ar.cacheAction)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return &streamedResponse{ar: ar, status: resp.StatusCode, err: ar.streamHTTP(resp)}, nil
+}
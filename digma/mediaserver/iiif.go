@@ -0,0 +1,597 @@
+package mediaserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/je4/mediaserver2/digma/ptiff"
+	"golang.org/x/image/draw"
+)
+
+// built-in iiif image api 3.0 (level 2) for pyramidal tiffs
+
+const iiifImageContext = "http://iiif.io/api/image/3/context.json"
+
+// error of the image api. 400 for invalid requests, 501 for valid requests which are not supported
+type iiifError struct {
+	status  int
+	message string
+}
+
+func (e *iiifError) Error() string { return e.message }
+
+func iiifBadRequest(format string, a ...interface{}) error {
+	return &iiifError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+// mimetypes of the output formats
+var iiifFormats = map[string]string{
+	"jpg":  "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+	"gif":  "image/gif",
+}
+
+// formats of the specification which are not implemented
+var iiifUnsupportedFormats = []string{"tif", "jp2", "pdf"}
+
+// default limit of the output area. upscaling is always limited
+const iiifMaxArea = 25000000
+
+// default lifetime of the access tokens in manifests and image services
+const iiifTokenTTL = 2 * time.Hour
+
+// lifetime of the access tokens in manifests and image services in seconds
+func (ms *Mediaserver) iiifTokenTTL() int64 {
+	ttl := ms.cfg.Mediaserver.IIIF.TokenTTL
+	if ttl <= 0 {
+		ttl = iiifTokenTTL
+	}
+	return int64(ttl / time.Second)
+}
+
+// server limits of the output size. maxHeight is only used together with maxWidth
+type iiifLimits struct {
+	maxWidth  int
+	maxHeight int
+	maxArea   int64
+}
+
+func (ms *Mediaserver) iiifLimits() iiifLimits {
+	cfg := ms.cfg.Mediaserver.IIIF
+	limits := iiifLimits{maxWidth: cfg.MaxWidth, maxArea: cfg.MaxArea}
+	if limits.maxArea <= 0 {
+		limits.maxArea = iiifMaxArea
+	}
+	if limits.maxWidth > 0 {
+		limits.maxHeight = cfg.MaxHeight
+		if limits.maxHeight <= 0 {
+			limits.maxHeight = limits.maxWidth
+		}
+	}
+	return limits
+}
+
+// {region}/{size}/{rotation}/{quality}.{format}
+type iiifImageRequest struct {
+	// region in full resolution
+	region  image.Rectangle
+	full    bool
+	width   int
+	height  int
+	upscale bool
+	mirror  bool
+	// clockwise, multiple of 90
+	rotation int
+	quality  string
+	format   string
+}
+
+// canonical form of the request. equivalent requests share the cached result
+func (r *iiifImageRequest) canonical() string {
+	region := "full"
+	if !r.full {
+		region = fmt.Sprintf("%d,%d,%d,%d", r.region.Min.X, r.region.Min.Y, r.region.Dx(), r.region.Dy())
+	}
+	size := fmt.Sprintf("%d,%d", r.width, r.height)
+	if r.upscale {
+		size = "^" + size
+	}
+	rotation := strconv.Itoa(r.rotation)
+	if r.mirror {
+		rotation = "!" + rotation
+	}
+	return fmt.Sprintf("%s/%s/%s/%s.%s", region, size, rotation, r.quality, r.format)
+}
+
+func parseIIIFImageRequest(params string, width int, height int, limits iiifLimits) (*iiifImageRequest, error) {
+	parts := strings.Split(strings.Trim(params, "/"), "/")
+	if len(parts) != 4 {
+		return nil, iiifBadRequest("invalid image request %s", params)
+	}
+	r := &iiifImageRequest{}
+	if err := r.parseRegion(parts[0], width, height); err != nil {
+		return nil, err
+	}
+	if err := r.parseSize(parts[1], limits); err != nil {
+		return nil, err
+	}
+	if err := r.parseRotation(parts[2]); err != nil {
+		return nil, err
+	}
+	quality, format, ok := strings.Cut(parts[3], ".")
+	if !ok {
+		return nil, iiifBadRequest("missing format in %s", parts[3])
+	}
+	switch quality {
+	case "default", "color", "gray", "bitonal":
+		r.quality = quality
+	default:
+		return nil, iiifBadRequest("invalid quality %s", quality)
+	}
+	if _, ok := iiifFormats[format]; !ok {
+		for _, f := range iiifUnsupportedFormats {
+			if f == format {
+				return nil, &iiifError{http.StatusNotImplemented, fmt.Sprintf("format %s not supported", format)}
+			}
+		}
+		return nil, iiifBadRequest("invalid format %s", format)
+	}
+	r.format = format
+	return r, nil
+}
+
+// comma separated numbers
+func parseIIIFNumbers(s string, count int) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != count {
+		return nil, iiifBadRequest("invalid value %s", s)
+	}
+	result := make([]float64, count)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, iiifBadRequest("invalid value %s", s)
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// full, square, x,y,w,h, pct:x,y,w,h
+func (r *iiifImageRequest) parseRegion(region string, width int, height int) error {
+	bounds := image.Rect(0, 0, width, height)
+	switch {
+	case region == "full":
+		r.region = bounds
+	case region == "square":
+		size := min(width, height)
+		r.region = image.Rect((width-size)/2, (height-size)/2, (width-size)/2+size, (height-size)/2+size)
+	case strings.HasPrefix(region, "pct:"):
+		v, err := parseIIIFNumbers(strings.TrimPrefix(region, "pct:"), 4)
+		if err != nil {
+			return err
+		}
+		if v[2] <= 0 || v[3] <= 0 {
+			return iiifBadRequest("empty region %s", region)
+		}
+		fw, fh := float64(width)/100, float64(height)/100
+		r.region = image.Rect(int(math.Round(v[0]*fw)), int(math.Round(v[1]*fh)),
+			int(math.Round(math.Min(v[0]+v[2], 100)*fw)), int(math.Round(math.Min(v[1]+v[3], 100)*fh)))
+	default:
+		v, err := parseIIIFNumbers(region, 4)
+		if err != nil {
+			return err
+		}
+		for _, n := range v {
+			if n != math.Trunc(n) || n > math.MaxInt32 {
+				return iiifBadRequest("invalid region %s", region)
+			}
+		}
+		if v[2] == 0 || v[3] == 0 {
+			return iiifBadRequest("empty region %s", region)
+		}
+		r.region = image.Rect(int(v[0]), int(v[1]), int(min(v[0]+v[2], math.MaxInt32)), int(min(v[1]+v[3], math.MaxInt32)))
+	}
+	r.region = r.region.Intersect(bounds)
+	if r.region.Empty() {
+		return iiifBadRequest("region %s outside of the image", region)
+	}
+	r.full = r.region == bounds
+	return nil
+}
+
+// max, w,, ,h, pct:n, w,h, !w,h. with ^ the image may be upscaled
+func (r *iiifImageRequest) parseSize(size string, limits iiifLimits) error {
+	rw, rh := float64(r.region.Dx()), float64(r.region.Dy())
+	r.upscale = strings.HasPrefix(size, "^")
+	s := strings.TrimPrefix(size, "^")
+	scaled := func(scale float64) (int, int) {
+		return max(int(math.Round(rw*scale)), 1), max(int(math.Round(rh*scale)), 1)
+	}
+	switch {
+	case s == "max":
+		scale := 1.0
+		if r.upscale {
+			scale = math.Inf(1)
+		}
+		if limits.maxWidth > 0 {
+			scale = min(scale, float64(limits.maxWidth)/rw, float64(limits.maxHeight)/rh)
+		}
+		scale = min(scale, math.Sqrt(float64(limits.maxArea)/(rw*rh)))
+		r.width, r.height = scaled(scale)
+		// rounding must not exceed the limits
+		for int64(r.width)*int64(r.height) > limits.maxArea && r.width > 1 && r.height > 1 {
+			scale *= 0.999
+			r.width, r.height = scaled(scale)
+		}
+		return nil
+	case strings.HasPrefix(s, "pct:"):
+		pct, err := strconv.ParseFloat(strings.TrimPrefix(s, "pct:"), 64)
+		if err != nil || pct <= 0 || math.IsInf(pct, 0) {
+			return iiifBadRequest("invalid size %s", size)
+		}
+		r.width, r.height = scaled(pct / 100)
+	case strings.HasPrefix(s, "!"):
+		v, err := parseIIIFNumbers(strings.TrimPrefix(s, "!"), 2)
+		if err != nil || v[0] < 1 || v[1] < 1 {
+			return iiifBadRequest("invalid size %s", size)
+		}
+		scale := min(v[0]/rw, v[1]/rh)
+		if !r.upscale {
+			scale = min(scale, 1)
+		}
+		r.width, r.height = scaled(scale)
+		r.width, r.height = min(r.width, int(v[0])), min(r.height, int(v[1]))
+	default:
+		w, h, ok := strings.Cut(s, ",")
+		if !ok || (w == "" && h == "") {
+			return iiifBadRequest("invalid size %s", size)
+		}
+		var err error
+		if w != "" {
+			if r.width, err = strconv.Atoi(w); err != nil || r.width < 1 {
+				return iiifBadRequest("invalid size %s", size)
+			}
+		}
+		if h != "" {
+			if r.height, err = strconv.Atoi(h); err != nil || r.height < 1 {
+				return iiifBadRequest("invalid size %s", size)
+			}
+		}
+		switch {
+		case w == "":
+			r.width, _ = scaled(float64(r.height) / rh)
+		case h == "":
+			_, r.height = scaled(float64(r.width) / rw)
+		}
+	}
+	if !r.upscale && (r.width > r.region.Dx() || r.height > r.region.Dy()) {
+		return iiifBadRequest("size %s is larger than the region, use ^ for upscaling", size)
+	}
+	// the area as float, the product of large sizes overflows
+	if (limits.maxWidth > 0 && (r.width > limits.maxWidth || r.height > limits.maxHeight)) ||
+		float64(r.width)*float64(r.height) > float64(limits.maxArea) {
+		return iiifBadRequest("size %s exceeds the limits of the server", size)
+	}
+	return nil
+}
+
+// n or !n for mirroring. only multiples of 90 degrees are supported
+func (r *iiifImageRequest) parseRotation(rotation string) error {
+	r.mirror = strings.HasPrefix(rotation, "!")
+	angle, err := strconv.ParseFloat(strings.TrimPrefix(rotation, "!"), 64)
+	if err != nil || angle < 0 || angle > 360 {
+		return iiifBadRequest("invalid rotation %s", rotation)
+	}
+	if angle != math.Trunc(angle) || int(angle)%90 != 0 {
+		return &iiifError{http.StatusNotImplemented, fmt.Sprintf("rotation %s not supported", rotation)}
+	}
+	r.rotation = int(angle) % 360
+	return nil
+}
+
+// pyramid level for the request: the smallest one which does not need upscaling
+func iiifLevel(levels []ptiff.Level, r *iiifImageRequest) int {
+	full := levels[0]
+	index := 0
+	for i, l := range levels[1:] {
+		if int64(r.region.Dx())*int64(l.Width) < int64(r.width)*int64(full.Width) ||
+			int64(r.region.Dy())*int64(l.Height) < int64(r.height)*int64(full.Height) {
+			break
+		}
+		index = i + 1
+	}
+	return index
+}
+
+// create the image of a request
+func (ms *Mediaserver) renderIIIF(tr *ptiff.Reader, r *iiifImageRequest) ([]byte, error) {
+	levels := tr.Levels()
+	index := iiifLevel(levels, r)
+	full, l := levels[0], levels[index]
+	// region in the coordinates of the level
+	scaleX := func(x int) int64 { return int64(x) * int64(l.Width) }
+	scaleY := func(y int) int64 { return int64(y) * int64(l.Height) }
+	w, h := int64(full.Width), int64(full.Height)
+	rect := image.Rect(int(scaleX(r.region.Min.X)/w), int(scaleY(r.region.Min.Y)/h),
+		int((scaleX(r.region.Max.X)+w-1)/w), int((scaleY(r.region.Max.Y)+h-1)/h))
+	// the regions of concurrent requests must fit into memory, like the masters of the image actions
+	ms.imageSlots <- struct{}{}
+	defer func() { <-ms.imageSlots }()
+	src, err := tr.ReadRegion(index, rect)
+	if err != nil {
+		return nil, err
+	}
+	var img image.Image = src
+	if src.Bounds().Dx() != r.width || src.Bounds().Dy() != r.height {
+		var dst draw.Image
+		if _, ok := src.(*image.Gray); ok {
+			dst = image.NewGray(image.Rect(0, 0, r.width, r.height))
+		} else {
+			dst = image.NewRGBA(image.Rect(0, 0, r.width, r.height))
+		}
+		draw.BiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+		img = dst
+	}
+	if r.mirror {
+		img = mirrorImage(img)
+	}
+	if r.rotation != 0 {
+		img = rotateImage(img, r.rotation)
+	}
+	switch r.quality {
+	case "gray", "bitonal":
+		gray := image.NewGray(img.Bounds())
+		draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+		if r.quality == "bitonal" {
+			for i, v := range gray.Pix {
+				if v < 128 {
+					gray.Pix[i] = 0
+				} else {
+					gray.Pix[i] = 255
+				}
+			}
+		}
+		img = gray
+	}
+
+	buf := &bytes.Buffer{}
+	switch r.format {
+	case "png":
+		err = png.Encode(buf, img)
+	case "webp":
+		err = nativewebp.Encode(buf, img, nil)
+	case "gif":
+		opts := &gif.Options{NumColors: 256}
+		if _, ok := img.(*image.Gray); ok {
+			opts.Quantizer = grayQuantizer{}
+		}
+		err = gif.Encode(buf, img, opts)
+	default:
+		quality := ms.cfg.Mediaserver.Images.Quality
+		if quality <= 0 {
+			quality = 85
+		}
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode %s: %v", r.format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// gray images keep their levels in gifs
+type grayQuantizer struct{}
+
+func (grayQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	for i := 0; i < 256; i++ {
+		p = append(p, color.Gray{Y: uint8(i)})
+	}
+	return p
+}
+
+// flip horizontally
+func mirrorImage(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dst.Set(b.Dx()-1-x, y, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+type iiifSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type iiifTiles struct {
+	Width        int   `json:"width"`
+	Height       int   `json:"height"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+// technical properties of an image service (image api 3.0, section 5)
+type iiifInfo struct {
+	Context        string      `json:"@context"`
+	ID             string      `json:"id"`
+	Type           string      `json:"type"`
+	Protocol       string      `json:"protocol"`
+	Profile        string      `json:"profile"`
+	Width          int         `json:"width"`
+	Height         int         `json:"height"`
+	MaxWidth       int         `json:"maxWidth,omitempty"`
+	MaxHeight      int         `json:"maxHeight,omitempty"`
+	MaxArea        int64       `json:"maxArea,omitempty"`
+	Sizes          []iiifSize  `json:"sizes,omitempty"`
+	Tiles          []iiifTiles `json:"tiles,omitempty"`
+	ExtraQualities []string    `json:"extraQualities"`
+	ExtraFormats   []string    `json:"extraFormats"`
+	ExtraFeatures  []string    `json:"extraFeatures"`
+}
+
+func newIIIFInfo(id string, levels []ptiff.Level, limits iiifLimits) *iiifInfo {
+	full := levels[0]
+	info := &iiifInfo{
+		Context:        iiifImageContext,
+		ID:             id,
+		Type:           "ImageService3",
+		Protocol:       "http://iiif.io/api/image",
+		Profile:        "level2",
+		Width:          full.Width,
+		Height:         full.Height,
+		MaxWidth:       limits.maxWidth,
+		MaxHeight:      limits.maxHeight,
+		MaxArea:        limits.maxArea,
+		ExtraQualities: []string{"color", "gray", "bitonal"},
+		ExtraFormats:   []string{"webp", "gif"},
+		ExtraFeatures:  []string{"mirroring", "sizeUpscaling"},
+	}
+	// the levels of the pyramid can be delivered without scaling
+	tiles := iiifTiles{Width: 512, Height: 512}
+	if full.Tiled {
+		tiles.Width, tiles.Height = full.TileWidth, full.TileHeight
+	}
+	for i := len(levels) - 1; i >= 0; i-- {
+		l := levels[i]
+		if (limits.maxWidth > 0 && (l.Width > limits.maxWidth || l.Height > limits.maxHeight)) ||
+			int64(l.Width)*int64(l.Height) > limits.maxArea {
+			continue
+		}
+		info.Sizes = append(info.Sizes, iiifSize{l.Width, l.Height})
+	}
+	for _, l := range levels {
+		factor := int(math.Round(float64(full.Width) / float64(l.Width)))
+		if n := len(tiles.ScaleFactors); n == 0 || tiles.ScaleFactors[n-1] < factor {
+			tiles.ScaleFactors = append(tiles.ScaleFactors, factor)
+		}
+	}
+	info.Tiles = []iiifTiles{tiles}
+	return info
+}
+
+// scheme, host and port of the server as seen by the client
+func (ms *Mediaserver) publicURL(req *http.Request) string {
+	proto, host, port := ms.getProtoHostPort(req)
+	if (proto == "http" && port != 80) || (proto == "https" && port != 443) {
+		host += ":" + strconv.Itoa(port)
+	}
+	return proto + "://" + host
+}
+
+// public url of the image service of a pyramidal tiff. token is <storageid>_<jwt>
+func (ms *Mediaserver) iiifID(req *http.Request, token string, iiifPath string) string {
+	return ms.publicURL(req) + singleJoiningSlash(ms.cfg.Mediaserver.IIIF.Alias, token) + "/iiif/3/" + iiifPath
+}
+
+// json-ld is delivered if the client asks for it
+func iiifContentType(req *http.Request, context string) string {
+	if strings.Contains(req.Header.Get("Accept"), "application/ld+json") {
+		return `application/ld+json;profile="` + context + `"`
+	}
+	return "application/json"
+}
+
+// serve the image api for a pyramidal tiff
+// iiifPath: escaped path of the image, used for the cache. params: iiif parameters. id: public url of the image service
+func (ms *Mediaserver) serveIIIF(writer http.ResponseWriter, req *http.Request, file StorageFile, iiifPath string, params string, id string) error {
+	params = strings.Trim(params, "/")
+	if params == "" {
+		http.Redirect(writer, req, id+"/info.json", http.StatusSeeOther)
+		return nil
+	}
+	tr, err := ptiff.NewReader(file)
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Cannot read pyramidal tiff %s: %s", iiifPath, err))
+		return err
+	}
+	levels := tr.Levels()
+	limits := ms.iiifLimits()
+
+	if params == "info.json" {
+		data, err := json.MarshalIndent(newIIIFInfo(id, levels, limits), "", "  ")
+		if err != nil {
+			ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Cannot create info.json of %s: %s", iiifPath, err))
+			return err
+		}
+		writer.Header().Set("Content-Type", iiifContentType(req, iiifImageContext))
+		writer.Header().Set("Link", `<http://iiif.io/api/image/3/level2.json>;rel="profile"`)
+		_, err = writer.Write(data)
+		return err
+	}
+
+	r, err := parseIIIFImageRequest(params, levels[0].Width, levels[0].Height, limits)
+	if err != nil {
+		status := http.StatusBadRequest
+		if ierr, ok := err.(*iiifError); ok {
+			status = ierr.status
+		}
+		ms.DoPanic(writer, req, status, fmt.Sprintf("Invalid iiif request %s/%s: %s", iiifPath, params, err))
+		return err
+	}
+	contentType := iiifFormats[r.format]
+	modTime := time.Time{}
+	if stat, err := file.Stat(); err == nil {
+		modTime = stat.ModTime()
+	}
+	if ms.iiifCache == nil {
+		data, err := ms.renderIIIF(tr, r)
+		if err != nil {
+			ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Cannot create %s/%s: %s", iiifPath, params, err))
+			return err
+		}
+		writer.Header().Set("Content-Type", contentType)
+		http.ServeContent(writer, req, "", modTime, bytes.NewReader(data))
+		return nil
+	}
+
+	key := iiifCacheKey(iiifPath, r.canonical())
+	if filename, item, ok := ms.iiifCache.Get(key); ok {
+		ms.logger.Debugf("iiif cache hit: %s", key)
+		if f, err := os.Open(filename); err == nil {
+			defer f.Close()
+			writer.Header().Set("Content-Type", item.ContentType)
+			http.ServeContent(writer, req, "", item.Created, f)
+			return nil
+		}
+	}
+	// concurrent identical requests wait for one rendering
+	val, err, shared := ms.iiifCache.flight.Do(key, func() (interface{}, error) {
+		start := time.Now()
+		data, err := ms.renderIIIF(tr, r)
+		if err != nil {
+			return nil, err
+		}
+		ms.logger.Debugf("rendered iiif %s in %v", key, time.Since(start))
+		if err := ms.iiifCache.Put(key, contentType, data, ms.iiifCache.ttl("")); err != nil {
+			ms.logger.Errorf("cannot store %s in iiif cache: %v", key, err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Cannot create %s/%s: %s", iiifPath, params, err))
+		return err
+	}
+	if shared {
+		ms.logger.Debugf("iiif shared response: %s", key)
+	}
+	writer.Header().Set("Content-Type", contentType)
+	http.ServeContent(writer, req, "", modTime, bytes.NewReader(val.([]byte)))
+	return nil
+}
@@ -0,0 +1,88 @@
+package mediaserver
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseIIIFImageRequest(t *testing.T) {
+	limits := iiifLimits{maxArea: iiifMaxArea}
+	small := iiifLimits{maxWidth: 1000, maxHeight: 1000, maxArea: iiifMaxArea}
+	large := iiifLimits{maxWidth: 5000, maxHeight: 5000, maxArea: iiifMaxArea}
+	// image of 4000x3000 pixels
+	tests := []struct {
+		params string
+		limits iiifLimits
+		want   string
+	}{
+		{"full/max/0/default.jpg", limits, "full/4000,3000/0/default.jpg"},
+		{"0,0,1000,500/500,/90/gray.png", limits, "0,0,1000,500/500,250/90/gray.png"},
+		{"square/,300/!0/color.webp", limits, "500,0,3000,3000/300,300/!0/color.webp"},
+		{"pct:50,50,50,50/pct:10/180/bitonal.gif", limits, "2000,1500,2000,1500/200,150/180/bitonal.gif"},
+		{"full/!400,400/0/default.jpg", limits, "full/400,300/0/default.jpg"},
+		{"3000,2000,5000,5000/max/0/default.jpg", limits, "3000,2000,1000,1000/1000,1000/0/default.jpg"},
+		{"0,0,4000,3000/4000,3000/360/default.jpg", limits, "full/4000,3000/0/default.jpg"},
+		{"full/max/0/default.jpg", small, "full/1000,750/0/default.jpg"},
+		{"full/^max/0/default.jpg", large, "full/^5000,3750/0/default.jpg"},
+		{"full/^!4800,4800/0/default.jpg", limits, "full/^4800,3600/0/default.jpg"},
+	}
+	for _, test := range tests {
+		r, err := parseIIIFImageRequest(test.params, 4000, 3000, test.limits)
+		if err != nil {
+			t.Errorf("%s: %v", test.params, err)
+			continue
+		}
+		if got := r.canonical(); got != test.want {
+			t.Errorf("%s: got %s, expected %s", test.params, got, test.want)
+		}
+	}
+	// upscaling to the maximum is limited by the area
+	r, err := parseIIIFImageRequest("full/^max/0/default.jpg", 4000, 3000, limits)
+	if err != nil || r.width <= 4000 || int64(r.width)*int64(r.height) > iiifMaxArea {
+		t.Errorf("full/^max/0/default.jpg: %v %v", r, err)
+	}
+}
+
+func TestParseIIIFImageRequestInvalid(t *testing.T) {
+	limits := iiifLimits{maxArea: iiifMaxArea}
+	small := iiifLimits{maxWidth: 1000, maxHeight: 1000, maxArea: iiifMaxArea}
+	tests := []struct {
+		params string
+		limits iiifLimits
+		status int
+	}{
+		{"full/max/0", limits, http.StatusBadRequest},
+		{"full/max/0/default", limits, http.StatusBadRequest},
+		{"full/max/0/sepia.jpg", limits, http.StatusBadRequest},
+		{"full/max/0/default.bmp", limits, http.StatusBadRequest},
+		{"full/max/0/default.tif", limits, http.StatusNotImplemented},
+		{"full/max/45/default.jpg", limits, http.StatusNotImplemented},
+		{"full/max/400/default.jpg", limits, http.StatusBadRequest},
+		{"5000,5000,10,10/max/0/default.jpg", limits, http.StatusBadRequest},
+		{"0,0,0,10/max/0/default.jpg", limits, http.StatusBadRequest},
+		{"0.5,0,10,10/max/0/default.jpg", limits, http.StatusBadRequest},
+		{"pct:0,0,0,10/max/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/0,/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/,/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/pct:0/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/!0,10/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/4001,/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/^100000,100000/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/^9223372036854775807,9223372036854775807/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/^pct:1000/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/^!8000,8000/0/default.jpg", limits, http.StatusBadRequest},
+		{"full/1001,/0/default.jpg", small, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		_, err := parseIIIFImageRequest(test.params, 4000, 3000, test.limits)
+		var iiifErr *iiifError
+		if !errors.As(err, &iiifErr) {
+			t.Errorf("%s: expected iiif error, got %v", test.params, err)
+			continue
+		}
+		if iiifErr.status != test.status {
+			t.Errorf("%s: status %d, expected %d", test.params, iiifErr.status, test.status)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package mediaserver
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+// default size of the cache in bytes
+const iiifCacheMaxSize = 1 << 30
+
+// prefix of files which are not yet renamed to their final name
+const iiifCacheTempPrefix = "tmp-"
+
+// size bounded disk cache for responses of the iiif server
+// every entry is stored as <hash>.data with metadata in <hash>.json
+type IIIFCache struct {
+	dir        string
+	maxSize    int64
+	defaultTTL time.Duration
+	size       int64
+	items      map[string]*list.Element
+	order      *list.List
+	m          sync.Mutex
+	flight     *flightGroup
+	logger     *logging.Logger
+	hits       atomic.Int64
+	misses     atomic.Int64
+}
+
+// metadata of a cache entry
+type iiifCacheItem struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"contenttype"`
+	Size        int64     `json:"size"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// create cache in dir and load the existing entries. maxsize defaults to 1 GiB
+func NewIIIFCache(cfg iiifcache, logger *logging.Logger) (*IIIFCache, error) {
+	if cfg.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid iiif cache size %d", cfg.MaxSize)
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = iiifCacheMaxSize
+	}
+	ic := &IIIFCache{
+		dir:        cfg.Dir,
+		maxSize:    cfg.MaxSize,
+		defaultTTL: cfg.TTL,
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+		flight:     newFlightGroup(),
+		logger:     logger,
+	}
+	if err := os.MkdirAll(ic.dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create iiif cache folder %s: %v", ic.dir, err)
+	}
+	// temporary files of puts which were interrupted by a shutdown or crash
+	temps, err := filepath.Glob(filepath.Join(ic.dir, "*", iiifCacheTempPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil {
+			logger.Warningf("cannot remove stale iiif cache file %s: %v", temp, err)
+		}
+	}
+	metas, err := filepath.Glob(filepath.Join(ic.dir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	items := []*iiifCacheItem{}
+	for _, meta := range metas {
+		data, err := os.ReadFile(meta)
+		if err != nil {
+			continue
+		}
+		item := &iiifCacheItem{}
+		if err := json.Unmarshal(data, item); err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	// newest entries first
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.After(items[j].Created) })
+	for _, item := range items {
+		ic.items[item.Key] = ic.order.PushBack(item)
+		ic.size += item.Size
+	}
+	ic.m.Lock()
+	ic.evict()
+	ic.m.Unlock()
+	return ic, nil
+}
+
+// normalized cache key of a iiif request
+func iiifCacheKey(file string, params string) string {
+	params = strings.ToLower(strings.Trim(path.Clean("/"+params), "/"))
+	return strings.Trim(file, "/") + "/" + params
+}
+
+// info.json contains the url of the service with the access token. it cannot be shared
+func iiifCacheable(params string) bool {
+	return params != "" && !strings.HasSuffix(strings.ToLower(strings.TrimRight(params, "/")), "info.json")
+}
+
+// ttl for a response from the cache-control header. 0 means not cacheable
+func (ic *IIIFCache) ttl(cacheControl string) time.Duration {
+	ttl := ic.defaultTTL
+	maxAge := -1
+	for _, directive := range strings.Split(strings.ToLower(cacheControl), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return 0
+		case strings.HasPrefix(directive, "s-maxage="):
+			// s-maxage has precedence for shared caches
+			if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "s-maxage=")); err == nil {
+				maxAge = secs
+				ttl = time.Duration(secs) * time.Second
+			}
+		case strings.HasPrefix(directive, "max-age=") && maxAge < 0:
+			if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				ttl = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return ttl
+}
+
+func (ic *IIIFCache) filename(key string, ext string) string {
+	hash := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(ic.dir, name[:2], name+ext)
+}
+
+// get an entry. returns the name of the data file
+func (ic *IIIFCache) Get(key string) (filename string, item *iiifCacheItem, ok bool) {
+	ic.m.Lock()
+	defer ic.m.Unlock()
+	elem, ok := ic.items[key]
+	if !ok {
+		ic.misses.Add(1)
+		return "", nil, false
+	}
+	item = elem.Value.(*iiifCacheItem)
+	if time.Now().After(item.Expires) {
+		ic.remove(elem)
+		ic.misses.Add(1)
+		return "", nil, false
+	}
+	ic.order.MoveToFront(elem)
+	ic.hits.Add(1)
+	return ic.filename(key, ".data"), item, true
+}
+
+// store an entry. data and metadata are written to temporary files and renamed
+// without holding the lock. only the index is updated under the lock
+func (ic *IIIFCache) Put(key string, contentType string, data []byte, ttl time.Duration) error {
+	if ttl <= 0 || int64(len(data)) > ic.maxSize {
+		return nil
+	}
+	item := &iiifCacheItem{
+		Key:         key,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Created:     time.Now(),
+		Expires:     time.Now().Add(ttl),
+	}
+	meta, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	dataFile := ic.filename(key, ".data")
+	metaFile := ic.filename(key, ".json")
+	if err := os.MkdirAll(filepath.Dir(dataFile), 0755); err != nil {
+		return err
+	}
+	dataTmp, err := writeTemp(filepath.Dir(dataFile), data)
+	if err != nil {
+		return err
+	}
+	metaTmp, err := writeTemp(filepath.Dir(metaFile), meta)
+	if err != nil {
+		os.Remove(dataTmp)
+		return err
+	}
+
+	// the old entry must not be evicted while its files are replaced
+	ic.m.Lock()
+	ic.detach(key)
+	ic.m.Unlock()
+
+	if err := os.Rename(dataTmp, dataFile); err != nil {
+		os.Remove(dataTmp)
+		os.Remove(metaTmp)
+		return err
+	}
+	if err := os.Rename(metaTmp, metaFile); err != nil {
+		os.Remove(metaTmp)
+		os.Remove(dataFile)
+		return err
+	}
+
+	ic.m.Lock()
+	defer ic.m.Unlock()
+	// a concurrent put of the same key has written the same files
+	ic.detach(key)
+	ic.items[key] = ic.order.PushFront(item)
+	ic.size += item.Size
+	ic.evict()
+	return nil
+}
+
+// write data to a new temporary file in dir and return its name
+func writeTemp(dir string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(dir, iiifCacheTempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// remove entry from the index but keep its files. needs lock
+func (ic *IIIFCache) detach(key string) {
+	if elem, ok := ic.items[key]; ok {
+		ic.order.Remove(elem)
+		delete(ic.items, key)
+		ic.size -= elem.Value.(*iiifCacheItem).Size
+	}
+}
+
+// remove entry. needs lock
+func (ic *IIIFCache) remove(elem *list.Element) {
+	item := elem.Value.(*iiifCacheItem)
+	ic.order.Remove(elem)
+	delete(ic.items, item.Key)
+	ic.size -= item.Size
+	os.Remove(ic.filename(item.Key, ".json"))
+	os.Remove(ic.filename(item.Key, ".data"))
+}
+
+// remove least recently used entries until the cache fits. needs lock
+func (ic *IIIFCache) evict() {
+	for ic.size > ic.maxSize && ic.order.Len() > 0 {
+		elem := ic.order.Back()
+		ic.logger.Debugf("iiif cache: evict %s", elem.Value.(*iiifCacheItem).Key)
+		ic.remove(elem)
+	}
+}
+
+// statistics
+func (ic *IIIFCache) Stats() CacheStats {
+	ic.m.Lock()
+	defer ic.m.Unlock()
+	return CacheStats{
+		Hits:     ic.hits.Load(),
+		Misses:   ic.misses.Load(),
+		Entries:  ic.order.Len(),
+		Bytes:    ic.size,
+		MaxBytes: ic.maxSize,
+	}
+}
@@ -0,0 +1,154 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// signature of the iiif collection document of a collection
+const IIIFCollectionSignature = "iiif-collection"
+
+// masters of these types have a manifest
+const iiifCollectionTypes = "(mimetype LIKE 'image/%' OR mimetype LIKE 'video/%' OR mimetype LIKE 'audio/%' OR mimetype = 'application/pdf')"
+
+// reference to a manifest or a page of a collection
+type iiifReference struct {
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	Label iiifLangMap `json:"label"`
+}
+
+// iiif presentation api 3.0 collection
+type iiifCollection struct {
+	Context string           `json:"@context"`
+	ID      string           `json:"id"`
+	Type    string           `json:"type"`
+	Label   iiifLangMap      `json:"label"`
+	PartOf  []*iiifReference `json:"partOf,omitempty"`
+	Items   []*iiifReference `json:"items"`
+}
+
+// labels of the masters of a collection from the table iiifmetadata
+func (ms *Mediaserver) masterLabels(coll Collection, signatures []string) (map[string]iiifLangMap, error) {
+	labels := map[string]iiifLangMap{}
+	if len(signatures) == 0 {
+		return labels, nil
+	}
+	args := []interface{}{coll.id}
+	for _, signature := range signatures {
+		args = append(args, signature)
+	}
+	rows, err := ms.db.Query("SELECT signature, language, value FROM iiifmetadata WHERE collection_id=? AND field='label'"+
+		" AND signature IN (?"+strings.Repeat(", ?", len(signatures)-1)+") ORDER BY sort", args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query labels of %s: %v", coll.name, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var signature, language, value string
+		if err := rows.Scan(&signature, &language, &value); err != nil {
+			return nil, fmt.Errorf("cannot scan labels of %s: %v", coll.name, err)
+		}
+		if language == "" {
+			language = "none"
+		}
+		if labels[signature] == nil {
+			labels[signature] = iiifLangMap{}
+		}
+		labels[signature][language] = append(labels[signature][language], value)
+	}
+	return labels, rows.Err()
+}
+
+// iiif collection of the public masters of a collection. large collections are split into pages,
+// the collection lists the pages, every page (query parameter page) lists the manifests of its masters
+func (ms *Mediaserver) HandlerIIIFCollection(writer http.ResponseWriter, req *http.Request, collection string) error {
+	coll, err := ms.collections.ByName(collection)
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusNotFound, err.Error())
+		return err
+	}
+	pageSize := ms.cfg.Mediaserver.IIIF.PageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	var count int
+	if err := ms.db.QueryRow("SELECT COUNT(*) FROM fullcache WHERE collection_id=? AND action='master' AND param='' AND private=0 AND "+iiifCollectionTypes, coll.id).Scan(&count); err != nil {
+		ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("cannot count masters of %s: %v", coll.name, err))
+		return err
+	}
+	pages := (count + pageSize - 1) / pageSize
+
+	base := ms.publicURL(req) + strings.TrimRight(ms.cfg.Mediaserver.Alias, "/") + "/" + coll.name
+	id := base + "/" + IIIFCollectionSignature
+	result := &iiifCollection{
+		Context: iiifPresentationContext,
+		ID:      id,
+		Type:    "Collection",
+		Label:   iiifLangMap{"none": {coll.name}},
+		Items:   []*iiifReference{},
+	}
+	page := 1
+	if p := req.URL.Query().Get("page"); p != "" {
+		if page, err = strconv.Atoi(p); err != nil || page < 1 || page > max(pages, 1) {
+			ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("invalid page %s of %s", p, id))
+			return fmt.Errorf("invalid page %s", p)
+		}
+		result.ID = fmt.Sprintf("%s?page=%d", id, page)
+		result.Label = iiifLangMap{"none": {fmt.Sprintf("%s (%d/%d)", coll.name, page, pages)}}
+		result.PartOf = []*iiifReference{{ID: id, Type: "Collection", Label: iiifLangMap{"none": {coll.name}}}}
+	} else if pages > 1 {
+		for p := 1; p <= pages; p++ {
+			result.Items = append(result.Items, &iiifReference{
+				ID:    fmt.Sprintf("%s?page=%d", id, p),
+				Type:  "Collection",
+				Label: iiifLangMap{"none": {fmt.Sprintf("%d - %d", (p-1)*pageSize+1, min(p*pageSize, count))}},
+			})
+		}
+	}
+
+	if len(result.Items) == 0 {
+		rows, err := ms.db.Query("SELECT signature FROM fullcache WHERE collection_id=? AND action='master' AND param='' AND private=0 AND "+iiifCollectionTypes+
+			" ORDER BY signature LIMIT ? OFFSET ?", coll.id, pageSize, (page-1)*pageSize)
+		if err != nil {
+			ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("cannot query masters of %s: %v", coll.name, err))
+			return err
+		}
+		signatures := []string{}
+		for rows.Next() {
+			var signature string
+			if err := rows.Scan(&signature); err != nil {
+				rows.Close()
+				ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("cannot scan masters of %s: %v", coll.name, err))
+				return err
+			}
+			signatures = append(signatures, signature)
+		}
+		rows.Close()
+		labels, err := ms.masterLabels(coll, signatures)
+		if err != nil {
+			ms.logger.Warningf("%v", err)
+		}
+		for _, signature := range signatures {
+			label := labels[signature]
+			if label == nil {
+				label = iiifLangMap{"none": {signature}}
+			}
+			result.Items = append(result.Items, &iiifReference{ID: base + "/" + url.PathEscape(signature) + "/manifest", Type: "Manifest", Label: label})
+		}
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Cannot create iiif collection of %s: %s", coll.name, err))
+		return err
+	}
+	writer.Header().Set("Content-Type", iiifContentType(req, iiifPresentationContext))
+	writer.Header().Set("Cache-Control", ms.cfg.Mediaserver.CacheControl)
+	_, err = writer.Write(data)
+	return err
+}
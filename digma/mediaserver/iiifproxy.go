@@ -0,0 +1,264 @@
+package mediaserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// response of the iiif server
+type iiifResponse struct {
+	status       int
+	contentType  string
+	cacheControl string
+	body         []byte
+}
+
+// forward a request to the iiif server
+// iiifPath: escaped path of the image on the iiif server, params: iiif parameters
+// forwardedPath: public path of the iiif service including the access token
+func (ms *Mediaserver) proxyIIIF(writer http.ResponseWriter, req *http.Request, iiifPath string, params string, forwardedPath string) (err error) {
+	iiifPathWithParam := iiifPath
+	if len(params) > 0 {
+		iiifPathWithParam = singleJoiningSlash(iiifPath, params)
+	}
+	urlstring := singleJoiningSlash(ms.cfg.Mediaserver.IIIF.URL, iiifPathWithParam)
+
+	newRequest := func() (*http.Request, error) {
+		req2, err := http.NewRequest("GET", urlstring, nil)
+		if err != nil {
+			return nil, err
+		}
+		proto, host, port := ms.getProtoHostPort(req)
+		req2.Header.Add("X-Forwarded-Proto", proto)
+		req2.Header.Add("X-Forwarded-Host", host)
+		req2.Header.Add("X-Forwarded-Port", strconv.Itoa(port))
+		req2.Header.Add("X-Forwarded-Path", forwardedPath)
+		req2.Header.Add("X-Forwarded-For", req.RemoteAddr[:strings.IndexByte(req.RemoteAddr, ':')])
+		return req2, nil
+	}
+
+	// responses which depend on the token are not cached
+	if ms.iiifCache == nil || !iiifCacheable(params) {
+		ms.logger.Debugf("Proxy: %s", urlstring)
+		req2, err := newRequest()
+		if err != nil {
+			ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Error creating http request for %s: %s", urlstring, err))
+			return err
+		}
+		rs, err := http.DefaultClient.Do(req2)
+		if err != nil {
+			ms.DoPanic(writer, req, http.StatusBadGateway, fmt.Sprintf("Error calling proxy: %s - %s", urlstring, err))
+			return err
+		}
+		defer rs.Body.Close()
+		if contentType := rs.Header.Get("Content-Type"); contentType != "" {
+			writer.Header().Set("Content-Type", contentType)
+		}
+		writer.WriteHeader(rs.StatusCode)
+		if _, err := io.Copy(writer, rs.Body); err != nil {
+			ms.logger.Errorf("cannot copy result body of iiif server: %v", err)
+			return err
+		}
+		return nil
+	}
+
+	key := iiifCacheKey(iiifPath, params)
+	if filename, item, ok := ms.iiifCache.Get(key); ok {
+		ms.logger.Debugf("iiif cache hit: %s", key)
+		if file, err := os.Open(filename); err == nil {
+			defer file.Close()
+			writer.Header().Set("Content-Type", item.ContentType)
+			http.ServeContent(writer, req, "", item.Created, file)
+			return nil
+		}
+	}
+
+	// concurrent identical requests wait for one call of the iiif server
+	val, err, shared := ms.iiifCache.flight.Do(key, func() (interface{}, error) {
+		ms.logger.Debugf("Proxy: %s", urlstring)
+		req2, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		rs, err := http.DefaultClient.Do(req2)
+		if err != nil {
+			return nil, err
+		}
+		defer rs.Body.Close()
+		body, err := io.ReadAll(rs.Body)
+		if err != nil {
+			return nil, err
+		}
+		resp := &iiifResponse{
+			status:       rs.StatusCode,
+			contentType:  rs.Header.Get("Content-Type"),
+			cacheControl: rs.Header.Get("Cache-Control"),
+			body:         body,
+		}
+		if resp.status == http.StatusOK {
+			if err := ms.iiifCache.Put(key, resp.contentType, resp.body, ms.iiifCache.ttl(resp.cacheControl)); err != nil {
+				ms.logger.Errorf("cannot store %s in iiif cache: %v", key, err)
+			}
+		}
+		return resp, nil
+	})
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusBadGateway, fmt.Sprintf("Error calling proxy: %s - %s", urlstring, err))
+		return err
+	}
+	if shared {
+		ms.logger.Debugf("iiif shared response: %s", key)
+	}
+	resp := val.(*iiifResponse)
+	if resp.contentType != "" {
+		writer.Header().Set("Content-Type", resp.contentType)
+	}
+	if resp.status != http.StatusOK {
+		writer.WriteHeader(resp.status)
+		writer.Write(resp.body)
+		return nil
+	}
+	http.ServeContent(writer, req, "", time.Time{}, bytes.NewReader(resp.body))
+	return nil
+}
+
+// iiif image api for the master. the request is forwarded to the iiif server with the pyramidal tiff of the master
+// or served by the native image api
+type iiifAction struct{}
+
+func (a *iiifAction) Name() string { return "iiif" }
+
+// iiif parameters are positional
+func (a *iiifAction) Params(params []string) ([]string, error) {
+	result := []string{}
+	for _, param := range params {
+		if param != "" {
+			result = append(result, param)
+		}
+	}
+	return result, nil
+}
+
+func (a *iiifAction) CacheKey(params []string) (string, string) { return "master", "" }
+
+func (a *iiifAction) NeedsMaster() bool { return true }
+
+func (a *iiifAction) Produce(ar *ActionRequest) error {
+	ms := ar.Mediaserver
+	if ar.Entry == nil {
+		return ar.Fallback("master")
+	}
+	ms.logger.Debug("Mimetype: " + ar.Entry.mimetype)
+
+	entry, err := ar.ptiffEntry()
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, err.Error())
+	}
+	if entry == nil {
+		// the php mediaserver gets the iiif parameters
+		ptiff := ar.ptiffRequest()
+		ptiff.Params = ar.Params
+		return ptiff.Fallback("convert")
+	}
+
+	fs, err := ms.storages.FS(entry.filebase)
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Cannot access storage %s: %s", entry.filebase, err.Error()))
+	}
+	_, fileName := path.Split(entry.path)
+	fileStat, err := fs.Stat(entry.path)
+	if err != nil {
+		return ar.Error(http.StatusNotFound, fmt.Sprintf("Cannot stat file: %s - %s", fileName, err.Error()))
+	}
+	if fileStat.IsDir() {
+		return ar.Error(http.StatusForbidden, fmt.Sprintf("Access to folder %s denied", fileName))
+	}
+	ms.logger.Debugf("size of %s - %v", storageURI(entry.filebase, entry.path), fileStat.Size())
+
+	iiifPath, token, err := ms.iiifService(entry)
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, err.Error())
+	}
+	if ms.cfg.Mediaserver.IIIF.Native {
+		file, err := fs.Open(entry.path)
+		if err != nil {
+			return ar.Error(http.StatusNotFound, fmt.Sprintf("Cannot open file: %s - %s", fileName, err.Error()))
+		}
+		defer file.Close()
+		return ms.serveIIIF(ar.Writer, ar.Request, file, iiifPath, ar.ParamString, ms.iiifID(ar.Request, token, iiifPath))
+	}
+	return ms.proxyIIIF(ar.Writer, ar.Request, iiifPath, ar.ParamString, singleJoiningSlash(ms.cfg.Mediaserver.IIIF.Alias, token)+"/")
+}
+
+// request for the pyramidal tiff of the master
+func (ar *ActionRequest) ptiffRequest() *ActionRequest {
+	return ar.derivativeRequest("convert", []string{"formatptiff"})
+}
+
+// pyramidal tiff of the master. the tiff is created like any other derivative,
+// concurrent requests wait for one run. nil without error if only the fcgi backend can create it
+func (ar *ActionRequest) ptiffEntry() (*Entry, error) {
+	ms := ar.Mediaserver
+	ptiff := ar.ptiffRequest()
+	entry, err := ms.lookup.Entry(ar.Collection.id, ar.Signature, ptiff.cacheAction, ptiff.cacheParam)
+	if err == nil {
+		return entry, nil
+	}
+	ms.logger.Debug(fmt.Sprintf("could not find in databbase [%s/%s/%s/%s]", ar.Collection.name, ar.Signature, ptiff.cacheAction, ptiff.cacheParam))
+	gen, ok := ms.actions.Get("convert").(Generator)
+	if !ok {
+		return nil, nil
+	}
+	val, err := ptiff.generate(gen)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create %s/%s/convert/formatptiff: %s", ar.Collection.name, ar.Signature, err.Error())
+	}
+	return val.(*Entry), nil
+}
+
+// pyramidal tiff of the master. without generator the tiff is created by the fcgi or http backend,
+// its response is discarded
+func (ar *ActionRequest) ptiffEntryBackend() (*Entry, error) {
+	ms := ar.Mediaserver
+	entry, err := ar.ptiffEntry()
+	if err != nil || entry != nil {
+		return entry, err
+	}
+	ptiff := ar.ptiffRequest()
+	ptiff.Writer = &discardWriter{header: http.Header{}}
+	if _, err := ptiff.generate(nil); err != nil {
+		return nil, fmt.Errorf("Cannot create %s/%s/convert/formatptiff: %s", ar.Collection.name, ar.Signature, err.Error())
+	}
+	ms.lookup.Invalidate(ar.Collection.id, ar.Signature, ptiff.cacheAction, ptiff.cacheParam)
+	if entry, err = ms.lookup.Entry(ar.Collection.id, ar.Signature, ptiff.cacheAction, ptiff.cacheParam); err != nil {
+		return nil, fmt.Errorf("backend did not create %s/%s/convert/formatptiff", ar.Collection.name, ar.Signature)
+	}
+	return entry, nil
+}
+
+// escaped path of a pyramidal tiff for the iiif routes and its access token <storageid>_<jwt>
+func (ms *Mediaserver) iiifService(entry *Entry) (string, string, error) {
+	uri := storageURI(entry.filebase, entry.path)
+	URL, err := url.Parse(uri)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse url %s: %v", uri, err)
+	}
+	iiifPath := strings.Replace(strings.Trim(strings.TrimPrefix(URL.Path, ms.cfg.Mediaserver.IIIF.IIIFBase), "/"), "/", "%24", -1)
+
+	token := "open"
+	if entry.jwtkey.Valid {
+		sub := ms.cfg.SubPrefix + iiifPath
+		if token, err = NewJWT(entry.jwtkey.String, sub, ms.iiifTokenTTL()); err != nil {
+			return "", "", fmt.Errorf("Error creating access token for %s: %s", sub, err)
+		}
+	}
+	return iiifPath, strconv.Itoa(entry.storageid) + "_" + token, nil
+}
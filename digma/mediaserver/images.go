@@ -0,0 +1,393 @@
+package mediaserver
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/je4/mediaserver2/digma/ptiff"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// actions handled by the native image pipeline
+var imageActions = []string{"resize", "convert", "rotate"}
+
+// default limit of the pixels of a master. the decoded master is held in memory
+const maxImagePixels = 50000000
+
+// resize, convert and rotate. missing derivatives are created from the master
+type imageAction struct {
+	name string
+}
+
+func (a *imageAction) Name() string { return a.name }
+
+func (a *imageAction) Params(params []string) ([]string, error) {
+	params, err := imageParamSpecs.Canonical(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseImageParams(a.name, params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (a *imageAction) CacheKey(params []string) (string, string) {
+	return a.name, strings.Join(params, "/")
+}
+
+func (a *imageAction) NeedsMaster() bool { return true }
+
+func (a *imageAction) Produce(ar *ActionRequest) error {
+	return ar.ServeEntry(a)
+}
+
+func (a *imageAction) Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error) {
+	return ms.createImage(coll, signature, a.name, strings.Join(params, "/"))
+}
+
+// parsed image parameters
+type imageParams struct {
+	width      int
+	height     int
+	crop       bool
+	stretch    bool
+	keepAspect bool
+	format     string
+	angle      int
+	quality    int
+}
+
+// output formats: extension and mimetype
+var imageFormats = map[string]struct {
+	ext      string
+	mimetype string
+}{
+	"jpeg":  {"jpg", "image/jpeg"},
+	"png":   {"png", "image/png"},
+	"webp":  {"webp", "image/webp"},
+	"ptiff": {"tif", "image/tiff"},
+}
+
+var imageParamSpecs = ParamSpecs{
+	{Name: "size", Kind: ParamSize, Min: 1},
+	{Name: "width", Kind: ParamInt, Min: 1},
+	{Name: "height", Kind: ParamInt, Min: 1},
+	{Name: "crop", Kind: ParamFlag},
+	{Name: "stretch", Kind: ParamFlag},
+	{Name: "keepaspect", Kind: ParamFlag},
+	{Name: "format", Kind: ParamEnum, Values: []string{"jpeg", "png", "webp", "ptiff"}, Aliases: map[string]string{"jpg": "jpeg"}},
+	{Name: "angle", Kind: ParamInt, Step: 90, Modulus: 360},
+	{Name: "quality", Kind: ParamInt, Min: 1, Max: 100},
+}
+
+// parameters of the image actions of the fcgi backend. the cache table has the spelling
+// of the php mediaserver, formatjpg and formatjpeg are different derivatives there
+var fcgiImageParamSpecs = ParamSpecs{
+	{Name: "size", Kind: ParamSize, Min: 1},
+	{Name: "width", Kind: ParamInt, Min: 1},
+	{Name: "height", Kind: ParamInt, Min: 1},
+	{Name: "crop", Kind: ParamFlag},
+	{Name: "stretch", Kind: ParamFlag},
+	{Name: "keepaspect", Kind: ParamFlag},
+	{Name: "format", Kind: ParamEnum, Values: []string{"jpeg", "jpg", "png", "webp", "ptiff"}},
+	{Name: "angle", Kind: ParamInt, Step: 90, Modulus: 360},
+	{Name: "quality", Kind: ParamInt, Min: 1, Max: 100},
+}
+
+// parse the sorted params of an image action
+// size<w>x<h>, width<w>, height<h>, crop, stretch, keepaspect, format<jpeg|png|webp|ptiff>, angle<90|180|270>, quality<1-100>
+func parseImageParams(action string, params []string) (*imageParams, error) {
+	ip := &imageParams{}
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		var err error
+		switch {
+		case param == "crop":
+			ip.crop = true
+		case param == "stretch":
+			ip.stretch = true
+		case param == "keepaspect":
+			ip.keepAspect = true
+		case strings.HasPrefix(param, "size"):
+			wh := strings.SplitN(strings.TrimPrefix(param, "size"), "x", 2)
+			if len(wh) != 2 {
+				return nil, &ParamError{param, "expected size<width>x<height>"}
+			}
+			if ip.width, err = strconv.Atoi(wh[0]); err != nil || ip.width <= 0 {
+				return nil, &ParamError{param, "invalid width"}
+			}
+			if ip.height, err = strconv.Atoi(wh[1]); err != nil || ip.height <= 0 {
+				return nil, &ParamError{param, "invalid height"}
+			}
+		case strings.HasPrefix(param, "width"):
+			if ip.width, err = strconv.Atoi(strings.TrimPrefix(param, "width")); err != nil || ip.width <= 0 {
+				return nil, &ParamError{param, "invalid width"}
+			}
+		case strings.HasPrefix(param, "height"):
+			if ip.height, err = strconv.Atoi(strings.TrimPrefix(param, "height")); err != nil || ip.height <= 0 {
+				return nil, &ParamError{param, "invalid height"}
+			}
+		case strings.HasPrefix(param, "format"):
+			ip.format = strings.TrimPrefix(param, "format")
+			if ip.format == "jpg" {
+				ip.format = "jpeg"
+			}
+			if _, ok := imageFormats[ip.format]; !ok {
+				return nil, &ParamError{param, "unsupported format"}
+			}
+		case strings.HasPrefix(param, "angle"):
+			if ip.angle, err = strconv.Atoi(strings.TrimPrefix(param, "angle")); err != nil || ip.angle%90 != 0 {
+				return nil, &ParamError{param, "angle must be a multiple of 90"}
+			}
+			ip.angle = (ip.angle%360 + 360) % 360
+		case strings.HasPrefix(param, "quality"):
+			if ip.quality, err = strconv.Atoi(strings.TrimPrefix(param, "quality")); err != nil || ip.quality < 1 || ip.quality > 100 {
+				return nil, &ParamError{param, "quality must be between 1 and 100"}
+			}
+		default:
+			return nil, &ParamError{param, "unknown parameter"}
+		}
+	}
+	switch action {
+	case "resize":
+		if ip.width == 0 && ip.height == 0 {
+			return nil, &ParamError{"size", "resize needs size, width or height"}
+		}
+		if (ip.crop || ip.stretch) && (ip.width == 0 || ip.height == 0) {
+			return nil, &ParamError{"size", "crop and stretch need width and height"}
+		}
+		// the aspect ratio is kept by default, keepaspect excludes the other modes
+		if ip.keepAspect && (ip.crop || ip.stretch) {
+			return nil, &ParamError{"keepaspect", "keepaspect cannot be combined with crop or stretch"}
+		}
+	case "convert":
+		if ip.format == "" {
+			return nil, &ParamError{"format", "convert needs a format"}
+		}
+	case "rotate":
+		if ip.angle == 0 {
+			return nil, &ParamError{"angle", "rotate needs an angle"}
+		}
+	}
+	return ip, nil
+}
+
+// create an image derivative from the master, store it and return the new cache entry
+// paramstring: sorted params joined by slash
+func (ms *Mediaserver) createImage(coll Collection, signature string, action string, paramstring string) (*Entry, error) {
+	ip, err := parseImageParams(action, strings.Split(paramstring, "/"))
+	if err != nil {
+		return nil, err
+	}
+	master, _, err := ms.OpenMaster(coll, signature)
+	if err != nil {
+		return nil, err
+	}
+	defer master.Close()
+
+	cfg, format, err := image.DecodeConfig(master)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image header of %s/%s: %v", coll.name, signature, err)
+	}
+	maxPixels := ms.cfg.Mediaserver.Images.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = maxImagePixels
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return nil, fmt.Errorf("master of %s/%s too large: %vx%v", coll.name, signature, cfg.Width, cfg.Height)
+	}
+	orientation := 1
+	if stat, err := master.Stat(); err == nil {
+		orientation = exifOrientation(master, stat.Size())
+	}
+	if _, err := master.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// the decoded masters of concurrent requests must fit into memory
+	ms.imageSlots <- struct{}{}
+	defer func() { <-ms.imageSlots }()
+	img, _, err := image.Decode(master)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode master of %s/%s: %v", coll.name, signature, err)
+	}
+	img = orientImage(img, orientation)
+
+	// without format the format of the master is kept if possible
+	if ip.format == "" {
+		ip.format = "jpeg"
+		if _, ok := imageFormats[format]; ok && format != "ptiff" {
+			ip.format = format
+		}
+	}
+	if ip.quality == 0 {
+		ip.quality = ms.cfg.Mediaserver.Images.Quality
+	}
+	if ip.quality == 0 {
+		ip.quality = 85
+	}
+
+	if ip.width > 0 || ip.height > 0 {
+		img = resizeImage(img, ip)
+	}
+	if ip.angle != 0 {
+		img = rotateImage(img, ip.angle)
+	}
+
+	f := imageFormats[ip.format]
+	tmp, err := ms.TempFile(f.ext)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	err = encodeImage(tmp, img, ip)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode %s/%s/%s as %s: %v", coll.name, signature, action, ip.format, err)
+	}
+	return ms.StoreDerivative(coll, signature, action, paramstring, f.mimetype, f.ext, tmp.Name())
+}
+
+// exif orientation of a jpeg or tiff master. 1 if there is none
+func exifOrientation(r io.ReaderAt, size int64) int {
+	exif, _, _ := readEmbeddedMetadata(r, size)
+	switch o := exif["Orientation"].(type) {
+	case uint16:
+		return int(o)
+	case uint32:
+		return int(o)
+	}
+	return 1
+}
+
+// turn the image upright according to the exif orientation
+func orientImage(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return mirrorImage(img)
+	case 3:
+		return rotateImage(img, 180)
+	case 4:
+		return rotateImage(mirrorImage(img), 180)
+	case 5:
+		return rotateImage(mirrorImage(img), 270)
+	case 6:
+		return rotateImage(img, 90)
+	case 7:
+		return rotateImage(mirrorImage(img), 90)
+	case 8:
+		return rotateImage(img, 270)
+	}
+	return img
+}
+
+// scale the image. images are not enlarged except with stretch
+func resizeImage(img image.Image, ip *imageParams) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := b
+	var tw, th int
+	switch {
+	case ip.stretch:
+		tw, th = ip.width, ip.height
+	case ip.crop:
+		// fill the box and cut the center
+		scale := max(float64(ip.width)/float64(w), float64(ip.height)/float64(h))
+		if scale > 1 {
+			scale = 1
+		}
+		tw, th = min(ip.width, w), min(ip.height, h)
+		cw, ch := int(float64(tw)/scale+0.5), int(float64(th)/scale+0.5)
+		cw, ch = min(cw, w), min(ch, h)
+		x0 := b.Min.X + (w-cw)/2
+		y0 := b.Min.Y + (h-ch)/2
+		src = image.Rect(x0, y0, x0+cw, y0+ch)
+	default:
+		scale := 1.0
+		if ip.width > 0 {
+			scale = min(scale, float64(ip.width)/float64(w))
+		}
+		if ip.height > 0 {
+			scale = min(scale, float64(ip.height)/float64(h))
+		}
+		tw, th = max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+	}
+	if tw == w && th == h && src == b {
+		return img
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
+
+// rotate clockwise by 90, 180 or 270 degrees
+func rotateImage(img image.Image, angle int) image.Image {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	var dst *image.NRGBA
+	if angle == 180 {
+		dst = image.NewNRGBA(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch angle {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			default:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// formats without alpha channel get a white background
+func flattenImage(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+func encodeImage(w io.WriteSeeker, img image.Image, ip *imageParams) error {
+	switch ip.format {
+	case "png":
+		return png.Encode(w, img)
+	case "webp":
+		return nativewebp.Encode(w, img, nil)
+	case "ptiff":
+		if _, ok := img.(*image.Gray); !ok {
+			img = flattenImage(img)
+		}
+		return ptiff.Encode(w, img, &ptiff.Options{Quality: ip.quality})
+	default:
+		if _, ok := img.(*image.Gray); !ok {
+			img = flattenImage(img)
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: ip.quality})
+	}
+}
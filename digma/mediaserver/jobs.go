@@ -0,0 +1,368 @@
+package mediaserver
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// state of an asynchronous creation of a derivative
+type Job struct {
+	// random public id. the numeric id is not exposed because anybody could query the jobs
+	Id         string  `json:"id"`
+	Collection string  `json:"collection"`
+	Signature  string  `json:"signature"`
+	Action     string  `json:"action"`
+	Param      string  `json:"param"`
+	Status     string  `json:"status"`
+	Progress   float64 `json:"progress"`
+	Message    string  `json:"message,omitempty"`
+	Created    int64   `json:"created"`
+	Updated    int64   `json:"updated"`
+	// location of the derivative if the job is done
+	URL string `json:"url,omitempty"`
+
+	jobid        int64
+	collectionId int
+	// access token of the request which queued the job
+	token string
+}
+
+const (
+	// default time finished jobs are kept
+	jobRetention     = 7 * 24 * time.Hour
+	jobPurgeInterval = time.Hour
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// job queue in table job. every instance runs its own workers
+type Jobs struct {
+	ms     *Mediaserver
+	db     *sql.DB
+	cfg    jobs
+	worker string
+	wakeup chan struct{}
+}
+
+func NewJobs(ms *Mediaserver, cfg jobs) *Jobs {
+	hostname, _ := os.Hostname()
+	return &Jobs{
+		ms:     ms,
+		db:     ms.db,
+		cfg:    cfg,
+		worker: hostname,
+		wakeup: make(chan struct{}, 1),
+	}
+}
+
+// create a job for a derivative. an unfinished job for the same derivative is reused.
+// token is the access token of the request, the workers need it for the backends
+func (js *Jobs) Enqueue(collectionId int, signature string, action string, param string, token string) (*Job, error) {
+	var id int64
+	err := js.db.QueryRow("SELECT jobid FROM job WHERE collection_id=? AND signature=? AND action=? AND param=? AND status IN (?, ?) ORDER BY jobid LIMIT 1",
+		collectionId, signature, action, param, jobQueued, jobRunning).Scan(&id)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		ticket := make([]byte, 16)
+		if _, err := rand.Read(ticket); err != nil {
+			return nil, fmt.Errorf("cannot create job id: %v", err)
+		}
+		res, err := js.db.Exec("INSERT INTO job (ticket, collection_id, signature, action, param, token, status) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			hex.EncodeToString(ticket), collectionId, signature, action, param, token, jobQueued)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create job: %v", err)
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return nil, fmt.Errorf("cannot get id of new job: %v", err)
+		}
+		select {
+		case js.wakeup <- struct{}{}:
+		default:
+		}
+	default:
+		return nil, fmt.Errorf("cannot query jobs: %v", err)
+	}
+	return js.Get(id)
+}
+
+// load a job. returns sql.ErrNoRows for unknown ids
+func (js *Jobs) Get(id int64) (*Job, error) {
+	return js.load("jobid=?", id)
+}
+
+// load a job by its public id. returns sql.ErrNoRows for unknown ids
+func (js *Jobs) ByTicket(ticket string) (*Job, error) {
+	return js.load("ticket=?", ticket)
+}
+
+func (js *Jobs) load(where string, arg interface{}) (*Job, error) {
+	job := &Job{}
+	var message, token sql.NullString
+	row := js.db.QueryRow("SELECT jobid, ticket, collection_id, signature, action, param, token, status, progress, message, UNIX_TIMESTAMP(created), UNIX_TIMESTAMP(updated) FROM job WHERE "+where, arg)
+	if err := row.Scan(&job.jobid, &job.Id, &job.collectionId, &job.Signature, &job.Action, &job.Param, &token, &job.Status, &job.Progress, &message, &job.Created, &job.Updated); err != nil {
+		return nil, err
+	}
+	job.Message = message.String
+	job.token = token.String
+	if coll, err := js.ms.collections.ById(job.collectionId); err == nil {
+		job.Collection = coll.name
+	}
+	if job.Status == jobDone {
+		job.URL = strings.TrimRight(js.ms.cfg.Mediaserver.Alias, "/") + "/" + job.Collection + "/" + job.Signature + "/" + job.Action
+		if job.Param != "" {
+			job.URL += "/" + job.Param
+		}
+	}
+	return job, nil
+}
+
+// start the job workers if jobs are enabled
+func (ms *Mediaserver) StartJobs() {
+	if ms.jobs != nil {
+		ms.jobs.Start()
+	}
+}
+
+// start the workers. jobs which were running on this host before a restart are queued again
+func (js *Jobs) Start() {
+	if _, err := js.db.Exec("UPDATE job SET status=?, progress=0 WHERE status=? AND worker=?", jobQueued, jobRunning, js.worker); err != nil {
+		js.ms.logger.Errorf("cannot requeue jobs of %s: %v", js.worker, err)
+	}
+	workers := js.cfg.Workers
+	if workers <= 0 {
+		workers = 2
+	}
+	for i := 0; i < workers; i++ {
+		go js.work()
+	}
+	go js.purge()
+}
+
+// remove finished jobs after the retention time
+func (js *Jobs) purge() {
+	retention := js.cfg.Retention
+	if retention <= 0 {
+		retention = jobRetention
+	}
+	ticker := time.NewTicker(jobPurgeInterval)
+	defer ticker.Stop()
+	for {
+		res, err := js.db.Exec("DELETE FROM job WHERE status IN (?, ?) AND updated < NOW() - INTERVAL ? SECOND",
+			jobDone, jobFailed, int64(retention/time.Second))
+		if err != nil {
+			js.ms.logger.Errorf("cannot remove finished jobs: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			js.ms.logger.Infof("removed %d finished jobs", n)
+		}
+		<-ticker.C
+	}
+}
+
+func (js *Jobs) work() {
+	poll := js.cfg.Poll
+	if poll <= 0 {
+		poll = 10 * time.Second
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		job, err := js.claim()
+		if err != nil {
+			js.ms.logger.Errorf("cannot get next job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-js.wakeup:
+			case <-ticker.C:
+			}
+			continue
+		}
+		js.safeRun(job)
+	}
+}
+
+// run a job. a panic fails the job instead of stopping the worker
+func (js *Jobs) safeRun(job *Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			js.finish(job.jobid, fmt.Errorf("panic: %v", r))
+		}
+	}()
+	js.run(job)
+}
+
+// take the oldest queued job. other workers and instances may be faster
+func (js *Jobs) claim() (*Job, error) {
+	for {
+		var id int64
+		err := js.db.QueryRow("SELECT jobid FROM job WHERE status=? ORDER BY jobid LIMIT 1", jobQueued).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		res, err := js.db.Exec("UPDATE job SET status=?, worker=? WHERE jobid=? AND status=?", jobRunning, js.worker, id, jobQueued)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return js.Get(id)
+		}
+	}
+}
+
+func (js *Jobs) setProgress(id int64, progress float64) {
+	if _, err := js.db.Exec("UPDATE job SET progress=? WHERE jobid=?", progress, id); err != nil {
+		js.ms.logger.Errorf("cannot update progress of job #%d: %v", id, err)
+	}
+}
+
+func (js *Jobs) finish(id int64, err error) {
+	status, progress, message := jobDone, 1.0, ""
+	if err != nil {
+		status, progress, message = jobFailed, 0, err.Error()
+		js.ms.logger.Errorf("job #%d failed: %v", id, err)
+	}
+	// the access token is not needed anymore
+	if _, err := js.db.Exec("UPDATE job SET status=?, progress=?, message=?, token=NULL WHERE jobid=?", status, progress, message, id); err != nil {
+		js.ms.logger.Errorf("cannot finish job #%d: %v", id, err)
+	}
+}
+
+// create the derivative of a job like a request without client
+func (js *Jobs) run(job *Job) {
+	ms := js.ms
+	ms.logger.Infof("job #%d: %s/%s/%s/%s", job.jobid, job.Collection, job.Signature, job.Action, job.Param)
+	coll, err := ms.collections.ById(job.collectionId)
+	if err != nil {
+		js.finish(job.jobid, err)
+		return
+	}
+	a := ms.actions.Get(job.Action)
+	params, err := a.Params(strings.Split(job.Param, "/"))
+	if err != nil {
+		js.finish(job.jobid, err)
+		return
+	}
+	uri := strings.TrimRight(ms.cfg.Mediaserver.Alias, "/") + "/" + coll.name + "/" + job.Signature + "/" + job.Action + "/" + job.Param
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		js.finish(job.jobid, err)
+		return
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	req.RequestURI = uri
+	ar := &ActionRequest{
+		Mediaserver: ms,
+		Writer:      &discardWriter{header: http.Header{}},
+		Request:     req,
+		Collection:  coll,
+		Signature:   job.Signature,
+		Action:      job.Action,
+		Params:      params,
+		ParamString: strings.Join(params, "/"),
+		Token:       job.token,
+		progress:    func(progress float64) { js.setProgress(job.jobid, progress) },
+	}
+	ar.cacheAction, ar.cacheParam = a.CacheKey(params)
+	gen, _ := a.(Generator)
+	val, err := ar.generate(gen)
+	if err != nil {
+		js.finish(job.jobid, err)
+		return
+	}
+	// the php mediaserver and the http backend register the derivative themselves
+	switch val.(type) {
+	case *streamedResponse:
+		ms.lookup.Invalidate(coll.id, job.Signature, ar.cacheAction, ar.cacheParam)
+		if _, err := ms.lookup.Entry(coll.id, job.Signature, ar.cacheAction, ar.cacheParam); err != nil {
+			js.finish(job.jobid, fmt.Errorf("backend did not create %s/%s/%s/%s", coll.name, job.Signature, ar.cacheAction, ar.cacheParam))
+			return
+		}
+	}
+	js.finish(job.jobid, nil)
+}
+
+// requests are processed asynchronously for configured actions or with the header Prefer: respond-async.
+// actions without checked parameters are never queued, every spelling would create a job
+func (ar *ActionRequest) async() bool {
+	ms := ar.Mediaserver
+	if ms.jobs == nil {
+		return false
+	}
+	if a, ok := ms.actions.Get(ar.Action).(*cachedAction); ok && a.specs == nil {
+		return false
+	}
+	for _, action := range ms.cfg.Mediaserver.Jobs.Actions {
+		if strings.EqualFold(action, ar.cacheAction) {
+			return true
+		}
+	}
+	for _, prefer := range ar.Request.Header.Values("Prefer") {
+		for _, p := range strings.Split(prefer, ",") {
+			if strings.TrimSpace(strings.ToLower(p)) == "respond-async" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queue the missing derivative of the request and answer with 202 Accepted
+func (ar *ActionRequest) enqueue() error {
+	ms := ar.Mediaserver
+	job, err := ms.jobs.Enqueue(ar.Collection.id, ar.Signature, ar.cacheAction, ar.cacheParam, ar.Token)
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, err.Error())
+	}
+	ar.Writer.Header().Set("Location", strings.TrimRight(ms.cfg.Mediaserver.Jobs.Alias, "/")+"/"+job.Id)
+	ar.Writer.Header().Set("Content-Type", "application/json")
+	ar.Writer.Header().Set("Cache-Control", "no-store")
+	ar.Writer.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(ar.Writer).Encode(job)
+}
+
+// json status of a job. only the clients which know the random id of the job get its status
+func (ms *Mediaserver) HandlerJob(writer http.ResponseWriter, req *http.Request, id string) (err error) {
+	if ms.jobs == nil {
+		ms.DoPanic(writer, req, http.StatusNotFound, "jobs are not enabled")
+		return fmt.Errorf("jobs are not enabled")
+	}
+	job, err := ms.jobs.ByTicket(id)
+	if err == sql.ErrNoRows {
+		ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("job %s not found", id))
+		return err
+	}
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("cannot load job %s: %v", id, err))
+		return err
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(writer).Encode(job)
+}
+
+// response writer of jobs. the output of the backends is not needed
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header { return w.header }
+
+func (w *discardWriter) Write(data []byte) (int, error) { return len(data), nil }
+
+func (w *discardWriter) WriteHeader(status int) {}
@@ -0,0 +1,115 @@
+package mediaserver
+
+import (
+	"database/sql"
+)
+
+// Entry is a row of fullcache
+type Entry struct {
+	filebase  string
+	path      string
+	mimetype  string
+	jwtkey    sql.NullString
+	storageid int
+	private   int
+}
+
+// location of the file on its storage
+func (e *Entry) Path() string     { return e.path }
+func (e *Entry) Filebase() string { return e.filebase }
+func (e *Entry) Mimetype() string { return e.mimetype }
+
+type cacheKey struct {
+	collectionId int
+	signature    string
+	action       string
+	param        string
+}
+
+// access data of a master
+type masterEntry struct {
+	jwtkey  sql.NullString
+	private int
+}
+
+type masterKey struct {
+	collectionId int
+	signature    string
+}
+
+// database lookups with in-memory cache
+// unknown signatures are cached as nil entries (negative cache)
+type Lookup struct {
+	db      *sql.DB
+	cfg     lookupcache
+	entries *lruCache[cacheKey, *Entry]
+	masters *lruCache[masterKey, *masterEntry]
+}
+
+func NewLookup(db *sql.DB, cfg lookupcache) *Lookup {
+	return &Lookup{
+		db:      db,
+		cfg:     cfg,
+		entries: newLRUCache[cacheKey, *Entry](cfg.Size),
+		masters: newLRUCache[masterKey, *masterEntry](cfg.Size),
+	}
+}
+
+// get fullcache entry. returns sql.ErrNoRows if there is none
+func (l *Lookup) Entry(collectionId int, signature string, action string, param string) (*Entry, error) {
+	key := cacheKey{collectionId: collectionId, signature: signature, action: action, param: param}
+	if entry, ok := l.entries.Get(key); ok {
+		return entry, nil
+	}
+	entry := &Entry{}
+	row := l.db.QueryRow("select filebase, path, mimetype, jwtkey, storageid, private FROM fullcache WHERE collection_id=? AND signature=? and action=? AND param=?", collectionId, signature, action, param)
+	if err := row.Scan(&entry.filebase, &entry.path, &entry.mimetype, &entry.jwtkey, &entry.storageid, &entry.private); err != nil {
+		return nil, err
+	}
+	l.entries.Set(key, entry, l.cfg.TTL)
+	return entry, nil
+}
+
+// get access data of a master. returns sql.ErrNoRows for unknown signatures
+func (l *Lookup) Master(collectionId int, signature string) (*masterEntry, error) {
+	key := masterKey{collectionId: collectionId, signature: signature}
+	if master, ok := l.masters.Get(key); ok {
+		if master == nil {
+			return nil, sql.ErrNoRows
+		}
+		return master, nil
+	}
+	master := &masterEntry{}
+	sqlstr := "select jwtkey, `m`.`public` = 0 or `c`.`public` = 0 AS `private` " +
+		" FROM master m, collection c, storage s " +
+		" WHERE m.collectionid=? AND m.signature=? AND m.collectionid=c.collectionid AND s.storageid=c.storageid"
+	row := l.db.QueryRow(sqlstr, collectionId, signature)
+	if err := row.Scan(&master.jwtkey, &master.private); err != nil {
+		if err == sql.ErrNoRows {
+			l.masters.Set(key, nil, l.cfg.NegativeTTL)
+		}
+		return nil, err
+	}
+	l.masters.Set(key, master, l.cfg.TTL)
+	return master, nil
+}
+
+// remove cached data of a signature, e.g. after a new derivative has been created
+func (l *Lookup) Invalidate(collectionId int, signature string, action string, param string) {
+	l.entries.Remove(cacheKey{collectionId: collectionId, signature: signature, action: action, param: param})
+	l.masters.Remove(masterKey{collectionId: collectionId, signature: signature})
+}
+
+// remove all cached data
+func (l *Lookup) Purge() {
+	l.entries.Purge()
+	l.masters.Purge()
+}
+
+// cache statistics
+func (l *Lookup) Stats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"fullcache": l.entries.Stats(),
+		"master":    l.masters.Stats(),
+	}
+}
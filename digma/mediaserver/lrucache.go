@@ -0,0 +1,111 @@
+package mediaserver
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// size bounded cache with least recently used eviction and expiry per entry
+type lruCache[K comparable, V any] struct {
+	size   int
+	items  map[K]*list.Element
+	order  *list.List
+	m      sync.Mutex
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type lruItem[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// statistics of a cache
+type CacheStats struct {
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Entries  int   `json:"entries"`
+	Size     int   `json:"size,omitempty"`
+	Bytes    int64 `json:"bytes,omitempty"`
+	MaxBytes int64 `json:"maxbytes,omitempty"`
+}
+
+// create cache with at most size entries. size 0 disables the cache
+func newLRUCache[K comparable, V any](size int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		size:  size,
+		items: make(map[K]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (c *lruCache[K, V]) Get(key K) (value V, ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return value, false
+	}
+	item := elem.Value.(*lruItem[K, V])
+	if time.Now().After(item.expires) {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		c.misses.Add(1)
+		return value, false
+	}
+	c.order.MoveToFront(elem)
+	c.hits.Add(1)
+	return item.value, true
+}
+
+func (c *lruCache[K, V]) Set(key K, value V, ttl time.Duration) {
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if elem, ok := c.items[key]; ok {
+		item := elem.Value.(*lruItem[K, V])
+		item.value = value
+		item.expires = time.Now().Add(ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruItem[K, V]).key)
+	}
+	c.items[key] = c.order.PushFront(&lruItem[K, V]{key: key, value: value, expires: time.Now().Add(ttl)})
+}
+
+func (c *lruCache[K, V]) Remove(key K) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+func (c *lruCache[K, V]) Purge() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.items = make(map[K]*list.Element)
+	c.order.Init()
+}
+
+func (c *lruCache[K, V]) Stats() CacheStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: c.order.Len(),
+		Size:    c.size,
+	}
+}
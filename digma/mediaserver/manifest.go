@@ -0,0 +1,377 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/je4/mediaserver2/digma/ptiff"
+)
+
+// iiif presentation api 3.0 manifests of the masters
+
+const iiifPresentationContext = "http://iiif.io/api/presentation/3/context.json"
+
+// resolution of the page images of pdf canvases
+const manifestPageDPI = 150
+
+// language map, e.g. {"en": ["label"]}. "none" for values without language
+type iiifLangMap map[string][]string
+
+type manifestMetadata struct {
+	Label iiifLangMap `json:"label"`
+	Value iiifLangMap `json:"value"`
+}
+
+// content resource or service
+type manifestResource struct {
+	ID       string              `json:"id"`
+	Type     string              `json:"type"`
+	Label    iiifLangMap         `json:"label,omitempty"`
+	Format   string              `json:"format,omitempty"`
+	Profile  string              `json:"profile,omitempty"`
+	Width    int                 `json:"width,omitempty"`
+	Height   int                 `json:"height,omitempty"`
+	Duration float64             `json:"duration,omitempty"`
+	Service  []*manifestResource `json:"service,omitempty"`
+}
+
+type manifestAnnotation struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Motivation string            `json:"motivation"`
+	Body       *manifestResource `json:"body"`
+	Target     string            `json:"target"`
+}
+
+type manifestAnnotationPage struct {
+	ID    string                `json:"id"`
+	Type  string                `json:"type"`
+	Items []*manifestAnnotation `json:"items"`
+}
+
+type manifestCanvas struct {
+	ID       string                    `json:"id"`
+	Type     string                    `json:"type"`
+	Label    iiifLangMap               `json:"label,omitempty"`
+	Width    int                       `json:"width,omitempty"`
+	Height   int                       `json:"height,omitempty"`
+	Duration float64                   `json:"duration,omitempty"`
+	Items    []*manifestAnnotationPage `json:"items,omitempty"`
+}
+
+type iiifManifest struct {
+	Context   string              `json:"@context"`
+	ID        string              `json:"id"`
+	Type      string              `json:"type"`
+	Label     iiifLangMap         `json:"label"`
+	Summary   iiifLangMap         `json:"summary,omitempty"`
+	Metadata  []manifestMetadata  `json:"metadata,omitempty"`
+	Rights    string              `json:"rights,omitempty"`
+	Rendering []*manifestResource `json:"rendering,omitempty"`
+	Items     []*manifestCanvas   `json:"items"`
+}
+
+// paint body on the canvas
+func (c *manifestCanvas) paint(body *manifestResource) {
+	c.Items = []*manifestAnnotationPage{{
+		ID:   c.ID + "/page",
+		Type: "AnnotationPage",
+		Items: []*manifestAnnotation{{
+			ID:         c.ID + "/annotation",
+			Type:       "Annotation",
+			Motivation: "painting",
+			Body:       body,
+			Target:     c.ID,
+		}},
+	}}
+}
+
+// labels and descriptive metadata of a master
+type masterDescription struct {
+	label    iiifLangMap
+	summary  iiifLangMap
+	rights   string
+	metadata []manifestMetadata
+}
+
+// description of a master from the table iiifmetadata. the fields label, summary and rights
+// are properties of the manifest, all other fields are listed as metadata
+func (ms *Mediaserver) masterDescription(coll Collection, signature string) (*masterDescription, error) {
+	rows, err := ms.db.Query("SELECT field, language, value FROM iiifmetadata WHERE collection_id=? AND signature=? ORDER BY sort, field", coll.id, signature)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query iiifmetadata of %s/%s: %v", coll.name, signature, err)
+	}
+	defer rows.Close()
+	desc := &masterDescription{}
+	fields := map[string]int{}
+	for rows.Next() {
+		var field, language, value string
+		if err := rows.Scan(&field, &language, &value); err != nil {
+			return nil, fmt.Errorf("cannot scan iiifmetadata of %s/%s: %v", coll.name, signature, err)
+		}
+		if language == "" {
+			language = "none"
+		}
+		switch field {
+		case "label":
+			if desc.label == nil {
+				desc.label = iiifLangMap{}
+			}
+			desc.label[language] = append(desc.label[language], value)
+		case "summary":
+			if desc.summary == nil {
+				desc.summary = iiifLangMap{}
+			}
+			desc.summary[language] = append(desc.summary[language], value)
+		case "rights":
+			desc.rights = value
+		default:
+			i, ok := fields[field]
+			if !ok {
+				i = len(desc.metadata)
+				fields[field] = i
+				desc.metadata = append(desc.metadata, manifestMetadata{Label: iiifLangMap{"none": {field}}, Value: iiifLangMap{}})
+			}
+			desc.metadata[i].Value[language] = append(desc.metadata[i].Value[language], value)
+		}
+	}
+	return desc, rows.Err()
+}
+
+// public url of an action of the master. private masters get an access token for the url
+func (ar *ActionRequest) actionURL(action string, params ...string) (string, error) {
+	ms := ar.Mediaserver
+	paramString := strings.Join(params, "/")
+	target := ms.publicURL(ar.Request) + strings.TrimRight(ms.cfg.Mediaserver.Alias, "/") + "/" + ar.Collection.name + "/" + url.PathEscape(ar.Signature) + "/" + action
+	if paramString != "" {
+		target += "/" + paramString
+	}
+	if entry := ar.Entry; entry != nil && entry.private == 1 && entry.jwtkey.Valid {
+		sub := strings.ToLower(strings.TrimRight(ms.cfg.SubPrefix+ar.Collection.name+"/"+ar.Signature+"/"+action+"/"+paramString, "/"))
+		token, err := NewJWT(entry.jwtkey.String, sub, ms.iiifTokenTTL())
+		if err != nil {
+			return "", fmt.Errorf("Error creating access token for %s: %s", sub, err)
+		}
+		target += "?token=" + url.QueryEscape(token)
+	}
+	return target, nil
+}
+
+// technical metadata of the master. the metadata derivative is created if it is missing,
+// concurrent requests wait for one run
+func (ar *ActionRequest) masterMetadata() (*Metadata, error) {
+	ms := ar.Mediaserver
+	meta := ar.derivativeRequest("metadata", nil)
+	entry, err := ms.lookup.Entry(ar.Collection.id, ar.Signature, meta.cacheAction, meta.cacheParam)
+	if err != nil {
+		val, err := meta.generate(&metadataAction{})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create %s/%s/metadata: %s", ar.Collection.name, ar.Signature, err.Error())
+		}
+		entry = val.(*Entry)
+	}
+	fs, err := ms.storages.FS(entry.filebase)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot access storage %s: %s", entry.filebase, err.Error())
+	}
+	file, err := fs.Open(entry.path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open metadata of %s/%s: %s", ar.Collection.name, ar.Signature, err.Error())
+	}
+	defer file.Close()
+	md := &Metadata{}
+	if err := json.NewDecoder(file).Decode(md); err != nil {
+		return nil, fmt.Errorf("Invalid metadata of %s/%s: %s", ar.Collection.name, ar.Signature, err.Error())
+	}
+	return md, nil
+}
+
+// canvas with the image service of the pyramidal tiff. the service path contains the access token,
+// iiif clients don't pass on tokens in the query
+func (ar *ActionRequest) imageCanvas(id string) (*manifestCanvas, error) {
+	ms := ar.Mediaserver
+	canvas := &manifestCanvas{ID: id, Type: "Canvas"}
+	entry, err := ar.ptiffEntryBackend()
+	if err != nil {
+		return nil, err
+	}
+	iiifPath, token, err := ms.iiifService(entry)
+	if err != nil {
+		return nil, err
+	}
+	service := ms.iiifID(ar.Request, token, iiifPath)
+	// the size of the image service
+	if fs, err := ms.storages.FS(entry.filebase); err == nil {
+		if file, err := fs.Open(entry.path); err == nil {
+			if tr, err := ptiff.NewReader(file); err == nil {
+				canvas.Width, canvas.Height = tr.Levels()[0].Width, tr.Levels()[0].Height
+			}
+			file.Close()
+		}
+	}
+	if canvas.Width == 0 {
+		md, err := ar.masterMetadata()
+		if err != nil {
+			return nil, err
+		}
+		if md.Width == 0 || md.Height == 0 {
+			return nil, fmt.Errorf("unknown size of %s/%s", ar.Collection.name, ar.Signature)
+		}
+		canvas.Width, canvas.Height = md.Width, md.Height
+	}
+	canvas.paint(&manifestResource{
+		ID:      service + "/full/max/0/default.jpg",
+		Type:    "Image",
+		Format:  "image/jpeg",
+		Width:   canvas.Width,
+		Height:  canvas.Height,
+		Service: []*manifestResource{{ID: service, Type: "ImageService3", Profile: "level2"}},
+	})
+	return canvas, nil
+}
+
+// canvas with the duration of a video or audio master
+func (ar *ActionRequest) avCanvas(id string, typ string) (*manifestCanvas, error) {
+	md, err := ar.masterMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if md.Duration <= 0 {
+		return nil, fmt.Errorf("unknown duration of %s/%s", ar.Collection.name, ar.Signature)
+	}
+	canvas := &manifestCanvas{ID: id, Type: "Canvas", Duration: md.Duration}
+	if typ == "Video" {
+		canvas.Width, canvas.Height = md.Width, md.Height
+	}
+	master, err := ar.actionURL("master")
+	if err != nil {
+		return nil, err
+	}
+	canvas.paint(&manifestResource{
+		ID:       master,
+		Type:     typ,
+		Format:   md.Mimetype,
+		Width:    canvas.Width,
+		Height:   canvas.Height,
+		Duration: md.Duration,
+	})
+	return canvas, nil
+}
+
+// one canvas per page of a pdf master with the image of the page action
+func (ar *ActionRequest) pdfCanvases(base string) ([]*manifestCanvas, error) {
+	md, err := ar.masterMetadata()
+	if err != nil {
+		return nil, err
+	}
+	_, pages := ar.Mediaserver.actions.actions["page"]
+	canvases := []*manifestCanvas{}
+	for page := 1; page <= md.Pages; page++ {
+		// metadata of older versions has the size of the first page only
+		size := MetadataPage{float64(md.Width), float64(md.Height)}
+		if page <= len(md.PageSizes) {
+			size = md.PageSizes[page-1]
+		}
+		canvas := &manifestCanvas{
+			ID:     fmt.Sprintf("%s/p%d", base, page),
+			Type:   "Canvas",
+			Label:  iiifLangMap{"none": {strconv.Itoa(page)}},
+			Width:  max(int(math.Round(size.Width*manifestPageDPI/72)), 1),
+			Height: max(int(math.Round(size.Height*manifestPageDPI/72)), 1),
+		}
+		if pages {
+			image, err := ar.actionURL("page", fmt.Sprintf("page%d", page))
+			if err != nil {
+				return nil, err
+			}
+			canvas.paint(&manifestResource{ID: image, Type: "Image", Format: "image/jpeg", Width: canvas.Width, Height: canvas.Height})
+		}
+		canvases = append(canvases, canvas)
+	}
+	return canvases, nil
+}
+
+// iiif manifest of the master
+type manifestAction struct{}
+
+func (a *manifestAction) Name() string { return "manifest" }
+
+// manifest has no parameters
+func (a *manifestAction) Params(params []string) ([]string, error) {
+	return ParamSpecs{}.Canonical(params)
+}
+
+// the manifest contains access tokens and is not stored
+func (a *manifestAction) CacheKey(params []string) (string, string) { return "master", "" }
+
+func (a *manifestAction) NeedsMaster() bool { return true }
+
+func (a *manifestAction) Produce(ar *ActionRequest) error {
+	ms := ar.Mediaserver
+	if ar.Entry == nil {
+		return ar.Fallback("manifest")
+	}
+	id, err := ar.actionURL("manifest")
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, err.Error())
+	}
+	// the id is the same for every request, only the urls of the resources and services have tokens
+	base, _, _ := strings.Cut(id, "?")
+	manifest := &iiifManifest{
+		Context: iiifPresentationContext,
+		ID:      base,
+		Type:    "Manifest",
+		Label:   iiifLangMap{"none": {ar.Signature}},
+		Items:   []*manifestCanvas{},
+	}
+	desc, err := ms.masterDescription(ar.Collection, ar.Signature)
+	if err != nil {
+		ms.logger.Warningf("%v", err)
+	} else {
+		if desc.label != nil {
+			manifest.Label = desc.label
+		}
+		manifest.Summary, manifest.Metadata, manifest.Rights = desc.summary, desc.metadata, desc.rights
+	}
+
+	var canvas *manifestCanvas
+	switch mimetype := strings.ToLower(ar.Entry.mimetype); {
+	case strings.HasPrefix(mimetype, "image/"):
+		canvas, err = ar.imageCanvas(base + "/canvas")
+	case strings.HasPrefix(mimetype, "video/"):
+		canvas, err = ar.avCanvas(base+"/canvas", "Video")
+	case strings.HasPrefix(mimetype, "audio/"):
+		canvas, err = ar.avCanvas(base+"/canvas", "Sound")
+	case mimetype == "application/pdf":
+		if manifest.Items, err = ar.pdfCanvases(base + "/canvas"); err == nil {
+			master, err2 := ar.actionURL("master")
+			if err = err2; err == nil {
+				manifest.Rendering = []*manifestResource{{ID: master, Type: "Text", Label: iiifLangMap{"none": {"PDF"}}, Format: "application/pdf"}}
+			}
+		}
+	default:
+		return ar.Error(http.StatusUnsupportedMediaType, fmt.Sprintf("no manifest for %s/%s of type %s", ar.Collection.name, ar.Signature, ar.Entry.mimetype))
+	}
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, err.Error())
+	}
+	if canvas != nil {
+		manifest.Items = append(manifest.Items, canvas)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return ar.Error(http.StatusInternalServerError, fmt.Sprintf("Cannot create manifest of %s/%s: %s", ar.Collection.name, ar.Signature, err))
+	}
+	ar.Writer.Header().Set("Content-Type", iiifContentType(ar.Request, iiifPresentationContext))
+	if !ar.Entry.jwtkey.Valid {
+		ar.Writer.Header().Set("Cache-Control", ms.cfg.Mediaserver.CacheControl)
+	}
+	_, err = ar.Writer.Write(data)
+	return err
+}
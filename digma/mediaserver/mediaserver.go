@@ -2,20 +2,17 @@ package mediaserver
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
-	"log"
 	"net/http"
-	"net/url"
-	"os"
-	"path/filepath"
-	"sort"
+	"path"
+	"runtime"
 	"strconv"
 	"strings"
 
+	fcgiclient "github.com/je4/mediaserver2/digma/fcgi"
 	logging "github.com/op/go-logging"
-	fcgiclient "github.com/tomasen/fcgi_client"
 )
 
 var (
@@ -29,27 +26,110 @@ type Mediaserver struct {
 	cfg         *Config
 	collections *Collections
 	storages    *Storages
+	archives    *archiveCache
+	fixity      *Fixity
+	lookup      *Lookup
+	iiifCache   *IIIFCache
+	actions     *Actions
+	generating  *flightGroup
+	// free slots for decoding image masters
+	imageSlots  chan struct{}
+	jobs        *Jobs
+	fcgi        *fcgiclient.Client
+	httpBackend *http.Client
 	logger      *logging.Logger
 }
 
 // Create a new Mediaserver
 // db Database Handle
-// fcgiProto Protocol for FCGI connection
-// fcgiAddr Address for FCGI connection
-func New(db *sql.DB, cfg *Config, logger *logging.Logger) *Mediaserver {
+// errors of the configuration are fatal. collections and storages which cannot be loaded
+// are logged, the next refresh will retry
+func New(db *sql.DB, cfg *Config, logger *logging.Logger) (*Mediaserver, error) {
 	mediaserver := &Mediaserver{
 		db:     db,
 		cfg:    cfg,
 		logger: logger}
-	mediaserver.Init()
-	return mediaserver
+	if err := mediaserver.Init(); err != nil {
+		return nil, fmt.Errorf("cannot initialize mediaserver: %v", err)
+	}
+	return mediaserver, nil
 }
 
-// constructor
+// constructor. all parts are initialized, errors of the configuration are returned together
 func (ms *Mediaserver) Init() (err error) {
-	ms.collections = NewCollections(ms.db)
-	ms.storages = NewStorages(ms.db)
-	return
+	var errColls, errStors error
+	errs := []error{}
+	ms.collections, errColls = NewCollections(ms.db)
+	if errColls != nil {
+		ms.logger.Errorf("cannot load collections: %v", errColls)
+	}
+	ms.storages, errStors = NewStorages(ms.db, &ms.cfg.Mediaserver)
+	if errStors != nil {
+		ms.logger.Errorf("cannot load storages: %v", errStors)
+	}
+	ms.archives = newArchiveCache()
+	ms.fixity = NewFixity(ms.db, ms.cfg.Mediaserver.Fixity.TTL)
+	ms.lookup = NewLookup(ms.db, ms.cfg.Mediaserver.LookupCache)
+	ms.actions = newActions(&ms.cfg.Mediaserver)
+	if ms.generating == nil {
+		ms.generating = newFlightGroup()
+	}
+	if ms.imageSlots == nil {
+		slots := ms.cfg.Mediaserver.Images.Concurrency
+		if slots <= 0 {
+			slots = runtime.NumCPU()
+		}
+		ms.imageSlots = make(chan struct{}, slots)
+	}
+	if ms.fcgi == nil {
+		if ms.fcgi, err = newFCGIClient(ms.cfg.Mediaserver.FCGI); err != nil {
+			errs = append(errs, fmt.Errorf("fcgi: %v", err))
+		}
+	}
+	if ms.cfg.Mediaserver.HTTPBackend.URL != "" && ms.httpBackend == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = ms.cfg.Mediaserver.HTTPBackend.Timeout
+		ms.httpBackend = &http.Client{Transport: transport}
+	}
+	if ms.cfg.Mediaserver.Jobs.Alias != "" && ms.jobs == nil {
+		ms.jobs = NewJobs(ms, ms.cfg.Mediaserver.Jobs)
+	}
+	if ms.cfg.Mediaserver.IIIF.Cache.Dir != "" && ms.iiifCache == nil {
+		if ms.iiifCache, err = NewIIIFCache(ms.cfg.Mediaserver.IIIF.Cache, ms.logger); err != nil {
+			errs = append(errs, fmt.Errorf("iiif cache: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serve a file from a storage. range and conditional requests are handled by http.ServeContent
+// the query parameter version selects a version on versioned storages
+func (ms *Mediaserver) serveStorageFile(writer http.ResponseWriter, req *http.Request, fs StorageFS, name string) (err error) {
+	_, fileName := path.Split(name)
+	// versioned storages (ocfl) deliver older versions on request
+	file, err := openStorageVersion(fs, name, req.URL.Query().Get("version"))
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("File not found: %s - %s", fileName, err.Error()))
+		return err
+	}
+	defer file.Close()
+
+	fileStat, err := file.Stat()
+	if err != nil {
+		ms.DoPanic(writer, req, http.StatusForbidden, fmt.Sprintf("Cannot stat file: %s - %s", fileName, err.Error()))
+		return err
+	}
+	if fileStat.IsDir() {
+		ms.DoPanic(writer, req, http.StatusForbidden, fmt.Sprintf("Access to folder %s denied", fileName))
+		return fmt.Errorf("%s is a folder", name)
+	}
+	// object stores deliver an etag, which is used by http.ServeContent for If-Match/If-None-Match
+	if etagger, ok := fileStat.(interface{ ETag() string }); ok && etagger.ETag() != "" {
+		writer.Header().Set("Etag", etagger.ETag())
+	}
+
+	http.ServeContent(writer, req, fileName, fileStat.ModTime(), file)
+	return nil
 }
 
 // html output of error message
@@ -125,307 +205,31 @@ func (ms *Mediaserver) HandlerIIIF(writer http.ResponseWriter, req *http.Request
 	}
 	iiifPath := strings.Replace(file, "$", "%24", -1)
 	filePath := iiifPath
-	if len(params) > 0 {
-		iiifPath = singleJoiningSlash(iiifPath, params)
-	}
-	urlstring := singleJoiningSlash(ms.cfg.Mediaserver.IIIF.URL, iiifPath)
-
-	client := &http.Client{}
-	log.Println("Proxy: ", urlstring)
-	req2, err := http.NewRequest("GET", urlstring, nil)
-	if err != nil {
-		ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Error creating new request: %s", err.Error()))
-		return err
-	}
 
 	token = "open"
 	if storage.secret.Valid {
 		sub := ms.cfg.SubPrefix + filePath
-		token, err = NewJWT(storage.secret.String, sub, 7200)
+		token, err = NewJWT(storage.secret.String, sub, ms.iiifTokenTTL())
 		if err != nil {
 			ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Error creating access token: %s", err.Error()))
 			return err
 		}
 	}
 	token = strconv.Itoa(storageid) + "_" + token
-	proto, host, port := ms.getProtoHostPort(req)
-	req2.Header.Add("X-Forwarded-Proto", proto)
-	req2.Header.Add("X-Forwarded-Host", host)
-	req2.Header.Add("X-Forwarded-Port", strconv.Itoa(port))
-	req2.Header.Add("X-Forwarded-Path", singleJoiningSlash(ms.cfg.Mediaserver.IIIF.Alias, token)+"/")
-	req2.Header.Add("X-Forwarded-For", req.RemoteAddr[:strings.IndexByte(req.RemoteAddr, ':')])
-
-	rs, err := client.Do(req2)
-	if err != nil {
-		ms.DoPanic(writer, req, http.StatusBadGateway, fmt.Sprintf("Error calling proxy: %s - %s", urlstring, err))
-		return err
-	}
-	defer rs.Body.Close()
-
-	io.Copy(writer, rs.Body)
-
-	return nil
-}
-
-// query handler
-func (ms *Mediaserver) Handler(writer http.ResponseWriter, req *http.Request, collection string, signature string, action string, params []string) (err error) {
-	var (
-		filebase     string
-		path         string
-		mimetype     string
-		jwtkey       sql.NullString
-		storageid    int
-		private      int
-		paramstring  string
-		naction      string
-		nparamstring string
-		token        []string
-		ok           bool = false
-	)
-	//	writer.Header().Set("Access-Control-Allow-Origin", "*")
-
-	sort.Strings(params)
-
-	coll, err := ms.collections.ByName(collection)
-	// collection not found
-	if err != nil {
-		// reload collections
-		err = ms.collections.Init()
+	if ms.cfg.Mediaserver.IIIF.Native {
+		fs, err := ms.storages.FS(storage.filebase)
 		if err != nil {
-			ms.DoPanic(writer, req, http.StatusNotFound, "could not load collections: "+err.Error())
+			ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Cannot access storage #%d: %s", storageid, err.Error()))
 			return err
 		}
-		coll, err = ms.collections.ByName(collection)
-		// again not found
+		name := strings.TrimLeft(path.Clean("/"+strings.TrimPrefix(filename, storagePath)), "/")
+		f, err := fs.Open(name)
 		if err != nil {
-			ms.DoPanic(writer, req, http.StatusNotFound, err.Error())
+			ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("File not found: %s - %s", name, err.Error()))
 			return err
 		}
-
-	}
-
-	paramstring = strings.Trim(strings.Join(params, "/"), "/")
-	naction = action
-	nparamstring = paramstring
-	isiiif := (action == "iiif")
-	if isiiif {
-		naction = "master"
-		nparamstring = ""
+		defer f.Close()
+		return ms.serveIIIF(writer, req, f, iiifPath, params, ms.iiifID(req, token, iiifPath))
 	}
-	ms.logger.Debug("QUERY: /" + collection + "[" + strconv.Itoa(coll.id) + "]/" + signature + "/" + naction + "/" + nparamstring)
-
-	found := true
-	exists := true
-	row := ms.db.QueryRow("select filebase, path, mimetype, jwtkey, storageid, private FROM fullcache WHERE collection_id=? AND signature=? and action=? AND param=?", coll.id, signature, naction, nparamstring)
-	err = row.Scan(&filebase, &path, &mimetype, &jwtkey, &storageid, &private)
-	if err != nil {
-		found = false
-		sqlstr := "select jwtkey, `m`.`public` = 0 or `c`.`public` = 0 AS `private` " +
-			" FROM master m, collection c, storage s " +
-			" WHERE m.collectionid=? AND m.signature=? AND m.collectionid=c.collectionid AND s.storageid=c.storageid"
-		//ms.logger.Debugf("%s - [%v, %s]", sqlstr, coll.id, signature)
-		row := ms.db.QueryRow(sqlstr, coll.id, signature)
-		err = row.Scan(&jwtkey, &private)
-		if err != nil {
-			exists = false
-			ms.logger.Debug(fmt.Sprintf("could not find in databbase [%s/%s] - %v", collection, signature, err))
-			//		ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("could not find %s[%d]/%s/%s/%s", collection, coll.id, signature, naction, nparamstring))
-			//		return nil
-		}
-		ms.logger.Debugf("%s/%s exists // private: %v", collection, signature, private)
-	}
-	if found && isiiif {
-		ms.logger.Debug("Mimetype: " + mimetype)
-
-		naction = "convert"
-		nparamstring = "formatptiff"
-		row := ms.db.QueryRow("select filebase, path, jwtkey, storageid, private FROM fullcache WHERE collection_id=? AND signature=? and action=? AND param=?", coll.id, signature, naction, nparamstring)
-		if err != nil {
-			ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("could not query %s[%d]/%s/%s/%s", collection, coll.id, signature, naction, nparamstring))
-			return err
-		}
-		err = row.Scan(&filebase, &path, &jwtkey, &storageid, &private)
-		if err != nil {
-			found = false
-			ms.logger.Debug(fmt.Sprintf("could not find in databbase [%s/%s/%s/%s]", collection, signature, naction, nparamstring))
-			//		ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("could not find %s[%d]/%s/%s/%s", collection, coll.id, signature, naction, nparamstring))
-			//		return nil
-		}
-	}
-	// get token from uri parameter
-	token, ok = req.URL.Query()["token"]
-	// sometimes auth is used instead of token...
-	if !ok {
-		token, ok = req.URL.Query()["auth"]
-	}
-
-	//if (found && jwtkey.Valid) || private == 1 {
-	ms.logger.Debugf("%s/%s: found: %v // exists: %v // private: %v // jwtkey.Valid: %v", collection, signature, found, exists, private, jwtkey.Valid)
-	if exists && private == 1 && jwtkey.Valid {
-		if ok {
-			sub := strings.ToLower(strings.TrimRight(ms.cfg.SubPrefix+collection+"/"+signature+"/"+action+"/"+paramstring, "/"))
-			err := CheckJWT(token[0], jwtkey.String, sub)
-			if err != nil {
-				ms.DoPanic(writer, req, http.StatusForbidden, err.Error())
-				return err
-			}
-		} else {
-			ms.DoPanic(writer, req, http.StatusForbidden, fmt.Sprintf("no access token"))
-			return err
-		}
-	}
-
-	// if not found, then forward to php mediaserver
-	if !found {
-		ms.logger.Debugf("Start fcgi %s %s", ms.cfg.Mediaserver.FCGI.Proto, ms.cfg.Mediaserver.FCGI.Addr)
-		fcgi, err := fcgiclient.Dial(ms.cfg.Mediaserver.FCGI.Proto, ms.cfg.Mediaserver.FCGI.Addr)
-		if err != nil {
-			ms.DoPanic(writer, req, http.StatusBadGateway, fmt.Sprintf("Unable to connect to fcgi backend: %s://%s - %s", ms.cfg.Mediaserver.FCGI.Proto, ms.cfg.Mediaserver.FCGI.Addr, err))
-			//ctx.Error("Unable to connect to the backend", 502)
-			return err
-		}
-		parameters := url.Values{}
-		parameters.Add("collection", collection)
-		parameters.Add("signature", signature)
-		parameters.Add("action", naction)
-		if len(token) > 0 {
-			parameters.Add("token", token[0])
-		}
-		for _, value := range params {
-			if value != "" {
-				parameters.Add("params[]", value)
-			}
-		}
-
-		env := map[string]string{
-			"AUTH_TYPE":       "", // Not used
-			"SCRIPT_FILENAME": ms.cfg.Mediaserver.FCGI.Script,
-			"SERVER_SOFTWARE": VERSION,
-			"REMOTE_ADDR":     req.RemoteAddr,
-			"QUERY_STRING":    parameters.Encode(),
-			"HOME":            "/",
-			"HTTPS":           "on",
-			"REQUEST_SCHEME":  "https",
-			"SERVER_PROTOCOL": req.Proto,
-			"REQUEST_METHOD":  req.Method,
-			"FCGI_ROLE":       "RESPONDER",
-			"REQUEST_URI":     req.RequestURI,
-		}
-		resp, err := fcgi.Get(env)
-		if err != nil {
-			ms.DoPanic(writer, req, http.StatusBadGateway, fmt.Sprintf("Unable to get data from fcgi backend: %s:%s - %s", ms.cfg.Mediaserver.FCGI.Proto, ms.cfg.Mediaserver.FCGI.Addr, err))
-			return err
-		}
-		contentType := resp.Header.Get("Content-type")
-		if contentType == "" {
-			contentType = "text/html"
-		}
-		writer.Header().Set("Content-type", contentType)
-		_, err = io.Copy(writer, resp.Body)
-		if err != nil {
-			ms.DoPanic(writer, req, http.StatusBadGateway, fmt.Sprintf("Unable to copy content from fcgi backend: %s://%s - %s", ms.cfg.Mediaserver.FCGI.Proto, ms.cfg.Mediaserver.FCGI.Addr, err))
-			return err
-		}
-
-		return nil
-	}
-
-	uri := strings.TrimRight(filebase, "/") + "/" + strings.TrimLeft(path, "/")
-	URL, err := url.Parse(uri)
-	if err != nil {
-		ms.logger.Errorf("cannot parse url %s: %v", uri, err)
-		return err
-	}
-	if _, err := os.Stat(URL.Path); err == nil {
-		filePath := URL.Path
-		_, fileName := filepath.Split(filePath)
-
-		fileStat, err := os.Stat(filePath)
-		if err != nil {
-			ms.DoPanic(writer, req, http.StatusForbidden, fmt.Sprintf("Cannot stat file: %s - %s", fileName, err.Error()))
-			return err
-		}
-
-		if fileStat.IsDir() {
-			ms.DoPanic(writer, req, http.StatusForbidden, fmt.Sprintf("Access to folder %s denied", fileName))
-			return err
-		}
-
-		ms.logger.Debugf("size of %s - %v", filePath, fileStat.Size())
-
-		if isiiif {
-			iiifPath := strings.Replace(strings.Trim(strings.TrimPrefix(filePath, ms.cfg.Mediaserver.IIIF.IIIFBase), "/"), "/", "%24", -1)
-			iiifPathWithParam := iiifPath
-			if len(paramstring) > 0 {
-				iiifPathWithParam = singleJoiningSlash(iiifPath, paramstring)
-			}
-			urlstring := singleJoiningSlash(ms.cfg.Mediaserver.IIIF.URL, iiifPathWithParam)
-
-			client := &http.Client{}
-			ms.logger.Debugf("Proxy: %s", urlstring)
-			req2, err := http.NewRequest("GET", urlstring, nil)
-			if err != nil {
-				ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Error creating http request for %s: %s", urlstring, err))
-				return err
-			}
-
-			token := "open"
-			if jwtkey.Valid {
-				secret := jwtkey.String
-				sub := ms.cfg.SubPrefix + iiifPath
-				token, err = NewJWT(secret, sub, 7200)
-				if err != nil {
-					ms.DoPanic(writer, req, http.StatusInternalServerError, fmt.Sprintf("Error creating access token for %s: %s", sub, err))
-					return err
-				}
-			}
-
-			//ms.logger.Debug("req.Host:", req.Host)
-			proto, host, port := ms.getProtoHostPort(req)
-			req2.Header.Add("X-Forwarded-Proto", proto)
-			req2.Header.Add("X-Forwarded-Host", host)
-			req2.Header.Add("X-Forwarded-Port", strconv.Itoa(port))
-			req2.Header.Add("X-Forwarded-Path", singleJoiningSlash(ms.cfg.Mediaserver.IIIF.Alias, strconv.Itoa(storageid)+"_"+token)+"/")
-			req2.Header.Add("X-Forwarded-For", req.RemoteAddr[:strings.IndexByte(req.RemoteAddr, ':')])
-			/*
-				for k, v := range req2.Header {
-					log.Println("Key:", k, "Value:", v)
-				}
-			*/
-			rs, err := client.Do(req2)
-			if err != nil {
-				ms.DoPanic(writer, req, http.StatusBadGateway, fmt.Sprintf("Error calling proxy: %s - %s", urlstring, err))
-				return err
-			}
-			defer rs.Body.Close()
-
-			if _, err := io.Copy(writer, rs.Body); err != nil {
-				ms.logger.Errorf("cannot copy result body of iiif server: %v", err)
-				return err
-			}
-
-			return nil
-		}
-		if !jwtkey.Valid {
-			//writer.Header().Set( "Cache-Control", "max-age=2592000, s-maxage=864000, stale-while-revalidate=86400, public")
-			writer.Header().Set("Cache-Control", ms.cfg.Mediaserver.CacheControl)
-		}
-
-		/*
-			file, err := os.Open(filePath)
-			if err != nil {
-				ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("File not found: %s - %s", fileName, err.Error()))
-				return err
-			}
-			defer file.Close()
-
-			t := fileStat.ModTime()
-			//writer.Header().Set("Server", VERSION)
-			//		log.Println("serve: ", fileName)
-			http.ServeContent(writer, req, fileName, t, file)
-		*/
-		http.ServeFile(writer, req, filePath)
-		return nil
-	}
-	return nil
+	return ms.proxyIIIF(writer, req, iiifPath, params, singleJoiningSlash(ms.cfg.Mediaserver.IIIF.Alias, token)+"/")
 }
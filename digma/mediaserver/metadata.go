@@ -0,0 +1,251 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// technical metadata of a master
+type Metadata struct {
+	Collection string `json:"collection"`
+	Signature  string `json:"signature"`
+	Mimetype   string `json:"mimetype"`
+	Size       int64  `json:"size"`
+	// images
+	Format     string                 `json:"format,omitempty"`
+	Width      int                    `json:"width,omitempty"`
+	Height     int                    `json:"height,omitempty"`
+	ColorSpace string                 `json:"colorspace,omitempty"`
+	Exif       map[string]interface{} `json:"exif,omitempty"`
+	XMP        string                 `json:"xmp,omitempty"`
+	// audio and video
+	Duration float64          `json:"duration,omitempty"`
+	Bitrate  int64            `json:"bitrate,omitempty"`
+	Streams  []MetadataStream `json:"streams,omitempty"`
+	// pdf
+	Pages     int               `json:"pages,omitempty"`
+	PageSizes []MetadataPage    `json:"pagesizes,omitempty"`
+	PDF       map[string]string `json:"pdf,omitempty"`
+}
+
+// size of a pdf page in points as displayed
+type MetadataPage struct {
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// stream of an audio or video master
+type MetadataStream struct {
+	Type          string  `json:"type"`
+	Codec         string  `json:"codec"`
+	Profile       string  `json:"profile,omitempty"`
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	PixelFormat   string  `json:"pixelformat,omitempty"`
+	ColorSpace    string  `json:"colorspace,omitempty"`
+	FrameRate     string  `json:"framerate,omitempty"`
+	SampleRate    int     `json:"samplerate,omitempty"`
+	Channels      int     `json:"channels,omitempty"`
+	ChannelLayout string  `json:"channellayout,omitempty"`
+	Bitrate       int64   `json:"bitrate,omitempty"`
+	Duration      float64 `json:"duration,omitempty"`
+}
+
+// names of the color models of the go decoders
+func colorModelName(model color.Model) string {
+	switch model {
+	case color.RGBAModel, color.NRGBAModel:
+		return "rgb"
+	case color.RGBA64Model, color.NRGBA64Model:
+		return "rgb16"
+	case color.GrayModel:
+		return "gray"
+	case color.Gray16Model:
+		return "gray16"
+	case color.YCbCrModel, color.NYCbCrAModel:
+		return "ycbcr"
+	case color.CMYKModel:
+		return "cmyk"
+	}
+	if _, ok := model.(color.Palette); ok {
+		return "palette"
+	}
+	return ""
+}
+
+// technical metadata of the master as json
+type metadataAction struct{}
+
+func (a *metadataAction) Name() string { return "metadata" }
+
+// metadata has no parameters
+func (a *metadataAction) Params(params []string) ([]string, error) {
+	return ParamSpecs{}.Canonical(params)
+}
+
+func (a *metadataAction) CacheKey(params []string) (string, string) { return "metadata", "" }
+
+func (a *metadataAction) NeedsMaster() bool { return true }
+
+func (a *metadataAction) Produce(ar *ActionRequest) error { return ar.ServeEntry(a) }
+
+func (a *metadataAction) Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error) {
+	start := time.Now()
+	file, master, err := ms.OpenMaster(coll, signature)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat master of %s/%s: %v", coll.name, signature, err)
+	}
+	md := &Metadata{
+		Collection: coll.name,
+		Signature:  signature,
+		Mimetype:   master.mimetype,
+		Size:       stat.Size(),
+	}
+	if md.Mimetype == "" {
+		head := make([]byte, 512)
+		n, _ := file.ReadAt(head, 0)
+		md.Mimetype = http.DetectContentType(head[:n])
+	}
+
+	switch mimetype := strings.ToLower(md.Mimetype); {
+	case strings.HasPrefix(mimetype, "image/"):
+		// unknown formats have exif or xmp anyway
+		if cfg, format, err := image.DecodeConfig(file); err == nil {
+			md.Format, md.Width, md.Height, md.ColorSpace = format, cfg.Width, cfg.Height, colorModelName(cfg.ColorModel)
+		}
+		if md.Exif, md.XMP, err = readEmbeddedMetadata(file, md.Size); err != nil {
+			ms.logger.Warningf("cannot read exif of %s/%s: %v", coll.name, signature, err)
+		}
+	case strings.HasPrefix(mimetype, "video/"), strings.HasPrefix(mimetype, "audio/"):
+		if ms.cfg.Mediaserver.FFmpeg.ProbePath == "" {
+			break
+		}
+		input, cleanup, _, err := ms.LocalMaster(coll, signature)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		if err := ms.probeMetadata(input, md); err != nil {
+			return nil, err
+		}
+	case mimetype == "application/pdf":
+		if ms.cfg.Mediaserver.PDF.Pdfinfo == "" {
+			break
+		}
+		input, cleanup, _, err := ms.LocalMaster(coll, signature)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		doc, err := ms.probePDFPages(input, 1, maxPDFPages)
+		if err != nil {
+			return nil, err
+		}
+		md.Pages = doc.pages
+		for page := 1; page <= doc.pages; page++ {
+			width, height, err := doc.pageSize(page)
+			if err != nil {
+				break
+			}
+			md.PageSizes = append(md.PageSizes, MetadataPage{width, height})
+			// the page information is not part of the document information
+			delete(doc.info, fmt.Sprintf("Page %d size", page))
+			delete(doc.info, fmt.Sprintf("Page %d rot", page))
+		}
+		md.PDF = doc.info
+		if len(md.PageSizes) > 0 {
+			md.Width, md.Height = int(md.PageSizes[0].Width+0.5), int(md.PageSizes[0].Height+0.5)
+		}
+		_, md.XMP, _ = readEmbeddedMetadata(file, md.Size)
+	}
+
+	tmp, err := ms.TempFile("json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(md); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("cannot write metadata: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	ms.logger.Infof("metadata of %s/%s in %v", coll.name, signature, time.Since(start))
+	return ms.StoreDerivative(coll, signature, "metadata", "", "application/json", "json", tmp.Name())
+}
+
+// format and streams of an audio or video file
+func (ms *Mediaserver) probeMetadata(name string, md *Metadata) error {
+	out, err := ms.execProbe("-v", "error", "-show_format", "-show_streams", "-of", "json", name)
+	if err != nil {
+		return fmt.Errorf("cannot probe %s: %v", name, err)
+	}
+	// ffprobe reports most numbers as strings
+	result := struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			Bitrate    string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType     string `json:"codec_type"`
+			CodecName     string `json:"codec_name"`
+			Profile       string `json:"profile"`
+			Width         int    `json:"width"`
+			Height        int    `json:"height"`
+			PixFmt        string `json:"pix_fmt"`
+			ColorSpace    string `json:"color_space"`
+			FrameRate     string `json:"avg_frame_rate"`
+			SampleRate    string `json:"sample_rate"`
+			Channels      int    `json:"channels"`
+			ChannelLayout string `json:"channel_layout"`
+			Bitrate       string `json:"bit_rate"`
+			Duration      string `json:"duration"`
+		} `json:"streams"`
+	}{}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return fmt.Errorf("cannot parse ffprobe output of %s: %v", name, err)
+	}
+	md.Format = result.Format.FormatName
+	md.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	md.Bitrate, _ = strconv.ParseInt(result.Format.Bitrate, 10, 64)
+	for _, s := range result.Streams {
+		stream := MetadataStream{
+			Type:          s.CodecType,
+			Codec:         s.CodecName,
+			Profile:       s.Profile,
+			Width:         s.Width,
+			Height:        s.Height,
+			PixelFormat:   s.PixFmt,
+			ColorSpace:    s.ColorSpace,
+			Channels:      s.Channels,
+			ChannelLayout: s.ChannelLayout,
+		}
+		if s.CodecType == "video" && s.FrameRate != "0/0" {
+			stream.FrameRate = s.FrameRate
+			if md.Width == 0 {
+				md.Width, md.Height, md.ColorSpace = s.Width, s.Height, s.ColorSpace
+			}
+		}
+		stream.SampleRate, _ = strconv.Atoi(s.SampleRate)
+		stream.Bitrate, _ = strconv.ParseInt(s.Bitrate, 10, 64)
+		stream.Duration, _ = strconv.ParseFloat(s.Duration, 64)
+		md.Streams = append(md.Streams, stream)
+	}
+	return nil
+}
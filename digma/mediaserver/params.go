@@ -0,0 +1,170 @@
+package mediaserver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParamKind is the type of the value of an action parameter
+type ParamKind int
+
+const (
+	// name only, e.g. crop
+	ParamFlag ParamKind = iota
+	// name<n>
+	ParamInt
+	// name<width>x<height>
+	ParamSize
+	// name<value> with a fixed set of values
+	ParamEnum
+	// name<n>[k|m] in bits per second
+	ParamBitrate
+	// name<seconds|[hh:]mm:ss[.fff]>
+	ParamTime
+)
+
+// ParamSpec declares a parameter of an action. the parameter is the name followed by the value
+type ParamSpec struct {
+	Name string
+	Kind ParamKind
+	// range of ParamInt and of the sides of ParamSize. 0 = no limit
+	Min int
+	Max int
+	// ParamInt must be a multiple of step and is reduced modulo the modulus
+	Step    int
+	Modulus int
+	// values of ParamEnum and alternative spellings
+	Values  []string
+	Aliases map[string]string
+}
+
+// ParamSpecs are all parameters of an action
+type ParamSpecs []ParamSpec
+
+// Canonical checks the parameters and returns the canonical form of every parameter in sorted order.
+// equivalent parameters like size0200x200 and size200x200 have the same canonical form
+func (ps ParamSpecs) Canonical(params []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, param := range params {
+		if param == "" {
+			continue
+		}
+		param = strings.ToLower(param)
+		spec := ps.find(param)
+		if spec == nil {
+			return nil, &ParamError{param, "unknown parameter"}
+		}
+		if seen[spec.Name] {
+			return nil, &ParamError{param, "duplicate parameter " + spec.Name}
+		}
+		seen[spec.Name] = true
+		value, err := spec.canonical(strings.TrimPrefix(param, spec.Name))
+		if err != nil {
+			return nil, &ParamError{param, err.Error()}
+		}
+		result = append(result, spec.Name+value)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// spec with the longest name which is a prefix of param
+func (ps ParamSpecs) find(param string) *ParamSpec {
+	var result *ParamSpec
+	for i := range ps {
+		spec := &ps[i]
+		if !strings.HasPrefix(param, spec.Name) || (spec.Kind == ParamFlag && param != spec.Name) {
+			continue
+		}
+		if result == nil || len(spec.Name) > len(result.Name) {
+			result = spec
+		}
+	}
+	return result
+}
+
+// canonical form of the value of a parameter
+func (spec *ParamSpec) canonical(value string) (string, error) {
+	switch spec.Kind {
+	case ParamFlag:
+		return "", nil
+	case ParamInt:
+		n, err := spec.int(value)
+		if err != nil {
+			return "", err
+		}
+		if spec.Step > 0 && n%spec.Step != 0 {
+			return "", fmt.Errorf("must be a multiple of %d", spec.Step)
+		}
+		if spec.Modulus > 0 {
+			n = (n%spec.Modulus + spec.Modulus) % spec.Modulus
+		}
+		return strconv.Itoa(n), nil
+	case ParamSize:
+		w, h, ok := strings.Cut(value, "x")
+		if !ok {
+			return "", fmt.Errorf("expected %s<width>x<height>", spec.Name)
+		}
+		width, err := spec.int(w)
+		if err != nil {
+			return "", err
+		}
+		height, err := spec.int(h)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%dx%d", width, height), nil
+	case ParamEnum:
+		if alias, ok := spec.Aliases[value]; ok {
+			value = alias
+		}
+		for _, v := range spec.Values {
+			if v == value {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("expected one of %s", strings.Join(spec.Values, ", "))
+	case ParamBitrate:
+		if _, err := parseBitrate(spec.Name, value); err != nil {
+			return "", fmt.Errorf("expected bitrate like 2000k")
+		}
+		n, _ := strconv.Atoi(strings.TrimRight(value, "km"))
+		switch {
+		case strings.HasSuffix(value, "m"):
+			n *= 1000000
+		case strings.HasSuffix(value, "k"):
+			n *= 1000
+		}
+		if n%1000 == 0 {
+			return strconv.Itoa(n/1000) + "k", nil
+		}
+		return strconv.Itoa(n), nil
+	case ParamTime:
+		seconds, err := parseTimestamp(spec.Name, value)
+		if err != nil {
+			return "", fmt.Errorf("expected seconds or hh:mm:ss")
+		}
+		return strconv.FormatFloat(seconds, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("unknown kind of parameter")
+}
+
+// integer within the limits of the spec
+func (spec *ParamSpec) int(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number")
+	}
+	switch {
+	case spec.Min != 0 && spec.Max != 0 && (n < spec.Min || n > spec.Max):
+		return 0, fmt.Errorf("must be between %d and %d", spec.Min, spec.Max)
+	case spec.Min != 0 && n < spec.Min:
+		return 0, fmt.Errorf("must be at least %d", spec.Min)
+	case spec.Max != 0 && n > spec.Max:
+		return 0, fmt.Errorf("must be at most %d", spec.Max)
+	}
+	return n, nil
+}
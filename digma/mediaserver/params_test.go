@@ -0,0 +1,88 @@
+package mediaserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		specs  ParamSpecs
+		params string
+		want   string
+	}{
+		{imageParamSpecs, "size200x200/formatjpeg", "formatjpeg/size200x200"},
+		{imageParamSpecs, "formatjpeg/size0200x0200", "formatjpeg/size200x200"},
+		{imageParamSpecs, "SIZE200x200//formatJPG", "formatjpeg/size200x200"},
+		{imageParamSpecs, "angle-90/crop", "angle270/crop"},
+		{imageParamSpecs, "angle450", "angle90"},
+		{imageParamSpecs, "", ""},
+		{fcgiImageParamSpecs, "formatjpg/size0200x200", "formatjpg/size200x200"},
+		{fcgiImageParamSpecs, "formatjpeg", "formatjpeg"},
+		{transcodeParamSpecs, "videobitrate2m", "videobitrate2000k"},
+		{transcodeParamSpecs, "audiobitrate128000", "audiobitrate128k"},
+		{posterParamSpecs, "time01:30/formatjpg", "formatjpeg/time90"},
+		{posterParamSpecs, "time90.0", "time90"},
+	}
+	for _, test := range tests {
+		params, err := test.specs.Canonical(strings.Split(test.params, "/"))
+		if err != nil {
+			t.Errorf("%s: %v", test.params, err)
+			continue
+		}
+		if got := strings.Join(params, "/"); got != test.want {
+			t.Errorf("%s: got %s, expected %s", test.params, got, test.want)
+		}
+	}
+}
+
+func TestCanonicalInvalid(t *testing.T) {
+	tests := []struct {
+		specs  ParamSpecs
+		params string
+	}{
+		{imageParamSpecs, "garbage"},
+		{imageParamSpecs, "size200"},
+		{imageParamSpecs, "size0x200"},
+		{imageParamSpecs, "sizeaxb"},
+		{imageParamSpecs, "size200x200/size100x100"},
+		{imageParamSpecs, "formatbmp"},
+		{imageParamSpecs, "angle45"},
+		{imageParamSpecs, "quality0"},
+		{imageParamSpecs, "quality101"},
+		{imageParamSpecs, "cropx"},
+		{fcgiImageParamSpecs, "resize"},
+		{fcgiImageParamSpecs, "formatgif"},
+		{transcodeParamSpecs, "videobitratefast"},
+		{posterParamSpecs, "timenow"},
+	}
+	for _, test := range tests {
+		_, err := test.specs.Canonical(strings.Split(test.params, "/"))
+		var paramErr *ParamError
+		if !errors.As(err, &paramErr) {
+			t.Errorf("%s: expected ParamError, got %v", test.params, err)
+		}
+	}
+}
+
+// invalid parameters of image actions of the fcgi backend are rejected instead of forwarded
+func TestCachedActionParams(t *testing.T) {
+	actions := newActions(&CfgMediaserver{})
+	a := actions.Get("resize")
+	if _, err := a.Params([]string{"garbage"}); err == nil {
+		t.Errorf("resize/garbage accepted")
+	}
+	params, err := a.Params([]string{"size0200x200", "formatjpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, param := a.CacheKey(params); param != "formatjpg/size200x200" {
+		t.Errorf("cache param %s", param)
+	}
+	// unknown actions are passed to the backend
+	params, err = actions.Get("custom").Params([]string{"B", "a"})
+	if err != nil || strings.Join(params, "/") != "a/b" {
+		t.Errorf("custom: %v %v", params, err)
+	}
+}
@@ -0,0 +1,333 @@
+package mediaserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// run a poppler tool with the configured timeout and return its standard output
+func (ms *Mediaserver) runPoppler(tool string, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if timeout := ms.cfg.Mediaserver.PDF.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ms.logger.Debugf("%s %s", tool, strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, tool, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s timed out after %v", tool, ms.cfg.Mediaserver.PDF.Timeout)
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 1024 {
+			msg = "..." + msg[len(msg)-1024:]
+		}
+		return nil, fmt.Errorf("%s failed: %v - %s", tool, err, msg)
+	}
+	return out, nil
+}
+
+// last page of a pdfinfo call for all pages
+const maxPDFPages = 1 << 20
+
+// output of pdfinfo
+type pdfDocument struct {
+	pages int
+	// fields of pdfinfo with single spaces in the keys, e.g. "Page 1 size"
+	info map[string]string
+}
+
+// document information and the size of a page. page 0 skips the page information
+func (ms *Mediaserver) probePDF(name string, page int) (*pdfDocument, error) {
+	return ms.probePDFPages(name, page, page)
+}
+
+// document information and the sizes of the pages first to last. pdfinfo stops at the last page of the document
+func (ms *Mediaserver) probePDFPages(name string, first int, last int) (*pdfDocument, error) {
+	args := []string{"-enc", "UTF-8"}
+	if first > 0 {
+		args = append(args, "-f", strconv.Itoa(first), "-l", strconv.Itoa(last))
+	}
+	out, err := ms.runPoppler(ms.cfg.Mediaserver.PDF.Pdfinfo, append(args, name)...)
+	if err != nil {
+		return nil, err
+	}
+	doc := &pdfDocument{info: map[string]string{}}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		doc.info[strings.Join(strings.Fields(key), " ")] = strings.TrimSpace(value)
+	}
+	if doc.pages, err = strconv.Atoi(doc.info["Pages"]); err != nil {
+		return nil, fmt.Errorf("cannot get page count of %s", name)
+	}
+	return doc, nil
+}
+
+// size of a page in points as displayed, i.e. with rotation
+func (doc *pdfDocument) pageSize(page int) (float64, float64, error) {
+	var width, height float64
+	size := doc.info[fmt.Sprintf("Page %d size", page)]
+	if _, err := fmt.Sscanf(size, "%g x %g", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("cannot get size of page %d: %s", page, size)
+	}
+	if rot, _ := strconv.Atoi(doc.info[fmt.Sprintf("Page %d rot", page)]); rot%180 != 0 {
+		width, height = height, width
+	}
+	return width, height, nil
+}
+
+// page number of a request. must exist in the document
+func (doc *pdfDocument) checkPage(page int) error {
+	if page > doc.pages {
+		return &ParamError{fmt.Sprintf("page%d", page), fmt.Sprintf("document has %d pages", doc.pages)}
+	}
+	return nil
+}
+
+var pageParamSpecs = ParamSpecs{
+	{Name: "page", Kind: ParamInt, Min: 1},
+	{Name: "dpi", Kind: ParamInt, Min: 1, Max: 600},
+	{Name: "width", Kind: ParamInt, Min: 1, Max: 10000},
+	{Name: "height", Kind: ParamInt, Min: 1, Max: 10000},
+	{Name: "format", Kind: ParamEnum, Values: []string{"jpeg", "png"}, Aliases: map[string]string{"jpg": "jpeg"}},
+}
+
+type pageParams struct {
+	page   int
+	dpi    int
+	width  int
+	height int
+	format string
+}
+
+// page<n>, dpi<n>, width<w>, height<h>, format<jpeg|png>. width and height replace dpi
+func parsePageParams(params []string) (*pageParams, error) {
+	pp := &pageParams{page: 1, format: "jpeg"}
+	for _, param := range params {
+		var err error
+		switch {
+		case strings.HasPrefix(param, "page"):
+			pp.page, err = parseDimension(param, "page")
+		case strings.HasPrefix(param, "dpi"):
+			pp.dpi, err = parseDimension(param, "dpi")
+			if err == nil && pp.dpi > 600 {
+				return nil, &ParamError{param, "maximum is 600 dpi"}
+			}
+		case strings.HasPrefix(param, "width"):
+			pp.width, err = parseDimension(param, "width")
+		case strings.HasPrefix(param, "height"):
+			pp.height, err = parseDimension(param, "height")
+		case strings.HasPrefix(param, "format"):
+			pp.format = strings.TrimPrefix(param, "format")
+			if pp.format == "jpg" {
+				pp.format = "jpeg"
+			}
+			if pp.format != "jpeg" && pp.format != "png" {
+				return nil, &ParamError{param, "unsupported format"}
+			}
+		default:
+			return nil, &ParamError{param, "unknown parameter"}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pp.dpi > 0 && (pp.width > 0 || pp.height > 0) {
+		return nil, &ParamError{fmt.Sprintf("dpi%d", pp.dpi), "dpi cannot be combined with width or height"}
+	}
+	if pp.width > 10000 || pp.height > 10000 {
+		return nil, &ParamError{fmt.Sprintf("width%d/height%d", pp.width, pp.height), "image too large"}
+	}
+	if pp.dpi == 0 && pp.width == 0 && pp.height == 0 {
+		pp.dpi = 150
+	}
+	return pp, nil
+}
+
+// image of a page of a pdf master
+type pageAction struct{}
+
+func (a *pageAction) Name() string { return "page" }
+
+func (a *pageAction) Params(params []string) ([]string, error) {
+	params, err := pageParamSpecs.Canonical(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parsePageParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (a *pageAction) CacheKey(params []string) (string, string) {
+	return "page", strings.Join(params, "/")
+}
+
+func (a *pageAction) NeedsMaster() bool { return true }
+
+func (a *pageAction) Produce(ar *ActionRequest) error { return ar.ServeEntry(a) }
+
+func (a *pageAction) Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error) {
+	pp, err := parsePageParams(params)
+	if err != nil {
+		return nil, err
+	}
+	input, cleanup, _, err := ms.LocalMaster(coll, signature)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	doc, err := ms.probePDF(input, pp.page)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.checkPage(pp.page); err != nil {
+		return nil, err
+	}
+	args := []string{"-f", strconv.Itoa(pp.page), "-l", strconv.Itoa(pp.page), "-singlefile"}
+	if pp.dpi > 0 {
+		args = append(args, "-r", strconv.Itoa(pp.dpi))
+	} else {
+		// fit into width x height and keep the aspect ratio of the page
+		width, height, err := doc.pageSize(pp.page)
+		if err != nil {
+			return nil, err
+		}
+		scale := math.Inf(1)
+		if pp.width > 0 {
+			scale = float64(pp.width) / width
+		}
+		if pp.height > 0 {
+			scale = min(scale, float64(pp.height)/height)
+		}
+		args = append(args,
+			"-scale-to-x", strconv.Itoa(max(int(math.Round(width*scale)), 1)),
+			"-scale-to-y", strconv.Itoa(max(int(math.Round(height*scale)), 1)))
+	}
+	if pp.format == "jpeg" {
+		quality := ms.cfg.Mediaserver.Images.Quality
+		if quality <= 0 {
+			quality = 85
+		}
+		args = append(args, "-jpeg", "-jpegopt", fmt.Sprintf("quality=%d", quality))
+	} else {
+		args = append(args, "-png")
+	}
+
+	f := imageFormats[pp.format]
+	tmp, err := ms.TempFile(f.ext)
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	// pdftoppm appends the extension to the output prefix
+	args = append(args, input, strings.TrimSuffix(tmp.Name(), "."+f.ext))
+	start := time.Now()
+	if _, err := ms.runPoppler(ms.cfg.Mediaserver.PDF.Pdftoppm, args...); err != nil {
+		return nil, err
+	}
+	ms.logger.Infof("rendered %s/%s %s in %v", coll.name, signature, strings.Join(params, "/"), time.Since(start))
+	return ms.StoreDerivative(coll, signature, "page", strings.Join(params, "/"), f.mimetype, f.ext, tmp.Name())
+}
+
+var textParamSpecs = ParamSpecs{
+	{Name: "page", Kind: ParamInt, Min: 1},
+}
+
+// page<n>. without page the text of the whole document
+func parseTextParams(params []string) (int, error) {
+	page := 0
+	for _, param := range params {
+		var err error
+		switch {
+		case strings.HasPrefix(param, "page"):
+			page, err = parseDimension(param, "page")
+		default:
+			return 0, &ParamError{param, "unknown parameter"}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return page, nil
+}
+
+// plain text of a pdf master or of one page
+type textAction struct{}
+
+func (a *textAction) Name() string { return "text" }
+
+func (a *textAction) Params(params []string) ([]string, error) {
+	params, err := textParamSpecs.Canonical(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseTextParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (a *textAction) CacheKey(params []string) (string, string) {
+	return "text", strings.Join(params, "/")
+}
+
+func (a *textAction) NeedsMaster() bool { return true }
+
+func (a *textAction) Produce(ar *ActionRequest) error { return ar.ServeEntry(a) }
+
+func (a *textAction) Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error) {
+	page, err := parseTextParams(params)
+	if err != nil {
+		return nil, err
+	}
+	input, cleanup, _, err := ms.LocalMaster(coll, signature)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	args := []string{"-enc", "UTF-8"}
+	if page > 0 {
+		doc, err := ms.probePDF(input, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := doc.checkPage(page); err != nil {
+			return nil, err
+		}
+		args = append(args, "-f", strconv.Itoa(page), "-l", strconv.Itoa(page))
+	}
+	tmp, err := ms.TempFile("txt")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	args = append(args, input, tmp.Name())
+	start := time.Now()
+	if _, err := ms.runPoppler(ms.cfg.Mediaserver.PDF.Pdftotext, args...); err != nil {
+		return nil, err
+	}
+	ms.logger.Infof("extracted text of %s/%s %s in %v", coll.name, signature, strings.Join(params, "/"), time.Since(start))
+	return ms.StoreDerivative(coll, signature, "text", strings.Join(params, "/"), "text/plain; charset=utf-8", "txt", tmp.Name())
+}
@@ -0,0 +1,173 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// ReconcileEntry is a fullcache row whose file is missing or cannot be checked or a master without fullcache row
+type ReconcileEntry struct {
+	Collection string `json:"collection"`
+	Signature  string `json:"signature"`
+	Action     string `json:"action"`
+	Param      string `json:"param"`
+	URI        string `json:"uri"`
+	Error      string `json:"error,omitempty"`
+	Deleted    bool   `json:"deleted,omitempty"`
+}
+
+// ReconcileOrphan is a file on a storage which is not referenced by the fullcache table
+type ReconcileOrphan struct {
+	Storage string `json:"storage"`
+	URI     string `json:"uri"`
+	Size    int64  `json:"size"`
+}
+
+// ReconcileReport is the result of the comparison of the fullcache table with the storages
+type ReconcileReport struct {
+	Checked int               `json:"checked"`
+	Missing []ReconcileEntry  `json:"missing"`
+	Orphans []ReconcileOrphan `json:"orphans"`
+	Errors  []string          `json:"errors"`
+}
+
+// compare the fullcache table with the files on the storages and write a json report.
+// masters without a row in fullcache are reported as missing.
+// with deleteStale the rows of missing derivatives are removed from the cache table, fullcache is expected
+// to be a view of cache (see the mediaserver schema). master rows are never deleted
+func (ms *Mediaserver) Reconcile(w io.Writer, deleteStale bool) (report *ReconcileReport, err error) {
+	report = &ReconcileReport{
+		Missing: []ReconcileEntry{},
+		Orphans: []ReconcileOrphan{},
+		Errors:  []string{},
+	}
+	referenced := map[string]bool{}
+	// folders of derivatives with several files
+	referencedDirs := map[string]bool{}
+
+	rows, err := ms.db.Query("SELECT collection_id, signature, action, param, filebase, path FROM fullcache")
+	if err != nil {
+		return nil, fmt.Errorf("cannot query fullcache: %v", err)
+	}
+	type entry struct {
+		collectionId int
+		ReconcileEntry
+		filebase string
+		path     string
+	}
+	entries := []entry{}
+	for rows.Next() {
+		e := entry{}
+		if err := rows.Scan(&e.collectionId, &e.Signature, &e.Action, &e.Param, &e.filebase, &e.path); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("cannot scan fullcache: %v", err)
+		}
+		e.URI = storageURI(e.filebase, e.path)
+		referenced[e.URI] = true
+		if derivativeDirActions[e.Action] {
+			referencedDirs[storageURI(e.filebase, path.Dir(e.path))] = true
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// masters without files
+	rows, err = ms.db.Query("SELECT m.collectionid, m.signature FROM master m" +
+		" LEFT JOIN fullcache f ON f.collection_id=m.collectionid AND f.signature=m.signature AND f.action='master' AND f.param=''" +
+		" WHERE f.signature IS NULL")
+	if err != nil {
+		return nil, fmt.Errorf("cannot query masters: %v", err)
+	}
+	for rows.Next() {
+		e := ReconcileEntry{Action: "master", Error: "no fullcache row of the master"}
+		var collectionId int
+		if err := rows.Scan(&collectionId, &e.Signature); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("cannot scan masters: %v", err)
+		}
+		report.Checked++
+		e.Collection = fmt.Sprintf("#%d", collectionId)
+		if coll, err := ms.collections.ById(collectionId); err == nil {
+			e.Collection = coll.name
+		}
+		report.Missing = append(report.Missing, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// rows without files
+	for _, e := range entries {
+		report.Checked++
+		e.Collection = fmt.Sprintf("#%d", e.collectionId)
+		if coll, err := ms.collections.ById(e.collectionId); err == nil {
+			e.Collection = coll.name
+		}
+		fs, err := ms.storages.FS(e.filebase)
+		if err != nil {
+			e.Error = err.Error()
+			report.Missing = append(report.Missing, e.ReconcileEntry)
+			continue
+		}
+		_, err = fs.Stat(e.path)
+		if err == nil {
+			continue
+		}
+		e.Error = err.Error()
+		if os.IsNotExist(err) && deleteStale && e.Action != "master" {
+			res, err := ms.db.Exec("DELETE FROM cache WHERE collection_id=? AND signature=? AND action=? AND param=?", e.collectionId, e.Signature, e.Action, e.Param)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("cannot delete %s/%s/%s/%s: %v", e.Collection, e.Signature, e.Action, e.Param, err))
+			} else if n, _ := res.RowsAffected(); n == 0 {
+				report.Errors = append(report.Errors, fmt.Sprintf("cannot delete %s/%s/%s/%s: no row in table cache", e.Collection, e.Signature, e.Action, e.Param))
+			} else {
+				e.Deleted = true
+			}
+		}
+		report.Missing = append(report.Missing, e.ReconcileEntry)
+	}
+
+	// files without rows
+	for _, storage := range ms.storages.All() {
+		ms.logger.Debugf("reconcile storage %s - %s", storage.name, storage.filebase)
+		fs, err := ms.storages.FS(storage.filebase)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("cannot access storage %s: %v", storage.name, err))
+			continue
+		}
+		err = walkStorage(fs, "", func(name string, info os.FileInfo) error {
+			uri := storageURI(storage.filebase, name)
+			if !referenced[uri] && !inReferencedDir(referencedDirs, storage.filebase, name) {
+				report.Orphans = append(report.Orphans, ReconcileOrphan{Storage: storage.name, URI: uri, Size: info.Size()})
+			}
+			return nil
+		})
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("cannot list storage %s: %v", storage.name, err))
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// file is below the folder of a derivative with several files
+func inReferencedDir(dirs map[string]bool, filebase string, name string) bool {
+	for dir := path.Dir(path.Clean("/" + name)); dir != "/"; dir = path.Dir(dir) {
+		if dirs[storageURI(filebase, dir)] {
+			return true
+		}
+	}
+	return false
+}
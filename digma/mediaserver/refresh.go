@@ -0,0 +1,67 @@
+package mediaserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// result of a refresh
+type RefreshResult struct {
+	Collections int      `json:"collections"`
+	Storages    int      `json:"storages"`
+	Errors      []string `json:"errors"`
+}
+
+// reload collections and storages. the last good state is kept if the database is not reachable
+func (ms *Mediaserver) Refresh() *RefreshResult {
+	result := &RefreshResult{Errors: []string{}}
+	if err := ms.collections.Init(); err != nil {
+		ms.logger.Errorf("cannot refresh collections: %v", err)
+		result.Errors = append(result.Errors, err.Error())
+	}
+	if err := ms.storages.Init(); err != nil {
+		ms.logger.Errorf("cannot refresh storages: %v", err)
+		result.Errors = append(result.Errors, err.Error())
+	}
+	result.Collections = ms.collections.Len()
+	result.Storages = ms.storages.Len()
+	return result
+}
+
+// default interval of the refresh
+const refreshInterval = 10 * time.Minute
+
+// refresh collections and storages periodically. interval 0 is the default of 10 minutes, a negative interval disables the refresh
+func (ms *Mediaserver) StartRefresh(interval time.Duration) {
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = refreshInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			result := ms.Refresh()
+			ms.logger.Debugf("refresh: %v collections, %v storages", result.Collections, result.Storages)
+		}
+	}()
+}
+
+// refresh on demand. the lookup cache is cleared as well
+func (ms *Mediaserver) HandlerReload(writer http.ResponseWriter, req *http.Request) (err error) {
+	if !ms.checkAdmin(writer, req) {
+		return fmt.Errorf("access denied")
+	}
+	result := ms.Refresh()
+	ms.lookup.Purge()
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if len(result.Errors) > 0 {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(writer).Encode(result)
+}
@@ -0,0 +1,73 @@
+package mediaserver
+
+import (
+	"strings"
+
+	"github.com/je4/mediaserver2/digma/data"
+)
+
+// scripts of replayweb.page for web archives. other params are handled like derivatives
+type replayAction struct{}
+
+var replayScripts = map[string][]byte{
+	"sw.js": data.Sw_js,
+	"ui.js": data.Ui_js,
+}
+
+func (a *replayAction) Name() string { return "replay" }
+
+func (a *replayAction) Params(params []string) ([]string, error) { return sortedParams(params), nil }
+
+// the scripts are no derivatives
+func (a *replayAction) CacheKey(params []string) (string, string) {
+	if len(params) == 1 && replayScripts[params[0]] != nil {
+		return "", ""
+	}
+	return "replay", strings.Join(params, "/")
+}
+
+func (a *replayAction) NeedsMaster() bool { return false }
+
+func (a *replayAction) Produce(ar *ActionRequest) error {
+	if len(ar.Params) == 1 && replayScripts[ar.Params[0]] != nil {
+		ar.Writer.Header().Set("Content-Type", "text/javascript")
+		_, err := ar.Writer.Write(replayScripts[ar.Params[0]])
+		return err
+	}
+	return ar.ServeEntry(nil)
+}
+
+// html page with the replayweb.page viewer for the master
+type webrecorderAction struct{}
+
+func (a *webrecorderAction) Name() string { return "webrecorder" }
+
+func (a *webrecorderAction) Params(params []string) ([]string, error) {
+	return sortedParams(params), nil
+}
+
+func (a *webrecorderAction) CacheKey(params []string) (string, string) { return "", "" }
+
+func (a *webrecorderAction) NeedsMaster() bool { return false }
+
+func (a *webrecorderAction) Produce(ar *ActionRequest) error {
+	html := `
+<html>
+<head>
+</head>
+<body>
+	<replay-web-page
+		source="master"
+		%%URL%%
+	</replay-web-page>
+	<script src="replay/ui.js"></script>
+</body>
+</html>
+`
+	if url := ar.Request.URL.Query().Get("url"); url != "" {
+		html = strings.ReplaceAll(html, "%%URL%%", "url=\""+url+"\"")
+	}
+	ar.Writer.Header().Set("Content-Type", "text/html")
+	_, err := ar.Writer.Write([]byte(html))
+	return err
+}
@@ -0,0 +1,219 @@
+package mediaserver
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageFS gives access to the files below the filebase of a storage.
+// names are slash separated and relative to the filebase
+type StorageFS interface {
+	// file information about name
+	Stat(name string) (os.FileInfo, error)
+	// open name for reading. the result supports seeking and ranged reads
+	Open(name string) (StorageFile, error)
+	// list the content of folder name
+	ReadDir(name string) ([]os.FileInfo, error)
+}
+
+// WritableFS is implemented by storages which can store derivatives
+type WritableFS interface {
+	// create or replace name. the content is visible after a successful Close
+	Create(name string) (io.WriteCloser, error)
+}
+
+// LocalFS is implemented by storages with files in the local filesystem.
+// external programs like ffmpeg read them without a temporary copy
+type LocalFS interface {
+	// path of name in the local filesystem
+	LocalPath(name string) (string, error)
+}
+
+// StorageFile is a readable file of a StorageFS. *os.File implements it
+type StorageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// file information for storages without native os.FileInfo (objects, common prefixes, ...)
+type storageFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	etag    string
+}
+
+func (fi *storageFileInfo) Name() string       { return fi.name }
+func (fi *storageFileInfo) Size() int64        { return fi.size }
+func (fi *storageFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *storageFileInfo) IsDir() bool        { return fi.dir }
+func (fi *storageFileInfo) Sys() interface{}   { return nil }
+func (fi *storageFileInfo) ETag() string       { return fi.etag }
+func (fi *storageFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// StorageDriver creates a StorageFS for a filebase url
+type StorageDriver func(base *url.URL, cfg *CfgMediaserver) (StorageFS, error)
+
+var (
+	storageDrivers     = map[string]StorageDriver{}
+	storageDriversLock sync.RWMutex
+)
+
+// RegisterStorageDriver makes a driver available for the url scheme
+func RegisterStorageDriver(scheme string, driver StorageDriver) {
+	storageDriversLock.Lock()
+	defer storageDriversLock.Unlock()
+	storageDrivers[strings.ToLower(scheme)] = driver
+}
+
+// NewStorageFS creates a StorageFS for filebase. filebases without scheme are local paths
+func NewStorageFS(filebase string, cfg *CfgMediaserver) (StorageFS, error) {
+	base, err := url.Parse(filebase)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse filebase %s: %v", filebase, err)
+	}
+	scheme := strings.ToLower(base.Scheme)
+	if scheme == "" {
+		scheme = "file"
+	}
+	// ocfl storage roots are located on another storage
+	if strings.HasPrefix(scheme, "ocfl+") {
+		inner := *base
+		inner.Scheme = strings.TrimPrefix(scheme, "ocfl+")
+		fs, err := NewStorageFS(inner.String(), cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newOCFLFS(fs)
+	}
+	storageDriversLock.RLock()
+	driver, ok := storageDrivers[scheme]
+	storageDriversLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no storage driver for scheme %s in %s", scheme, filebase)
+	}
+	return driver(base, cfg)
+}
+
+// uri of a file on a storage
+func storageURI(filebase string, name string) string {
+	return strings.TrimRight(filebase, "/") + "/" + strings.TrimLeft(path.Clean("/"+name), "/")
+}
+
+// call fn for all files below dir. names are relative to the filebase
+func walkStorage(fs StorageFS, dir string, fn func(name string, info os.FileInfo) error) error {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := walkStorage(fs, name, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(name, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterStorageDriver("file", newLocalFS)
+}
+
+// local filesystem
+type localFS struct {
+	root string
+}
+
+func newLocalFS(base *url.URL, cfg *CfgMediaserver) (StorageFS, error) {
+	return &localFS{root: filepath.FromSlash(base.Path)}, nil
+}
+
+// builds the local path. name cannot leave the root
+func (lfs *localFS) path(name string) string {
+	return filepath.Join(lfs.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (lfs *localFS) LocalPath(name string) (string, error) {
+	return lfs.path(name), nil
+}
+
+func (lfs *localFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(lfs.path(name))
+}
+
+func (lfs *localFS) Open(name string) (StorageFile, error) {
+	return os.Open(lfs.path(name))
+}
+
+func (lfs *localFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(lfs.path(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// file which replaces its target on Close
+type localWriter struct {
+	*os.File
+	target string
+	closed bool
+}
+
+func (lw *localWriter) Close() error {
+	if lw.closed {
+		return nil
+	}
+	lw.closed = true
+	if err := lw.File.Close(); err != nil {
+		os.Remove(lw.File.Name())
+		return err
+	}
+	if err := os.Rename(lw.File.Name(), lw.target); err != nil {
+		os.Remove(lw.File.Name())
+		return err
+	}
+	return nil
+}
+
+func (lfs *localFS) Create(name string) (io.WriteCloser, error) {
+	target := lfs.path(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(target), ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: file, target: target}, nil
+}
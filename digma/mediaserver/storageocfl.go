@@ -0,0 +1,366 @@
+package mediaserver
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VersionedFS is implemented by storages which keep several versions of a file.
+// an empty version means the latest one
+type VersionedFS interface {
+	StatVersion(name string, version string) (os.FileInfo, error)
+	OpenVersion(name string, version string) (StorageFile, error)
+}
+
+// storage driver for OCFL storage roots (https://ocfl.io)
+// filebase format: ocfl+<scheme>://... e.g. ocfl+file:///data/ocfl or ocfl+s3://bucket/ocfl
+// names have the format <url escaped object id>/<logical path>
+type ocflFS struct {
+	base        StorageFS
+	layout      string
+	tupleSize   int
+	tuples      int
+	shortRoot   bool
+	digest      string
+	inventories map[string]*ocflInventory
+	m           sync.Mutex
+}
+
+type ocflVersion struct {
+	Created time.Time           `json:"created"`
+	Message string              `json:"message"`
+	State   map[string][]string `json:"state"`
+}
+
+type ocflInventory struct {
+	ID               string                 `json:"id"`
+	Type             string                 `json:"type"`
+	DigestAlgorithm  string                 `json:"digestAlgorithm"`
+	Head             string                 `json:"head"`
+	ContentDirectory string                 `json:"contentDirectory"`
+	Manifest         map[string][]string    `json:"manifest"`
+	Versions         map[string]ocflVersion `json:"versions"`
+
+	root    string
+	size    int64
+	modTime time.Time
+}
+
+type ocflLayout struct {
+	Extension string `json:"extension"`
+}
+
+type ocflLayoutConfig struct {
+	DigestAlgorithm string `json:"digestAlgorithm"`
+	TupleSize       int    `json:"tupleSize"`
+	NumberOfTuples  int    `json:"numberOfTuples"`
+	ShortObjectRoot bool   `json:"shortObjectRoot"`
+}
+
+func newOCFLFS(base StorageFS) (StorageFS, error) {
+	ofs := &ocflFS{
+		base:        base,
+		tupleSize:   3,
+		tuples:      3,
+		digest:      "sha256",
+		inventories: make(map[string]*ocflInventory),
+	}
+	layout := &ocflLayout{}
+	if err := ofs.readJSON("ocfl_layout.json", layout); err != nil {
+		if os.IsNotExist(err) {
+			// no layout, object ids are paths relative to the storage root
+			return ofs, nil
+		}
+		return nil, err
+	}
+	ofs.layout = layout.Extension
+	switch ofs.layout {
+	case "0002-flat-direct-storage-layout":
+	case "0004-hashed-n-tuple-storage-layout":
+		cfg := &ocflLayoutConfig{}
+		if err := ofs.readJSON(path.Join("extensions", ofs.layout, "config.json"), cfg); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if cfg.DigestAlgorithm != "" {
+			ofs.digest = cfg.DigestAlgorithm
+		}
+		if cfg.TupleSize > 0 {
+			ofs.tupleSize = cfg.TupleSize
+			ofs.tuples = cfg.NumberOfTuples
+		}
+		ofs.shortRoot = cfg.ShortObjectRoot
+	default:
+		return nil, fmt.Errorf("unsupported ocfl storage layout %s", ofs.layout)
+	}
+	return ofs, nil
+}
+
+func (ofs *ocflFS) readJSON(name string, v interface{}) error {
+	file, err := ofs.base.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(v); err != nil {
+		return fmt.Errorf("cannot decode %s: %v", name, err)
+	}
+	return nil
+}
+
+// path of the object root relative to the storage root
+func (ofs *ocflFS) objectRoot(id string) (string, error) {
+	if ofs.layout != "0004-hashed-n-tuple-storage-layout" {
+		return id, nil
+	}
+	var h hash.Hash
+	switch ofs.digest {
+	case "md5":
+		h = md5.New()
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported layout digest algorithm %s", ofs.digest)
+	}
+	h.Write([]byte(id))
+	digest := hex.EncodeToString(h.Sum(nil))
+	parts := []string{}
+	for i := 0; i < ofs.tuples; i++ {
+		parts = append(parts, digest[i*ofs.tupleSize:(i+1)*ofs.tupleSize])
+	}
+	if ofs.shortRoot {
+		parts = append(parts, digest[ofs.tuples*ofs.tupleSize:])
+	} else {
+		parts = append(parts, digest)
+	}
+	return path.Join(parts...), nil
+}
+
+// split name into object id and logical path
+func ocflSplit(name string) (id string, logical string, err error) {
+	name = strings.TrimLeft(name, "/")
+	parts := strings.SplitN(name, "/", 2)
+	id, err = url.PathUnescape(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid object id in %s: %v", name, err)
+	}
+	if len(parts) > 1 {
+		logical = strings.Trim(parts[1], "/")
+	}
+	return id, logical, nil
+}
+
+// get the inventory of an object. cached inventories are checked against the inventory file
+func (ofs *ocflFS) inventory(id string) (*ocflInventory, error) {
+	root, err := ofs.objectRoot(id)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Join(root, "inventory.json")
+	stat, err := ofs.base.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	ofs.m.Lock()
+	inv, ok := ofs.inventories[root]
+	ofs.m.Unlock()
+	if ok && inv.size == stat.Size() && inv.modTime.Equal(stat.ModTime()) {
+		return inv, nil
+	}
+	inv = &ocflInventory{}
+	if err := ofs.readJSON(name, inv); err != nil {
+		return nil, err
+	}
+	if inv.ID != id {
+		return nil, fmt.Errorf("object root %s contains object %s instead of %s", root, inv.ID, id)
+	}
+	inv.root = root
+	inv.size = stat.Size()
+	inv.modTime = stat.ModTime()
+	ofs.m.Lock()
+	ofs.inventories[root] = inv
+	ofs.m.Unlock()
+	return inv, nil
+}
+
+// physical path of a logical file in a version
+func (ofs *ocflFS) resolve(name string, version string) (string, error) {
+	id, logical, err := ocflSplit(name)
+	if err != nil {
+		return "", err
+	}
+	inv, err := ofs.inventory(id)
+	if err != nil {
+		return "", err
+	}
+	if version == "" {
+		version = inv.Head
+	}
+	v, ok := inv.Versions[version]
+	if !ok {
+		return "", &os.PathError{Op: "open", Path: name + "@" + version, Err: os.ErrNotExist}
+	}
+	for digest, paths := range v.State {
+		for _, p := range paths {
+			if p != logical {
+				continue
+			}
+			contents := inv.Manifest[digest]
+			if len(contents) == 0 {
+				return "", fmt.Errorf("digest %s of %s not in manifest of %s", digest, logical, id)
+			}
+			return path.Join(inv.root, contents[0]), nil
+		}
+	}
+	return "", &os.PathError{Op: "open", Path: name + "@" + version, Err: os.ErrNotExist}
+}
+
+func (ofs *ocflFS) StatVersion(name string, version string) (os.FileInfo, error) {
+	p, err := ofs.resolve(name, version)
+	if err != nil {
+		return nil, err
+	}
+	return ofs.base.Stat(p)
+}
+
+func (ofs *ocflFS) OpenVersion(name string, version string) (StorageFile, error) {
+	p, err := ofs.resolve(name, version)
+	if err != nil {
+		return nil, err
+	}
+	return ofs.base.Open(p)
+}
+
+// ocfl roots in the local filesystem are local as well
+func (ofs *ocflFS) LocalPath(name string) (string, error) {
+	lfs, ok := ofs.base.(LocalFS)
+	if !ok {
+		return "", fmt.Errorf("ocfl root of %s is not local", name)
+	}
+	p, err := ofs.resolve(name, "")
+	if err != nil {
+		return "", err
+	}
+	return lfs.LocalPath(p)
+}
+
+func (ofs *ocflFS) Stat(name string) (os.FileInfo, error) {
+	return ofs.StatVersion(name, "")
+}
+
+func (ofs *ocflFS) Open(name string) (StorageFile, error) {
+	return ofs.OpenVersion(name, "")
+}
+
+// the root lists the object ids, objects list the logical paths of the latest version
+func (ofs *ocflFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		ids, err := ofs.objectIDs("")
+		if err != nil {
+			return nil, err
+		}
+		infos := []os.FileInfo{}
+		for _, id := range ids {
+			infos = append(infos, &storageFileInfo{name: url.PathEscape(id), dir: true})
+		}
+		return infos, nil
+	}
+	id, logical, err := ocflSplit(name)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := ofs.inventory(id)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if logical != "" {
+		prefix = logical + "/"
+	}
+	entries := map[string]os.FileInfo{}
+	for digest, paths := range inv.Versions[inv.Head].State {
+		for _, p := range paths {
+			if !strings.HasPrefix(p, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(p, prefix)
+			if i := strings.Index(rest, "/"); i >= 0 {
+				entries[rest[:i]] = &storageFileInfo{name: rest[:i], dir: true}
+				continue
+			}
+			info := &storageFileInfo{name: rest, modTime: inv.Versions[inv.Head].Created}
+			if contents := inv.Manifest[digest]; len(contents) > 0 {
+				if stat, err := ofs.base.Stat(path.Join(inv.root, contents[0])); err == nil {
+					info.size = stat.Size()
+					info.modTime = stat.ModTime()
+				}
+			}
+			entries[rest] = info
+		}
+	}
+	names := make([]string, 0, len(entries))
+	for n := range entries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, n := range names {
+		infos = append(infos, entries[n])
+	}
+	return infos, nil
+}
+
+// find all objects below dir. object roots contain a 0=ocfl_object_* namaste file
+func (ofs *ocflFS) objectIDs(dir string) ([]string, error) {
+	infos, err := ofs.base.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), "0=ocfl_object_") {
+			inv := &ocflInventory{}
+			if err := ofs.readJSON(path.Join(dir, "inventory.json"), inv); err != nil {
+				return nil, err
+			}
+			return []string{inv.ID}, nil
+		}
+	}
+	ids := []string{}
+	for _, info := range infos {
+		if !info.IsDir() || (dir == "" && info.Name() == "extensions") {
+			continue
+		}
+		sub, err := ofs.objectIDs(path.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, sub...)
+	}
+	return ids, nil
+}
+
+// open a storage file in the given version. storages without versions only know the latest one
+func openStorageVersion(fs StorageFS, name string, version string) (StorageFile, error) {
+	if version == "" {
+		return fs.Open(name)
+	}
+	vfs, ok := fs.(VersionedFS)
+	if !ok {
+		return nil, fmt.Errorf("storage of %s has no versions", name)
+	}
+	return vfs.OpenVersion(name, version)
+}
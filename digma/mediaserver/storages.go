@@ -3,8 +3,9 @@ package mediaserver
 import (
 	"database/sql"
 	"errors"
-	"log"
+	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
 	"sync"
 )
@@ -12,7 +13,9 @@ import (
 // the storages
 type Storages struct {
 	db       *sql.DB
+	cfg      *CfgMediaserver
 	storages map[int]Storage
+	fss      map[string]StorageFS
 	m        sync.RWMutex
 }
 
@@ -25,52 +28,63 @@ type Storage struct {
 
 // Create a new Mediaserver
 // db Database Handle
-func NewStorages(db *sql.DB) *Storages {
+// cfg configuration of the storage drivers
+func NewStorages(db *sql.DB, cfg *CfgMediaserver) (*Storages, error) {
 	storages := &Storages{
-		db: db,
+		db:       db,
+		cfg:      cfg,
+		storages: make(map[int]Storage),
+		fss:      make(map[string]StorageFS),
 	}
-	storages.Init()
-	return storages
+	err := storages.Init()
+	return storages, err
 }
 
 // constructor
-// load all collections into a map
+// load all storages into a new map and swap it with the current one.
+// on errors the current storages are kept
 func (stors *Storages) Init() (err error) {
-	stors.m.Lock()
-	defer stors.m.Unlock()
 	var (
 		id       int
 		name     string
 		filebase string
 		secret   sql.NullString
 	)
-	// initialize maps
-	stors.storages = make(map[int]Storage)
+	storages := make(map[int]Storage)
 	// get all storages
 	rows, err := stors.db.Query("select storageid as id, name, filebase, jwtkey from storage")
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("cannot query storages: %v", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		err := rows.Scan(&id, &name, &filebase, &secret)
 		if err != nil {
-			log.Fatal(err)
-			break
+			return fmt.Errorf("cannot scan storage: %v", err)
 		}
-		// add collection to map
-		stors.storages[id] = Storage{name: name,
+		// add storage to map
+		storages[id] = Storage{name: name,
 			id:       id,
 			filebase: filebase,
 			secret:   secret}
 	}
 	err = rows.Err()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("cannot read storages: %v", err)
 	}
+	stors.m.Lock()
+	stors.storages = storages
+	stors.m.Unlock()
 	return
 }
 
+// number of storages
+func (stors *Storages) Len() int {
+	stors.m.RLock()
+	defer stors.m.RUnlock()
+	return len(stors.storages)
+}
+
 func (stors *Storages) ById(id int) (s Storage, err error) {
 	stors.m.RLock()
 	defer stors.m.RUnlock()
@@ -93,6 +107,36 @@ func (stors *Storages) ByName(name string) (s Storage, err error) {
 	return
 }
 
+// all storages ordered by id
+func (stors *Storages) All() []Storage {
+	stors.m.RLock()
+	defer stors.m.RUnlock()
+	list := make([]Storage, 0, len(stors.storages))
+	for _, s := range stors.storages {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// get the StorageFS of a filebase. the filesystems are created on first use
+func (stors *Storages) FS(filebase string) (StorageFS, error) {
+	stors.m.RLock()
+	fs, ok := stors.fss[filebase]
+	stors.m.RUnlock()
+	if ok {
+		return fs, nil
+	}
+	fs, err := NewStorageFS(filebase, stors.cfg)
+	if err != nil {
+		return nil, err
+	}
+	stors.m.Lock()
+	stors.fss[filebase] = fs
+	stors.m.Unlock()
+	return fs, nil
+}
+
 func (s *Storage) GetPath() (string, error) {
 	_url, err := url.Parse(s.filebase)
 	if err != nil {
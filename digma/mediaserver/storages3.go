@@ -0,0 +1,437 @@
+package mediaserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storage driver for S3 compatible object stores (AWS, MinIO, ...)
+// filebase format: s3://bucket/prefix
+// endpoint and credentials are configured in [mediaserver.s3]
+type s3FS struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	region    string
+}
+
+func init() {
+	RegisterStorageDriver("s3", newS3FS)
+}
+
+func newS3FS(base *url.URL, cfg *CfgMediaserver) (StorageFS, error) {
+	if cfg.S3.Endpoint == "" {
+		return nil, fmt.Errorf("no s3 endpoint configured for %s", base.String())
+	}
+	endpoint, err := url.Parse(cfg.S3.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse s3 endpoint %s: %v", cfg.S3.Endpoint, err)
+	}
+	if base.Host == "" {
+		return nil, fmt.Errorf("no bucket in %s", base.String())
+	}
+	region := cfg.S3.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3FS{
+		client:    &http.Client{},
+		endpoint:  endpoint,
+		bucket:    base.Host,
+		prefix:    strings.Trim(base.Path, "/"),
+		accessKey: cfg.S3.AccessKey,
+		secretKey: cfg.S3.SecretKey,
+		region:    region,
+	}, nil
+}
+
+// object key of name
+func (s3 *s3FS) key(name string) string {
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if s3.prefix == "" {
+		return name
+	}
+	if name == "" {
+		return s3.prefix
+	}
+	return s3.prefix + "/" + name
+}
+
+// uri encoding as required by signature v4
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// create a signed (aws signature v4) request for an object key. path style addressing is used
+func (s3 *s3FS) newRequest(method string, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	canonicalURI := "/" + s3Escape(s3.bucket, true)
+	if key != "" {
+		canonicalURI += "/" + s3Escape(key, false)
+	}
+	canonicalURI = strings.TrimRight(s3.endpoint.Path, "/") + canonicalURI
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	queryParts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			queryParts = append(queryParts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	canonicalQuery := strings.Join(queryParts, "&")
+
+	req, err := http.NewRequest(method, s3.endpoint.Scheme+"://"+s3.endpoint.Host+canonicalURI, body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = canonicalURI
+	req.URL.RawQuery = canonicalQuery
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := "UNSIGNED-PAYLOAD"
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{method, canonicalURI, canonicalQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s3.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s3.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s3.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3.accessKey, scope, signedHeaders, signature))
+	return req, nil
+}
+
+// execute request and map s3 errors
+func (s3 *s3FS) do(req *http.Request, op string, name string) (*http.Response, error) {
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err = os.ErrNotExist
+	case http.StatusForbidden:
+		err = os.ErrPermission
+	case http.StatusRequestedRangeNotSatisfiable:
+		err = io.EOF
+	default:
+		err = fmt.Errorf("s3 error %s: %s", resp.Status, string(msg))
+	}
+	return nil, &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (s3 *s3FS) Stat(name string) (os.FileInfo, error) {
+	key := s3.key(name)
+	req, err := s3.newRequest("HEAD", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s3.do(req, "stat", name)
+	if err == nil {
+		resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &storageFileInfo{
+			name:    path.Base(key),
+			size:    resp.ContentLength,
+			modTime: modTime,
+			etag:    resp.Header.Get("ETag"),
+		}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// no object. maybe it's a folder
+	result, err2 := s3.list(key, "", 1)
+	if err2 != nil || (len(result.Contents) == 0 && len(result.CommonPrefixes) == 0) {
+		return nil, err
+	}
+	return &storageFileInfo{name: path.Base(key), dir: true}, nil
+}
+
+func (s3 *s3FS) Open(name string) (StorageFile, error) {
+	info, err := s3.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{fs: s3, name: name, key: s3.key(name), info: info.(*storageFileInfo)}, nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// one page of ListObjectsV2 for the folder key
+func (s3 *s3FS) list(key string, continuationToken string, maxKeys int) (*s3ListResult, error) {
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	query.Set("delimiter", "/")
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+	req, err := s3.newRequest("GET", "", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s3.do(req, "readdir", key)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &s3ListResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("cannot decode object list of %s: %v", key, err)
+	}
+	return result, nil
+}
+
+func (s3 *s3FS) ReadDir(name string) ([]os.FileInfo, error) {
+	key := s3.key(name)
+	infos := []os.FileInfo{}
+	token := ""
+	for {
+		result, err := s3.list(key, token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range result.CommonPrefixes {
+			infos = append(infos, &storageFileInfo{name: path.Base(strings.TrimRight(p.Prefix, "/")), dir: true})
+		}
+		for _, c := range result.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				continue
+			}
+			infos = append(infos, &storageFileInfo{name: path.Base(c.Key), size: c.Size, modTime: c.LastModified, etag: c.ETag})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return infos, nil
+}
+
+// an s3 object opened for reading
+// sequential reads share one streaming GET, seeks and ReadAt use range requests
+type s3File struct {
+	fs      *s3FS
+	name    string
+	key     string
+	info    *storageFileInfo
+	pos     int64
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// get object content starting at offset. length < 0 means up to the end
+func (f *s3File) get(offset int64, length int64) (io.ReadCloser, error) {
+	req, err := f.fs.newRequest("GET", f.key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	resp, err := f.fs.do(req, "read", f.name)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.info.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errors.New("is a folder")}
+	}
+	if f.pos >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body != nil && f.bodyPos != f.pos {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.body == nil {
+		body, err := f.get(f.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+		f.bodyPos = f.pos
+	}
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	f.bodyPos = f.pos
+	if err == io.EOF {
+		f.body.Close()
+		f.body = nil
+		if f.pos < f.info.size {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	length := int64(len(p))
+	if off+length > f.info.size {
+		length = f.info.size - off
+	}
+	body, err := f.get(off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:length])
+	if err == nil && int64(n) < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = f.pos + offset
+	case io.SeekEnd:
+		pos = f.info.size + offset
+	default:
+		return f.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return f.pos, fmt.Errorf("negative position %d", pos)
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		err := f.body.Close()
+		f.body = nil
+		return err
+	}
+	return nil
+}
+
+// content is buffered in a temporary file and uploaded on Close
+type s3Writer struct {
+	*os.File
+	fs     *s3FS
+	name   string
+	closed bool
+}
+
+func (sw *s3Writer) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	defer os.Remove(sw.File.Name())
+	defer sw.File.Close()
+	size, err := sw.File.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := sw.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := sw.fs.newRequest("PUT", sw.fs.key(sw.name), nil, sw.File)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := sw.fs.do(req, "write", sw.name)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s3 *s3FS) Create(name string) (io.WriteCloser, error) {
+	file, err := os.CreateTemp("", "mediasrv2-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{File: file, fs: s3, name: name}, nil
+}
@@ -0,0 +1,267 @@
+package mediaserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sample rate of the decoded audio
+const waveformRate = 44100
+
+// limits of the peak data. the peaks are held in memory
+const (
+	minSamplesPerPixel = 32
+	maxWaveformPeaks   = 10000000
+)
+
+// peak data in the json format of audiowaveform (https://github.com/bbc/audiowaveform)
+type waveformData struct {
+	Version         int   `json:"version"`
+	Channels        int   `json:"channels"`
+	SampleRate      int   `json:"sample_rate"`
+	SamplesPerPixel int   `json:"samples_per_pixel"`
+	Bits            int   `json:"bits"`
+	Length          int   `json:"length"`
+	Data            []int `json:"data"`
+}
+
+var waveformParamSpecs = ParamSpecs{
+	{Name: "format", Kind: ParamEnum, Values: []string{"json", "png"}},
+	{Name: "bits", Kind: ParamEnum, Values: []string{"8", "16"}},
+	{Name: "samplesperpixel", Kind: ParamInt, Min: minSamplesPerPixel},
+	{Name: "width", Kind: ParamInt, Min: 1, Max: 10000},
+	{Name: "height", Kind: ParamInt, Min: 1, Max: 10000},
+}
+
+type waveformParams struct {
+	format          string
+	bits            int
+	samplesPerPixel int
+	width           int
+	height          int
+}
+
+// format<json|png>, bits<8|16>, samplesperpixel<n>, width<w>, height<h>. width and height are for png only
+func parseWaveformParams(params []string) (*waveformParams, error) {
+	wp := &waveformParams{format: "json", bits: 16}
+	for _, param := range params {
+		var err error
+		switch {
+		case strings.HasPrefix(param, "format"):
+			wp.format = strings.TrimPrefix(param, "format")
+			if wp.format != "json" && wp.format != "png" {
+				return nil, &ParamError{param, "unsupported format"}
+			}
+		case strings.HasPrefix(param, "bits"):
+			wp.bits, err = strconv.Atoi(strings.TrimPrefix(param, "bits"))
+			if err != nil || (wp.bits != 8 && wp.bits != 16) {
+				return nil, &ParamError{param, "expected 8 or 16 bits"}
+			}
+		case strings.HasPrefix(param, "samplesperpixel"):
+			wp.samplesPerPixel, err = parseDimension(param, "samplesperpixel")
+		case strings.HasPrefix(param, "width"):
+			wp.width, err = parseDimension(param, "width")
+		case strings.HasPrefix(param, "height"):
+			wp.height, err = parseDimension(param, "height")
+		default:
+			return nil, &ParamError{param, "unknown parameter"}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch wp.format {
+	case "json":
+		if wp.width > 0 || wp.height > 0 {
+			return nil, &ParamError{"formatjson", "width and height need formatpng"}
+		}
+		if wp.samplesPerPixel == 0 {
+			wp.samplesPerPixel = 256
+		}
+	case "png":
+		if wp.samplesPerPixel > 0 {
+			return nil, &ParamError{"formatpng", "samplesperpixel needs formatjson"}
+		}
+		if wp.width == 0 {
+			wp.width = 800
+		}
+		if wp.height == 0 {
+			wp.height = 250
+		}
+		if wp.width > 10000 || wp.height > 10000 {
+			return nil, &ParamError{fmt.Sprintf("width%d/height%d", wp.width, wp.height), "image too large"}
+		}
+	}
+	return wp, nil
+}
+
+// waveform of an audio master as peak data or image
+type waveformAction struct{}
+
+func (a *waveformAction) Name() string { return "waveform" }
+
+func (a *waveformAction) Params(params []string) ([]string, error) {
+	params, err := waveformParamSpecs.Canonical(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseWaveformParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func (a *waveformAction) CacheKey(params []string) (string, string) {
+	return "waveform", strings.Join(params, "/")
+}
+
+func (a *waveformAction) NeedsMaster() bool { return true }
+
+func (a *waveformAction) Produce(ar *ActionRequest) error { return ar.ServeEntry(a) }
+
+func (a *waveformAction) Generate(ms *Mediaserver, coll Collection, signature string, params []string) (*Entry, error) {
+	wp, err := parseWaveformParams(params)
+	if err != nil {
+		return nil, err
+	}
+	input, cleanup, _, err := ms.LocalMaster(coll, signature)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// the image needs one min/max pair per column
+	samplesPerPixel := wp.samplesPerPixel
+	if wp.format == "png" {
+		duration := ms.probeDuration(input)
+		if duration <= 0 {
+			return nil, fmt.Errorf("cannot get duration of %s/%s", coll.name, signature)
+		}
+		samplesPerPixel = max(int(duration*waveformRate)/wp.width, 1)
+	}
+	start := time.Now()
+	peaks, err := ms.audioPeaks(input, samplesPerPixel)
+	if err != nil {
+		return nil, err
+	}
+	if len(peaks) == 0 {
+		return nil, fmt.Errorf("%s/%s has no audio stream", coll.name, signature)
+	}
+	ms.logger.Infof("waveform of %s/%s with %d peaks in %v", coll.name, signature, len(peaks)/2, time.Since(start))
+
+	var mimetype, ext string
+	tmp, err := ms.TempFile(wp.format)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	switch wp.format {
+	case "json":
+		mimetype, ext = "application/json", "json"
+		data := &waveformData{
+			Version:         2,
+			Channels:        1,
+			SampleRate:      waveformRate,
+			SamplesPerPixel: samplesPerPixel,
+			Bits:            wp.bits,
+			Length:          len(peaks) / 2,
+			Data:            peaks,
+		}
+		if wp.bits == 8 {
+			for i, peak := range data.Data {
+				data.Data[i] = peak >> 8
+			}
+		}
+		err = json.NewEncoder(tmp).Encode(data)
+	case "png":
+		mimetype, ext = "image/png", "png"
+		err = png.Encode(tmp, drawWaveform(peaks, wp.width, wp.height))
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("cannot write waveform: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	return ms.StoreDerivative(coll, signature, "waveform", strings.Join(params, "/"), mimetype, ext, tmp.Name())
+}
+
+// min and max of every block of samples as 16 bit values. all channels are mixed to mono.
+// fails if there are more than maxWaveformPeaks blocks
+func (ms *Mediaserver) audioPeaks(input string, samplesPerPixel int) ([]int, error) {
+	peaks := []int{}
+	args := []string{"-nostdin", "-v", "error", "-i", input, "-vn", "-ac", "1", "-ar", strconv.Itoa(waveformRate), "-f", "s16le", "-acodec", "pcm_s16le", "-"}
+	err := ms.execFFmpeg(args, func(stdout io.Reader) error {
+		r := bufio.NewReaderSize(stdout, 64*1024)
+		buf := make([]byte, 2)
+		lo, hi, n := 0, 0, 0
+		for {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				return err
+			}
+			sample := int(int16(binary.LittleEndian.Uint16(buf)))
+			if n == 0 || sample < lo {
+				lo = sample
+			}
+			if n == 0 || sample > hi {
+				hi = sample
+			}
+			n++
+			if n == samplesPerPixel {
+				if len(peaks) >= 2*maxWaveformPeaks {
+					return fmt.Errorf("more than %d peaks, use more samples per pixel", maxWaveformPeaks)
+				}
+				peaks = append(peaks, lo, hi)
+				n = 0
+			}
+		}
+		if n > 0 {
+			peaks = append(peaks, lo, hi)
+		}
+		return nil
+	})
+	return peaks, err
+}
+
+// draw the peaks as vertical lines, one column per pair
+func drawWaveform(peaks []int, width int, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	wave := color.RGBA{R: 0x33, G: 0x66, B: 0x99, A: 0xff}
+	columns := len(peaks) / 2
+	// y coordinate of a sample, positive values are up
+	y := func(sample int) int {
+		return min(max((32767-sample)*(height-1)/65535, 0), height-1)
+	}
+	for x := 0; x < width; x++ {
+		// several pairs may fall into one column if the duration was estimated too short
+		from, to := x*columns/width, (x+1)*columns/width
+		if from >= columns {
+			break
+		}
+		to = max(to, from+1)
+		lo, hi := peaks[2*from], peaks[2*from+1]
+		for i := from + 1; i < to; i++ {
+			lo, hi = min(lo, peaks[2*i]), max(hi, peaks[2*i+1])
+		}
+		for py := y(hi); py <= y(lo); py++ {
+			img.Set(x, py, wave)
+		}
+	}
+	return img
+}
@@ -0,0 +1,68 @@
+// Package ptiff writes and reads tiled pyramidal tiff images as used by iiif image servers.
+// every resolution level is stored as a tiled, jpeg compressed image file directory.
+// the reader accepts the pyramids of other writers (libtiff, vips) as well
+package ptiff
+
+import (
+	"encoding/binary"
+)
+
+// tiff tags
+const (
+	tagNewSubfileType            = 254
+	tagImageWidth                = 256
+	tagImageLength               = 257
+	tagBitsPerSample             = 258
+	tagCompression               = 259
+	tagPhotometricInterpretation = 262
+	tagSamplesPerPixel           = 277
+	tagPlanarConfiguration       = 284
+	tagPredictor                 = 317
+	tagTileWidth                 = 322
+	tagTileLength                = 323
+	tagTileOffsets               = 324
+	tagTileByteCounts            = 325
+	tagJPEGTables                = 347
+	tagYCbCrSubSampling          = 530
+)
+
+// field types
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+	typeLong8     = 16
+)
+
+// compression
+const (
+	compressionNone    = 1
+	compressionLZW     = 5
+	compressionJPEG    = 7
+	compressionDeflate = 8
+	compressionAdobe   = 32946
+)
+
+// photometric interpretation
+const (
+	photometricWhiteIsZero = 0
+	photometricMinIsBlack  = 1
+	photometricRGB         = 2
+	photometricYCbCr       = 6
+)
+
+// size in bytes of the field types
+var typeSize = map[uint16]int{
+	typeByte:      1,
+	typeASCII:     1,
+	typeShort:     2,
+	typeLong:      4,
+	typeRational:  8,
+	typeUndefined: 1,
+	typeLong8:     8,
+}
+
+var byteOrder = binary.LittleEndian
@@ -0,0 +1,192 @@
+package ptiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// smooth test image, jpeg keeps it almost unchanged
+func testImage(width int, height int, gray bool) image.Image {
+	if gray {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.SetGray(x, y, color.Gray{uint8(x * 255 / width)})
+			}
+		}
+		return img
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+	return img
+}
+
+// mean absolute difference of the color channels
+func difference(a image.Image, b image.Image) float64 {
+	var sum, n float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x-bounds.Min.X+b.Bounds().Min.X, y-bounds.Min.Y+b.Bounds().Min.Y).RGBA()
+			for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				sum += float64(max(d, -d))
+				n++
+			}
+		}
+	}
+	return sum / n
+}
+
+func encodeFile(t *testing.T, img image.Image, o *Options) *os.File {
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := Encode(f, img, o); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		width, height int
+		gray          bool
+		tileSize      int
+		levels        []image.Point
+	}{
+		{600, 400, false, 128, []image.Point{{600, 400}, {300, 200}, {150, 100}, {75, 50}}},
+		{600, 400, true, 128, []image.Point{{600, 400}, {300, 200}, {150, 100}, {75, 50}}},
+		{257, 100, false, 0, []image.Point{{257, 100}, {129, 50}}},
+		{100, 100, false, 0, []image.Point{{100, 100}}},
+	}
+	for _, test := range tests {
+		img := testImage(test.width, test.height, test.gray)
+		tr, err := NewReader(encodeFile(t, img, &Options{TileSize: test.tileSize, Quality: 95}))
+		if err != nil {
+			t.Fatalf("%dx%d: %v", test.width, test.height, err)
+		}
+		levels := tr.Levels()
+		if len(levels) != len(test.levels) {
+			t.Fatalf("%dx%d: %d levels, expected %d", test.width, test.height, len(levels), len(test.levels))
+		}
+		for i, l := range levels {
+			if l.Width != test.levels[i].X || l.Height != test.levels[i].Y || !l.Tiled {
+				t.Errorf("%dx%d: level %d is %+v", test.width, test.height, i, l)
+			}
+		}
+		full, err := tr.ReadRegion(0, image.Rect(0, 0, test.width, test.height))
+		if err != nil {
+			t.Fatalf("%dx%d: %v", test.width, test.height, err)
+		}
+		if _, ok := full.(*image.Gray); ok != test.gray {
+			t.Errorf("%dx%d: decoded as %T", test.width, test.height, full)
+		}
+		if d := difference(img, full); d > 3 {
+			t.Errorf("%dx%d: difference %.2f", test.width, test.height, d)
+		}
+		// region across tile borders
+		rect := image.Rect(test.width/3, test.height/3, test.width*2/3, test.height*2/3)
+		region, err := tr.ReadRegion(0, rect)
+		if err != nil {
+			t.Fatalf("%dx%d: %v", test.width, test.height, err)
+		}
+		if region.Bounds() != image.Rect(0, 0, rect.Dx(), rect.Dy()) {
+			t.Errorf("%dx%d: region bounds %v", test.width, test.height, region.Bounds())
+		}
+		if d := difference(img.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(rect), region); d > 3 {
+			t.Errorf("%dx%d: difference of region %.2f", test.width, test.height, d)
+		}
+	}
+}
+
+// striped tiffs of other writers
+func TestReadStrips(t *testing.T) {
+	tests := []struct {
+		img  image.Image
+		opts *tiff.Options
+	}{
+		{testImage(300, 200, false), nil},
+		{testImage(300, 200, true), nil},
+		{testImage(300, 200, false), &tiff.Options{Compression: tiff.Deflate, Predictor: true}},
+		{testImage(300, 200, true), &tiff.Options{Compression: tiff.Deflate}},
+	}
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		if err := tiff.Encode(buf, test.img, test.opts); err != nil {
+			t.Fatal(err)
+		}
+		tr, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		region, err := tr.ReadRegion(0, image.Rect(0, 0, 300, 200))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if d := difference(test.img, region); d != 0 {
+			t.Errorf("%d: difference %.2f", i, d)
+		}
+	}
+}
+
+// a strip of the whole image is rejected before its memory is allocated
+func TestHugeStrip(t *testing.T) {
+	const size = 1 << 20
+	type entry struct {
+		tag, typ uint16
+		value    uint32
+	}
+	entries := []entry{
+		{tagImageWidth, typeLong, size},
+		{tagImageLength, typeLong, size},
+		{tagBitsPerSample, typeShort, 8},
+		{tagCompression, typeShort, compressionNone},
+		{tagPhotometricInterpretation, typeShort, photometricMinIsBlack},
+		{tagStripOffsets, typeLong, 8},
+		{tagSamplesPerPixel, typeShort, 1},
+		{tagRowsPerStrip, typeLong, size},
+		{tagStripByteCounts, typeLong, 16},
+	}
+	data := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+	ifd := len(data) + 16
+	binary.LittleEndian.PutUint32(data[4:], uint32(ifd))
+	data = append(data, make([]byte, 16)...)
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(entries)))
+	for _, e := range entries {
+		data = binary.LittleEndian.AppendUint16(data, e.tag)
+		data = binary.LittleEndian.AppendUint16(data, e.typ)
+		data = binary.LittleEndian.AppendUint32(data, 1)
+		if e.typ == typeShort {
+			data = binary.LittleEndian.AppendUint16(data, uint16(e.value))
+			data = append(data, 0, 0)
+		} else {
+			data = binary.LittleEndian.AppendUint32(data, e.value)
+		}
+	}
+	data = append(data, 0, 0, 0, 0)
+
+	tr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.ReadRegion(0, image.Rect(0, 0, 10, 10)); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected error for huge strip, got %v", err)
+	}
+}
@@ -0,0 +1,515 @@
+package ptiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"sort"
+
+	"golang.org/x/image/tiff/lzw"
+)
+
+// more tiff tags of the reader
+const (
+	tagStripOffsets    = 273
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagSubIFDs         = 330
+	tagSampleFormat    = 339
+)
+
+// field types of sub directory offsets
+const (
+	typeIFD  = 13
+	typeIFD8 = 18
+)
+
+// reduced resolution images are used as levels, transparency masks are skipped
+const subfileMask = 4
+
+// limit of the memory for a field, a compressed tile and a decoded tile
+const maxDataSize = 1 << 28
+
+// Level is a resolution of a pyramidal tiff
+type Level struct {
+	Width  int
+	Height int
+	// size of the tiles. striped images have tiles of the full width
+	TileWidth  int
+	TileHeight int
+	Tiled      bool
+}
+
+// image file directory of a level
+type level struct {
+	Level
+	compression uint16
+	photometric uint16
+	samples     int
+	predictor   uint16
+	jpegTables  []byte
+	offsets     []uint64
+	counts      []uint64
+}
+
+// Reader reads regions of the levels of a tiled or striped tiff.
+// supported are 8 bit gray, rgb and ycbcr images, uncompressed or compressed with jpeg, deflate or lzw
+type Reader struct {
+	r         io.ReaderAt
+	byteOrder binary.ByteOrder
+	bigTIFF   bool
+	levels    []*level
+}
+
+// NewReader reads the directories of the tiff. levels with a different aspect ratio (e.g. thumbnails
+// of other content) or unsupported parameters are skipped
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header[:8], 0); err != nil {
+		return nil, fmt.Errorf("cannot read tiff header: %v", err)
+	}
+	tr := &Reader{r: r}
+	switch string(header[:2]) {
+	case "II":
+		tr.byteOrder = binary.LittleEndian
+	case "MM":
+		tr.byteOrder = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("no tiff file")
+	}
+	var next uint64
+	switch tr.byteOrder.Uint16(header[2:]) {
+	case 42:
+		next = uint64(tr.byteOrder.Uint32(header[4:]))
+	case 43:
+		if _, err := r.ReadAt(header, 0); err != nil {
+			return nil, fmt.Errorf("cannot read bigtiff header: %v", err)
+		}
+		tr.bigTIFF = true
+		next = tr.byteOrder.Uint64(header[8:])
+	default:
+		return nil, fmt.Errorf("no tiff file")
+	}
+
+	offsets := []uint64{}
+	visited := map[uint64]bool{}
+	var firstErr error
+	for next != 0 && !visited[next] {
+		visited[next] = true
+		ifd, subIFDs, nextIFD, err := tr.readIFD(next)
+		if err != nil {
+			return nil, err
+		}
+		// pyramids of some writers are sub directories of the first image
+		offsets = append(offsets, subIFDs...)
+		if l, err := tr.newLevel(ifd); err == nil {
+			tr.levels = append(tr.levels, l)
+		} else if firstErr == nil {
+			firstErr = err
+		}
+		next = nextIFD
+	}
+	for _, offset := range offsets {
+		if visited[offset] {
+			continue
+		}
+		visited[offset] = true
+		ifd, _, _, err := tr.readIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		if l, err := tr.newLevel(ifd); err == nil {
+			tr.levels = append(tr.levels, l)
+		}
+	}
+	if len(tr.levels) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no image found")
+		}
+		return nil, firstErr
+	}
+
+	sort.SliceStable(tr.levels, func(i, j int) bool { return tr.levels[i].Width > tr.levels[j].Width })
+	full := tr.levels[0]
+	levels := []*level{full}
+	for _, l := range tr.levels[1:] {
+		// height of the level according to the aspect ratio of the full resolution
+		height := int((int64(l.Width)*int64(full.Height) + int64(full.Width)/2) / int64(full.Width))
+		if l.Width == levels[len(levels)-1].Width || abs(height-l.Height) > 1+l.Height/100 {
+			continue
+		}
+		levels = append(levels, l)
+	}
+	tr.levels = levels
+	return tr, nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Levels returns the resolutions, the full resolution first
+func (tr *Reader) Levels() []Level {
+	result := make([]Level, len(tr.levels))
+	for i, l := range tr.levels {
+		result[i] = l.Level
+	}
+	return result
+}
+
+// fields of a directory by tag as unsigned values
+type ifdFields map[uint16][]uint64
+
+// raw content of fields which are not numeric
+type ifdData map[uint16][]byte
+
+type directory struct {
+	fields ifdFields
+	data   ifdData
+}
+
+func (d *directory) value(tag uint16, def uint64) uint64 {
+	if v, ok := d.fields[tag]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+// read the directory at offset. returns the directory, the offsets of sub directories and the next directory
+func (tr *Reader) readIFD(offset uint64) (*directory, []uint64, uint64, error) {
+	countSize, entrySize, offsetSize := 2, 12, 4
+	if tr.bigTIFF {
+		countSize, entrySize, offsetSize = 8, 20, 8
+	}
+	buf := make([]byte, countSize)
+	if _, err := tr.r.ReadAt(buf, int64(offset)); err != nil {
+		return nil, nil, 0, fmt.Errorf("cannot read directory at %d: %v", offset, err)
+	}
+	var count uint64
+	if tr.bigTIFF {
+		count = tr.byteOrder.Uint64(buf)
+	} else {
+		count = uint64(tr.byteOrder.Uint16(buf))
+	}
+	if count > 4096 {
+		return nil, nil, 0, fmt.Errorf("invalid directory at %d with %d entries", offset, count)
+	}
+	buf = make([]byte, int(count)*entrySize+offsetSize)
+	if _, err := tr.r.ReadAt(buf, int64(offset)+int64(countSize)); err != nil {
+		return nil, nil, 0, fmt.Errorf("cannot read directory at %d: %v", offset, err)
+	}
+
+	d := &directory{fields: ifdFields{}, data: ifdData{}}
+	for i := 0; i < int(count); i++ {
+		entry := buf[i*entrySize : (i+1)*entrySize]
+		tag := tr.byteOrder.Uint16(entry)
+		typ := tr.byteOrder.Uint16(entry[2:])
+		var n uint64
+		var inline []byte
+		if tr.bigTIFF {
+			n = tr.byteOrder.Uint64(entry[4:])
+			inline = entry[12:20]
+		} else {
+			n = uint64(tr.byteOrder.Uint32(entry[4:]))
+			inline = entry[8:12]
+		}
+		size := fieldSize(typ)
+		if size == 0 {
+			// unknown types are not needed
+			continue
+		}
+		if n > maxDataSize/uint64(size) {
+			return nil, nil, 0, fmt.Errorf("field %d too large", tag)
+		}
+		raw := make([]byte, int(n)*size)
+		if len(raw) <= len(inline) {
+			copy(raw, inline)
+		} else {
+			var pos uint64
+			if tr.bigTIFF {
+				pos = tr.byteOrder.Uint64(inline)
+			} else {
+				pos = uint64(tr.byteOrder.Uint32(inline))
+			}
+			if _, err := tr.r.ReadAt(raw, int64(pos)); err != nil {
+				return nil, nil, 0, fmt.Errorf("cannot read field %d: %v", tag, err)
+			}
+		}
+		d.data[tag] = raw
+		values := make([]uint64, 0, n)
+		switch typ {
+		case typeByte, typeUndefined:
+			for _, b := range raw {
+				values = append(values, uint64(b))
+			}
+		case typeShort:
+			for j := 0; j < len(raw); j += 2 {
+				values = append(values, uint64(tr.byteOrder.Uint16(raw[j:])))
+			}
+		case typeLong, typeIFD:
+			for j := 0; j < len(raw); j += 4 {
+				values = append(values, uint64(tr.byteOrder.Uint32(raw[j:])))
+			}
+		case typeLong8, typeIFD8:
+			for j := 0; j < len(raw); j += 8 {
+				values = append(values, tr.byteOrder.Uint64(raw[j:]))
+			}
+		default:
+			continue
+		}
+		d.fields[tag] = values
+	}
+	var next uint64
+	if tr.bigTIFF {
+		next = tr.byteOrder.Uint64(buf[int(count)*entrySize:])
+	} else {
+		next = uint64(tr.byteOrder.Uint32(buf[int(count)*entrySize:]))
+	}
+	return d, d.fields[tagSubIFDs], next, nil
+}
+
+// size in bytes of a field type, 0 if unknown
+func fieldSize(typ uint16) int {
+	switch typ {
+	case typeIFD:
+		return 4
+	case typeIFD8:
+		return 8
+	// signed and floating point values
+	case 6:
+		return 1
+	case 8:
+		return 2
+	case 9, 11:
+		return 4
+	case 10, 12, 17:
+		return 8
+	}
+	return typeSize[typ]
+}
+
+// check the parameters of a directory
+func (tr *Reader) newLevel(d *directory) (*level, error) {
+	if d.value(tagNewSubfileType, 0)&subfileMask != 0 {
+		return nil, fmt.Errorf("transparency mask")
+	}
+	l := &level{
+		compression: uint16(d.value(tagCompression, compressionNone)),
+		photometric: uint16(d.value(tagPhotometricInterpretation, photometricMinIsBlack)),
+		samples:     int(d.value(tagSamplesPerPixel, 1)),
+		predictor:   uint16(d.value(tagPredictor, 1)),
+		jpegTables:  d.data[tagJPEGTables],
+	}
+	l.Width = int(d.value(tagImageWidth, 0))
+	l.Height = int(d.value(tagImageLength, 0))
+	if l.Width <= 0 || l.Height <= 0 || l.Width > 1<<20 || l.Height > 1<<20 {
+		return nil, fmt.Errorf("invalid image size %vx%v", l.Width, l.Height)
+	}
+	for _, bits := range d.fields[tagBitsPerSample] {
+		if bits != 8 {
+			return nil, fmt.Errorf("unsupported bits per sample %d", bits)
+		}
+	}
+	if d.value(tagPlanarConfiguration, 1) != 1 {
+		return nil, fmt.Errorf("unsupported planar configuration")
+	}
+	if d.value(tagSampleFormat, 1) != 1 {
+		return nil, fmt.Errorf("unsupported sample format")
+	}
+	switch l.compression {
+	case compressionNone, compressionLZW, compressionDeflate, compressionAdobe, compressionJPEG:
+	default:
+		return nil, fmt.Errorf("unsupported compression %d", l.compression)
+	}
+	switch {
+	case l.compression == compressionJPEG && (l.samples == 1 || l.samples == 3):
+	case l.photometric == photometricMinIsBlack && (l.samples == 1 || l.samples == 2):
+	case l.photometric == photometricWhiteIsZero && l.samples == 1:
+	case l.photometric == photometricRGB && (l.samples == 3 || l.samples == 4):
+	default:
+		return nil, fmt.Errorf("unsupported photometric interpretation %d with %d samples", l.photometric, l.samples)
+	}
+	if l.predictor != 1 && l.predictor != 2 {
+		return nil, fmt.Errorf("unsupported predictor %d", l.predictor)
+	}
+
+	if _, ok := d.fields[tagTileWidth]; ok {
+		l.Tiled = true
+		l.TileWidth = int(d.value(tagTileWidth, 0))
+		l.TileHeight = int(d.value(tagTileLength, 0))
+		l.offsets = d.fields[tagTileOffsets]
+		l.counts = d.fields[tagTileByteCounts]
+	} else {
+		l.TileWidth = l.Width
+		l.TileHeight = int(min(d.value(tagRowsPerStrip, uint64(l.Height)), uint64(l.Height)))
+		l.offsets = d.fields[tagStripOffsets]
+		l.counts = d.fields[tagStripByteCounts]
+	}
+	if l.TileWidth <= 0 || l.TileHeight <= 0 || l.Tiled && (l.TileWidth > 1<<16 || l.TileHeight > 1<<16) {
+		return nil, fmt.Errorf("invalid tile size %vx%v", l.TileWidth, l.TileHeight)
+	}
+	across := (l.Width + l.TileWidth - 1) / l.TileWidth
+	down := (l.Height + l.TileHeight - 1) / l.TileHeight
+	if len(l.offsets) < across*down || len(l.counts) < across*down {
+		return nil, fmt.Errorf("missing tiles")
+	}
+	return l, nil
+}
+
+// ReadRegion decodes rect of a level. the result is *image.Gray for gray levels and *image.RGBA otherwise,
+// its bounds start at 0,0
+func (tr *Reader) ReadRegion(index int, rect image.Rectangle) (draw.Image, error) {
+	if index < 0 || index >= len(tr.levels) {
+		return nil, fmt.Errorf("invalid level %d", index)
+	}
+	l := tr.levels[index]
+	rect = rect.Intersect(image.Rect(0, 0, l.Width, l.Height))
+	if rect.Empty() {
+		return nil, fmt.Errorf("empty region")
+	}
+	var dst draw.Image
+	if l.samples <= 2 {
+		dst = image.NewGray(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	}
+	across := (l.Width + l.TileWidth - 1) / l.TileWidth
+	for ty := rect.Min.Y / l.TileHeight; ty*l.TileHeight < rect.Max.Y; ty++ {
+		for tx := rect.Min.X / l.TileWidth; tx*l.TileWidth < rect.Max.X; tx++ {
+			tile, err := tr.readTile(l, ty*across+tx)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read tile %d/%d: %v", tx, ty, err)
+			}
+			origin := image.Pt(tx*l.TileWidth, ty*l.TileHeight)
+			area := image.Rectangle{Min: origin, Max: origin.Add(tile.Bounds().Size())}.Intersect(rect)
+			draw.Draw(dst, area.Sub(rect.Min), tile, area.Min.Sub(origin).Add(tile.Bounds().Min), draw.Src)
+		}
+	}
+	return dst, nil
+}
+
+// decode a tile or strip
+func (tr *Reader) readTile(l *level, index int) (image.Image, error) {
+	count := l.counts[index]
+	if count == 0 || count > maxDataSize {
+		return nil, fmt.Errorf("invalid size %d", count)
+	}
+	data := make([]byte, count)
+	if _, err := tr.r.ReadAt(data, int64(l.offsets[index])); err != nil {
+		return nil, err
+	}
+	// the last strip may be shorter
+	width, height := l.TileWidth, l.TileHeight
+	if !l.Tiled {
+		height = min(height, l.Height-index*l.TileHeight)
+	}
+	// strips of untiled images can have the size of the whole image
+	if int64(width)*int64(height)*4 > maxDataSize {
+		return nil, fmt.Errorf("tile of %dx%d pixels too large", width, height)
+	}
+	if l.compression == compressionJPEG {
+		return decodeJPEGTile(l, data)
+	}
+
+	rowSize := width * l.samples
+	var src io.Reader = bytes.NewReader(data)
+	switch l.compression {
+	case compressionLZW:
+		rc := lzw.NewReader(src, lzw.MSB, 8)
+		defer rc.Close()
+		src = rc
+	case compressionDeflate, compressionAdobe:
+		rc, err := zlib.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		src = rc
+	}
+	pix := make([]byte, rowSize*height)
+	if _, err := io.ReadFull(src, pix); err != nil {
+		return nil, fmt.Errorf("cannot decompress: %v", err)
+	}
+	if l.predictor == 2 {
+		for y := 0; y < height; y++ {
+			row := pix[y*rowSize : (y+1)*rowSize]
+			for x := l.samples; x < rowSize; x++ {
+				row[x] += row[x-l.samples]
+			}
+		}
+	}
+
+	rect := image.Rect(0, 0, width, height)
+	switch l.samples {
+	case 1:
+		img := image.NewGray(rect)
+		copy(img.Pix, pix)
+		if l.photometric == photometricWhiteIsZero {
+			for i := range img.Pix {
+				img.Pix[i] = 255 - img.Pix[i]
+			}
+		}
+		return img, nil
+	case 2:
+		img := image.NewNRGBA(rect)
+		for i := 0; i < width*height; i++ {
+			v := pix[2*i]
+			copy(img.Pix[4*i:], []byte{v, v, v, pix[2*i+1]})
+		}
+		return img, nil
+	case 3:
+		img := image.NewRGBA(rect)
+		for i := 0; i < width*height; i++ {
+			copy(img.Pix[4*i:], []byte{pix[3*i], pix[3*i+1], pix[3*i+2], 255})
+		}
+		return img, nil
+	default:
+		// extra sample is taken as unassociated alpha
+		img := image.NewNRGBA(rect)
+		copy(img.Pix, pix)
+		return img, nil
+	}
+}
+
+// jpeg tiles may share their tables, which are stored without image data in the directory
+func decodeJPEGTile(l *level, data []byte) (image.Image, error) {
+	if len(l.jpegTables) > 4 && len(data) > 2 {
+		// remove end of image of the tables and start of image of the tile
+		joined := make([]byte, 0, len(l.jpegTables)+len(data))
+		joined = append(joined, l.jpegTables[:len(l.jpegTables)-2]...)
+		data = append(joined, data[2:]...)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height)*4 > maxDataSize {
+		return nil, fmt.Errorf("tile of %dx%d pixels too large", cfg.Width, cfg.Height)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	// rgb stored in a jpeg without adobe marker is decoded as ycbcr
+	if ycc, ok := img.(*image.YCbCr); ok && l.photometric == photometricRGB && ycc.SubsampleRatio == image.YCbCrSubsampleRatio444 {
+		b := ycc.Bounds()
+		rgb := image.NewRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				yi, ci := ycc.YOffset(x, y), ycc.COffset(x, y)
+				rgb.SetRGBA(x, y, color.RGBA{ycc.Y[yi], ycc.Cb[ci], ycc.Cr[ci], 255})
+			}
+		}
+		return rgb, nil
+	}
+	return img, nil
+}
@@ -0,0 +1,241 @@
+package ptiff
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// Options of the encoder
+type Options struct {
+	// width and height of the tiles (multiple of 16). default 256
+	TileSize int
+	// jpeg quality of the tiles. default 85
+	Quality int
+}
+
+// field of an image file directory
+type field struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func shortField(tag uint16, values ...uint16) field {
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		byteOrder.PutUint16(data[2*i:], v)
+	}
+	return field{tag: tag, typ: typeShort, count: uint32(len(values)), data: data}
+}
+
+func longField(tag uint16, values ...uint32) field {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		byteOrder.PutUint32(data[4*i:], v)
+	}
+	return field{tag: tag, typ: typeLong, count: uint32(len(values)), data: data}
+}
+
+// writer which keeps track of the position
+type countingWriter struct {
+	w   io.WriteSeeker
+	pos int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.pos += int64(n)
+	return n, err
+}
+
+// pad to word boundary
+func (cw *countingWriter) align() error {
+	if cw.pos%2 == 1 {
+		_, err := cw.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// Encode writes img as tiled pyramidal tiff with jpeg compressed tiles.
+// the first directory contains the full resolution, every following one half of the previous
+func Encode(w io.WriteSeeker, img image.Image, o *Options) error {
+	tileSize := 256
+	quality := 85
+	if o != nil {
+		if o.TileSize > 0 {
+			tileSize = (o.TileSize + 15) / 16 * 16
+		}
+		if o.Quality > 0 {
+			quality = o.Quality
+		}
+	}
+
+	// grayscale images are stored with one sample
+	var level draw.Image
+	gray := false
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		gray = true
+		level = image.NewGray(img.Bounds().Sub(img.Bounds().Min))
+	default:
+		level = image.NewRGBA(img.Bounds().Sub(img.Bounds().Min))
+	}
+	draw.Draw(level, level.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	cw := &countingWriter{w: w}
+	// little endian header, offset of first directory is patched later
+	if _, err := cw.Write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	nextOffsetPos := int64(4)
+
+	for subfile := uint32(0); ; subfile = 1 {
+		width := level.Bounds().Dx()
+		height := level.Bounds().Dy()
+		if width > math.MaxUint32 || height > math.MaxUint32 {
+			return fmt.Errorf("image too large: %vx%v", width, height)
+		}
+		across := (width + tileSize - 1) / tileSize
+		down := (height + tileSize - 1) / tileSize
+		offsets := make([]uint32, 0, across*down)
+		counts := make([]uint32, 0, across*down)
+
+		var tile draw.Image
+		if gray {
+			tile = image.NewGray(image.Rect(0, 0, tileSize, tileSize))
+		} else {
+			tile = image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+		}
+		buf := &bytes.Buffer{}
+		for ty := 0; ty < down; ty++ {
+			for tx := 0; tx < across; tx++ {
+				draw.Draw(tile, tile.Bounds(), image.Transparent, image.Point{}, draw.Src)
+				draw.Draw(tile, tile.Bounds(), level, image.Pt(tx*tileSize, ty*tileSize), draw.Src)
+				buf.Reset()
+				if err := jpeg.Encode(buf, tile, &jpeg.Options{Quality: quality}); err != nil {
+					return fmt.Errorf("cannot encode tile: %v", err)
+				}
+				if cw.pos+int64(buf.Len()) > math.MaxUint32 {
+					return fmt.Errorf("image too large for tiff")
+				}
+				offsets = append(offsets, uint32(cw.pos))
+				counts = append(counts, uint32(buf.Len()))
+				if _, err := cw.Write(buf.Bytes()); err != nil {
+					return err
+				}
+				if err := cw.align(); err != nil {
+					return err
+				}
+			}
+		}
+
+		fields := []field{
+			longField(tagNewSubfileType, subfile),
+			longField(tagImageWidth, uint32(width)),
+			longField(tagImageLength, uint32(height)),
+			shortField(tagCompression, compressionJPEG),
+			shortField(tagPlanarConfiguration, 1),
+			shortField(tagTileWidth, uint16(tileSize)),
+			shortField(tagTileLength, uint16(tileSize)),
+			longField(tagTileOffsets, offsets...),
+			longField(tagTileByteCounts, counts...),
+		}
+		if gray {
+			fields = append(fields,
+				shortField(tagBitsPerSample, 8),
+				shortField(tagPhotometricInterpretation, photometricMinIsBlack),
+				shortField(tagSamplesPerPixel, 1),
+			)
+		} else {
+			// the go jpeg encoder writes YCbCr 4:2:0
+			fields = append(fields,
+				shortField(tagBitsPerSample, 8, 8, 8),
+				shortField(tagPhotometricInterpretation, photometricYCbCr),
+				shortField(tagSamplesPerPixel, 3),
+				shortField(tagYCbCrSubSampling, 2, 2),
+			)
+		}
+		ifdOffset := cw.pos
+		pos, err := writeIFD(cw, fields)
+		if err != nil {
+			return err
+		}
+		// link previous directory
+		if _, err := w.Seek(nextOffsetPos, io.SeekStart); err != nil {
+			return err
+		}
+		offset := make([]byte, 4)
+		byteOrder.PutUint32(offset, uint32(ifdOffset))
+		if _, err := w.Write(offset); err != nil {
+			return err
+		}
+		if _, err := w.Seek(cw.pos, io.SeekStart); err != nil {
+			return err
+		}
+		nextOffsetPos = pos
+
+		if width <= tileSize && height <= tileSize {
+			break
+		}
+		// next level with half the size
+		next := image.Rect(0, 0, (width+1)/2, (height+1)/2)
+		var scaled draw.Image
+		if gray {
+			scaled = image.NewGray(next)
+		} else {
+			scaled = image.NewRGBA(next)
+		}
+		draw.ApproxBiLinear.Scale(scaled, next, level, level.Bounds(), draw.Src, nil)
+		level = scaled
+	}
+	return nil
+}
+
+// write directory with its external values. returns the position of the next directory offset
+func writeIFD(cw *countingWriter, fields []field) (int64, error) {
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+	ifdSize := int64(2 + 12*len(fields) + 4)
+	extraPos := cw.pos + ifdSize
+	ifd := &bytes.Buffer{}
+	extra := &bytes.Buffer{}
+	b := make([]byte, 12)
+	byteOrder.PutUint16(b, uint16(len(fields)))
+	ifd.Write(b[:2])
+	for _, f := range fields {
+		byteOrder.PutUint16(b[0:], f.tag)
+		byteOrder.PutUint16(b[2:], f.typ)
+		byteOrder.PutUint32(b[4:], f.count)
+		for i := 8; i < 12; i++ {
+			b[i] = 0
+		}
+		if len(f.data) <= 4 {
+			copy(b[8:], f.data)
+		} else {
+			byteOrder.PutUint32(b[8:], uint32(extraPos+int64(extra.Len())))
+			extra.Write(f.data)
+			if extra.Len()%2 == 1 {
+				extra.WriteByte(0)
+			}
+		}
+		ifd.Write(b)
+	}
+	nextPos := cw.pos + int64(ifd.Len())
+	// no next directory yet
+	ifd.Write([]byte{0, 0, 0, 0})
+	if _, err := cw.Write(ifd.Bytes()); err != nil {
+		return 0, err
+	}
+	if _, err := cw.Write(extra.Bytes()); err != nil {
+		return 0, err
+	}
+	return nextPos, nil
+}
@@ -4,12 +4,13 @@ go 1.24.2
 
 require (
 	github.com/BurntSushi/toml v1.5.0
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-sql-driver/mysql v1.9.2
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/mash/go-accesslog v1.3.0
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
-	github.com/tomasen/fcgi_client v0.0.0-20180423082037-2bb3d819fd19
+	golang.org/x/image v0.27.0
 )
 
 require filippo.io/edwards25519 v1.1.0 // indirect
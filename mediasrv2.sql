@@ -0,0 +1,48 @@
+-- tables used by mediasrv2 in addition to the mediaserver schema
+
+-- expected checksums of cache entries (same key as fullcache)
+CREATE TABLE IF NOT EXISTS `fixity` (
+  `collection_id` int(11) NOT NULL,
+  `signature` varchar(255) NOT NULL,
+  `action` varchar(64) NOT NULL,
+  `param` varchar(255) NOT NULL DEFAULT '',
+  `algorithm` varchar(16) NOT NULL,
+  `digest` varchar(128) NOT NULL,
+  PRIMARY KEY (`collection_id`, `signature`, `action`, `param`, `algorithm`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- asynchronous creation of derivatives
+CREATE TABLE IF NOT EXISTS `job` (
+  `jobid` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  -- random public id of the job
+  `ticket` char(32) NOT NULL,
+  `collection_id` int(11) NOT NULL,
+  `signature` varchar(255) NOT NULL,
+  `action` varchar(64) NOT NULL,
+  `param` varchar(255) NOT NULL DEFAULT '',
+  -- access token of the request which queued the job
+  `token` text,
+  `status` enum('queued','running','done','failed') NOT NULL DEFAULT 'queued',
+  `progress` float NOT NULL DEFAULT 0,
+  `message` text,
+  `worker` varchar(255) DEFAULT NULL,
+  `created` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`jobid`),
+  UNIQUE KEY `ticket` (`ticket`),
+  KEY `status` (`status`, `jobid`),
+  KEY `derivative` (`collection_id`, `signature`, `action`, `param`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- labels and descriptive metadata of masters for iiif manifests
+-- the fields label, summary and rights (uri of the license) are properties of the manifest,
+-- all other fields are listed as metadata. language is a bcp 47 code or none
+CREATE TABLE IF NOT EXISTS `iiifmetadata` (
+  `collection_id` int(11) NOT NULL,
+  `signature` varchar(255) NOT NULL,
+  `field` varchar(255) NOT NULL,
+  `language` varchar(16) NOT NULL DEFAULT 'none',
+  `value` text NOT NULL,
+  `sort` int(11) NOT NULL DEFAULT 0,
+  KEY `master` (`collection_id`, `signature`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
-	"github.com/je4/mediaserver2/digma/data"
 	"github.com/je4/mediaserver2/digma/mediaserver"
 	"log"
 	"os"
@@ -53,6 +52,12 @@ func main() {
 
 	// get location of config file
 	cfgfile := flag.String("cfg", "/etc/mediasrv2.toml", "location of config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [options] [command]\n\ncommands:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  fixity\tverify the checksums of all cache entries and report mismatches as json\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  reconcile [-delete]\treport fullcache rows and masters without files and files without rows as json\n\noptions:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	cfg := mediaserver.LoadConfig(*cfgfile)
 
@@ -100,7 +105,38 @@ func main() {
 	}
 
 	// create mediaserver route
-	ms := mediaserver.New(db, &cfg, _log)
+	ms, err := mediaserver.New(db, &cfg, _log)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// commands
+	switch flag.Arg(0) {
+	case "":
+	case "fixity":
+		report, err := ms.FixityAudit(os.Stdout)
+		if err != nil {
+			log.Fatalf("fixity audit failed: %v", err)
+		}
+		if len(report.Mismatches) > 0 {
+			os.Exit(1)
+		}
+		return
+	case "reconcile":
+		reconcileFlags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+		deleteStale := reconcileFlags.Bool("delete", false, "delete cache rows of missing derivatives")
+		reconcileFlags.Parse(flag.Args()[1:])
+		report, err := ms.Reconcile(os.Stdout, *deleteStale)
+		if err != nil {
+			log.Fatalf("reconcile failed: %v", err)
+		}
+		if len(report.Missing) > 0 || len(report.Orphans) > 0 {
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %s", flag.Arg(0))
+	}
 
 	// create a new router
 	router := httprouter.New()
@@ -148,88 +184,35 @@ func main() {
 	   	})
 	*/
 	// route with parameters
-	router.GET(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature/:action/*params", func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	// parameters are normalized by the action
+	actionHandler := func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		collection := params.ByName("collection")
 		signature := params.ByName("signature")
 		action := params.ByName("action")
-		paramString := strings.ToLower(params.ByName("params"))
-		if action == "replay" {
-			//fmt.Println(paramString)
-			if paramString == "/sw.js" {
-				writer.Header().Set("Content-Type", "text/javascript")
-				writer.Write(data.Sw_js)
-				return
-			}
-			if paramString == "/ui.js" {
-				writer.Header().Set("Content-Type", "text/javascript")
-				writer.Write(data.Ui_js)
-				return
-			}
-		}
-		ps := strings.Split(paramString, "/")
+		ps := strings.Split(params.ByName("params"), "/")
 		writer.Header().Set("Server", VERSION)
 		writer.Header().Set("Access-Control-Allow-Origin", "*")
 		ms.Handler(writer, req, collection, signature, action, ps)
-	})
+	}
+	router.GET(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature/:action/*params", actionHandler)
+	router.HEAD(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature/:action/*params", actionHandler)
 
-	router.HEAD(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature/:action/*params", func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
-		collection := params.ByName("collection")
-		signature := params.ByName("signature")
-		action := params.ByName("action")
-		paramString := strings.ToLower(params.ByName("params"))
-		ps := strings.Split(paramString, "/")
+	// route without parameters
+	router.GET(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature/:action", actionHandler)
+	router.HEAD(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature/:action", actionHandler)
+
+	// route for the IIIF collection of a collection
+	collectionHandler := func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		writer.Header().Set("Server", VERSION)
 		writer.Header().Set("Access-Control-Allow-Origin", "*")
-		ms.Handler(writer, req, collection, signature, action, ps)
-	})
-
-	// route without parameters
-	router.GET(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature/:action", func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
-		collection := params.ByName("collection")
-		signature := params.ByName("signature")
-		action := params.ByName("action")
-		paramString := ""
-		ps := strings.Split(paramString, "/")
-		url := req.URL.Query().Get("url")
-		if action == "webrecorder" {
-			html := `
-<html>
-<head>
-</head>
-<body>
-	<replay-web-page 
-		source="master"
-		%%URL%%
-	</replay-web-page>
-	<script src="replay/ui.js"></script>
-</body>
-</html>
-`
-			//var str string
-			if url != "" {
-				//str = "%%URL%%", "url=\"" + url + "\""
-				html = strings.ReplaceAll(html, "%%URL%%", "url=\""+url+"\"")
-			}
-			//html = strings.ReplaceAll(html, str)
-			//			html = fmt.Sprintf(html, )
-			writer.Header().Set("Content-Type", "text/html")
-			writer.Write([]byte(html))
+		if params.ByName("signature") != mediaserver.IIIFCollectionSignature {
+			ms.DoPanic(writer, req, http.StatusNotFound, fmt.Sprintf("no action for %s/%s", params.ByName("collection"), params.ByName("signature")))
 			return
 		}
-		writer.Header().Set("Server", VERSION)
-		writer.Header().Set("Access-Control-Allow-Origin", "*")
-		ms.Handler(writer, req, collection, signature, action, ps)
-	})
-	router.HEAD(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature/:action", func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
-		collection := params.ByName("collection")
-		signature := params.ByName("signature")
-		action := params.ByName("action")
-		paramString := ""
-		ps := strings.Split(paramString, "/")
-		writer.Header().Set("Server", VERSION)
-		writer.Header().Set("Access-Control-Allow-Origin", "*")
-		ms.Handler(writer, req, collection, signature, action, ps)
-	})
+		ms.HandlerIIIFCollection(writer, req, params.ByName("collection"))
+	}
+	router.GET(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature", collectionHandler)
+	router.HEAD(strings.TrimRight(cfg.Mediaserver.Alias, "/")+"/:collection/:signature", collectionHandler)
 
 	// route for IIIF
 	router.GET(strings.TrimRight(cfg.Mediaserver.IIIF.Alias, "/")+"/:token/:service/:api/:file/*params", func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
@@ -250,6 +233,30 @@ func main() {
 		ms.HandlerIIIF(writer, req, file, "", token)
 	})
 
+	// administration routes
+	if cfg.Mediaserver.Admin.Alias != "" {
+		router.GET(strings.TrimRight(cfg.Mediaserver.Admin.Alias, "/")+"/stats", func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			writer.Header().Set("Server", VERSION)
+			ms.HandlerStats(writer, req)
+		})
+		router.POST(strings.TrimRight(cfg.Mediaserver.Admin.Alias, "/")+"/reload", func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			writer.Header().Set("Server", VERSION)
+			ms.HandlerReload(writer, req)
+		})
+	}
+
+	// job status
+	if cfg.Mediaserver.Jobs.Alias != "" {
+		router.GET(strings.TrimRight(cfg.Mediaserver.Jobs.Alias, "/")+"/:id", func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+			writer.Header().Set("Server", VERSION)
+			writer.Header().Set("Access-Control-Allow-Origin", "*")
+			ms.HandlerJob(writer, req, params.ByName("id"))
+		})
+	}
+
+	ms.StartRefresh(cfg.Mediaserver.Refresh)
+	ms.StartJobs()
+
 	addr := cfg.IP + ":" + strconv.Itoa(cfg.Port)
 	_log.Info("Starting HTTP server on", addr)
 
@@ -268,7 +275,7 @@ func main() {
 		}
 	}()
 
-	var gracefulStop = make(chan os.Signal)
+	var gracefulStop = make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
 	sig := <-gracefulStop